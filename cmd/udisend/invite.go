@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+	"udisend/config"
+	"udisend/internal/network"
+	"udisend/pkg/crypt"
+)
+
+// invite mints an invite token signed by the node's auth key.
+func invite(args []string) {
+	flags := flag.NewFlagSet("invite", flag.ExitOnError)
+	listen := flags.String("listen", "", "address the node accepts bootstrap connections on")
+	entry := flags.String("entry", "", "address the newcomer joins through, the -listen one by default")
+	ttl := flags.Duration("ttl", 24*time.Hour, "how long the invite is valid")
+	once := flags.Bool("once", false, "make the invite single-use")
+	flags.Parse(args)
+
+	if *entry == "" {
+		*entry = *listen
+	}
+	if *entry == "" {
+		log.Fatalf("entry address is required")
+	}
+	// Only the inviter knows whether a single-use invite is spent, so the
+	// newcomer has to be verified by this very node.
+	if *once && *entry != *listen {
+		log.Fatalf("single-use invite has to enter through the node's own -listen address")
+	}
+
+	cfg := config.NewConfig()
+	privateAuth, _, err := crypt.LoadOrGenerateKeys(
+		cfg.PrivateAuthKeyFile,
+		cfg.PublickAuthKeyFile,
+	)
+	if err != nil {
+		log.Fatalf("error load auth keys: %v", err)
+	}
+
+	token, err := network.MintInvite(privateAuth, *entry, *ttl, *once)
+	if err != nil {
+		log.Fatalf("error mint invite: %v", err)
+	}
+	fmt.Println(token)
+}
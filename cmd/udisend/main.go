@@ -1,36 +1,192 @@
-package udisend
+package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 	"udisend/config"
 	"udisend/internal/network"
 	"udisend/pkg/closer"
 	"udisend/pkg/crypt"
+
+	"github.com/pion/webrtc/v4"
 )
 
 func main() {
-	cfg := config.NewConfig()
+	if len(os.Args) > 1 && os.Args[1] == "invite" {
+		invite(os.Args[2:])
+		return
+	}
+
+	listen := flag.String("listen", "", "address to accept bootstrap connections on")
+	entry := flag.String("entry", "", "address of a cluster member to join through")
+	chat := flag.String("chat", "", "address of the local chat endpoint, ':9000' by default")
+	var iceServers []config.ICEServer
+	flag.Func("ice", "ICE server as 'url[,username,credential[,password|oauth]]', may be repeated", func(v string) error {
+		srv, err := config.ParseICEServer(v)
+		if err != nil {
+			return err
+		}
+		iceServers = append(iceServers, srv)
+		return nil
+	})
+	peers := flag.String("peers", "", "file to remember known peers in between runs")
+	mail := flag.String("mail", "", "file to keep messages for offline members in")
+	inviteToken := flag.String("invite", "", "invite token to join an invite-only cluster with")
+	inviteOnly := flag.Bool("invite-only", false, "verify newcomers only if they present an invite")
+	var policyRules []string
+	flag.Func("policy", "admission rule as 'allow|deny:id|fingerprint|cidr|signal:value', may be repeated", func(v string) error {
+		if _, err := network.ParsePolicyRule(v); err != nil {
+			return err
+		}
+		policyRules = append(policyRules, v)
+		return nil
+	})
+	quorum := flag.Int("quorum", 0, "votes needed to evict a member, a majority by default")
+	turnListen := flag.String("turn-listen", "", "UDP address to serve STUN/TURN on")
+	turnIP := flag.String("turn-ip", "", "IP advertised by the embedded STUN/TURN server")
+	turnRealm := flag.String("turn-realm", "", "realm of the embedded TURN server")
+	var turnUsers [][2]string
+	flag.Func("turn-user", "TURN user as 'username:password', may be repeated", func(v string) error {
+		user, password, ok := strings.Cut(v, ":")
+		if !ok {
+			return fmt.Errorf("TURN user must be 'username:password'")
+		}
+		turnUsers = append(turnUsers, [2]string{user, password})
+		return nil
+	})
+	flag.Parse()
+
+	with := []config.WithFn{
+		config.WithListenPort(*listen),
+		config.WithEntryPoint(*entry),
+		config.WithTURNServer(*turnListen, *turnIP),
+		config.WithEvictionQuorum(*quorum),
+		config.WithInvite(*inviteToken),
+		config.WithInviteOnly(*inviteOnly),
+	}
+	for _, srv := range iceServers {
+		with = append(with, config.WithICEServer(srv))
+	}
+	if *chat != "" {
+		with = append(with, config.WithChatPort(*chat))
+	}
+	if *peers != "" {
+		with = append(with, config.WithPeerStoreFile(*peers))
+	}
+	if *mail != "" {
+		with = append(with, config.WithMailStoreFile(*mail))
+	}
+	if *turnRealm != "" {
+		with = append(with, config.WithTURNRealm(*turnRealm))
+	}
+	for _, r := range policyRules {
+		with = append(with, config.WithPolicyRule(r))
+	}
+	for _, u := range turnUsers {
+		with = append(with, config.WithTURNUser(u[0], u[1]))
+	}
+
+	cfg := config.NewConfig(with...)
 	privateAuth, pubAuth, err := crypt.LoadOrGenerateKeys(
 		cfg.PrivateAuthKeyFile,
-		cfg.PrivateAuthKeyFile,
+		cfg.PublickAuthKeyFile,
 	)
 	if err != nil {
 		log.Fatalf("error load auth keys: %v", err)
 	}
+	if cfg.ID, err = crypt.NodeID(pubAuth); err != nil {
+		log.Fatalf("error derive node ID: %v", err)
+	}
+
+	rtcServers, err := toICEServers(cfg.ICEServers)
+	if err != nil {
+		log.Fatalf("error parse ICE servers: %v", err)
+	}
+
+	rules, err := toPolicyRules(cfg.PolicyRules)
+	if err != nil {
+		log.Fatalf("error parse policy rules: %v", err)
+	}
+
+	opts := []network.With{
+		network.WithListenAddr(cfg.ListenPort),
+		network.WithEntypoint(cfg.EntryPoint),
+		network.WithChatAddr(cfg.ChatPort),
+		network.WithICEServers(rtcServers...),
+		network.WithPeerStore(cfg.PeerStoreFile),
+		network.WithMailStore(cfg.MailStoreFile),
+		network.WithEvictionQuorum(cfg.EvictionQuorum),
+		network.WithInvite(cfg.Invite),
+		network.WithInviteOnly(cfg.InviteOnly),
+		network.WithPolicyRules(rules...),
+	}
+	if cfg.TURNListenAddr != "" {
+		opts = append(opts, network.WithTURNServer(network.TURNServerConfig{
+			ListenAddr: cfg.TURNListenAddr,
+			PublicIP:   cfg.TURNPublicIP,
+			Realm:      cfg.TURNRealm,
+			Users:      cfg.TURNUsers,
+		}))
+	}
 
 	nw := network.New(
 		cfg.ID,
 		pubAuth,
 		privateAuth,
+		opts...,
 	)
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
 
 	closer.Add(func() error {
-		ctx.Done()
+		cancel()
 		return nil
 	})
 
 	nw.Run(ctx)
 }
+
+func toICEServers(servers []config.ICEServer) ([]webrtc.ICEServer, error) {
+	out := make([]webrtc.ICEServer, 0, len(servers))
+	for _, srv := range servers {
+		rtcSrv := webrtc.ICEServer{
+			URLs:     srv.URLs,
+			Username: srv.Username,
+		}
+		switch srv.CredentialType {
+		case config.CredentialTypeOauth:
+			macKey, accessToken, ok := strings.Cut(srv.Credential, ":")
+			if !ok {
+				return nil, fmt.Errorf("oauth credential of '%s' must be 'macKey:accessToken'", srv.URLs[0])
+			}
+			rtcSrv.CredentialType = webrtc.ICECredentialTypeOauth
+			rtcSrv.Credential = webrtc.OAuthCredential{
+				MACKey:      macKey,
+				AccessToken: accessToken,
+			}
+		default:
+			rtcSrv.CredentialType = webrtc.ICECredentialTypePassword
+			if srv.Credential != "" {
+				rtcSrv.Credential = srv.Credential
+			}
+		}
+		out = append(out, rtcSrv)
+	}
+	return out, nil
+}
+
+func toPolicyRules(rules []string) ([]network.PolicyRule, error) {
+	out := make([]network.PolicyRule, 0, len(rules))
+	for _, v := range rules {
+		r, err := network.ParsePolicyRule(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
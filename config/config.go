@@ -1,22 +1,49 @@
 package config
 
 import (
-	"crypto/rand"
+	"fmt"
+	"strings"
 )
 
+const (
+	CredentialTypePassword = "password"
+	CredentialTypeOauth    = "oauth"
+)
+
+type ICEServer struct {
+	URLs           []string
+	Username       string
+	Credential     string
+	CredentialType string
+}
+
 type Config struct {
 	ID                 string
 	ChatPort           string
 	ListenPort         string
+	EntryPoint         string
 	PrivateAuthKeyFile string
 	PublickAuthKeyFile string
+	ICEServers         []ICEServer
+	TURNListenAddr     string
+	TURNPublicIP       string
+	TURNRealm          string
+	TURNUsers          map[string]string
+	PeerStoreFile      string
+	EvictionQuorum     int
+	Invite             string
+	InviteOnly         bool
+	PolicyRules        []string
+	MailStoreFile      string
 }
 
 var (
-	defaultID                 = rand.Text() + rand.Text()
 	defaultChatPort           = ":9000"
 	defaultPrivateAuthKeyFile = "ecdsa_private.pem"
 	defaultPublicAuthKeyFile  = "ecdsa_public.pem"
+	defaultTURNRealm          = "udisend"
+	defaultPeerStoreFile      = "peers.json"
+	defaultMailStoreFile      = "mail.json"
 )
 
 type WithFn func(c Config) Config
@@ -42,6 +69,13 @@ func WithListenPort(v string) WithFn {
 	}
 }
 
+func WithEntryPoint(v string) WithFn {
+	return func(c Config) Config {
+		c.EntryPoint = v
+		return c
+	}
+}
+
 func WithPrivateAuthKeyFile(v string) WithFn {
 	return func(c Config) Config {
 		c.PrivateAuthKeyFile = v
@@ -56,13 +90,125 @@ func WithPublicAuthKeyFile(v string) WithFn {
 	}
 }
 
+func WithICEServer(v ICEServer) WithFn {
+	return func(c Config) Config {
+		c.ICEServers = append(c.ICEServers, v)
+		return c
+	}
+}
+
+func WithTURNServer(listenAddr, publicIP string) WithFn {
+	return func(c Config) Config {
+		c.TURNListenAddr = listenAddr
+		c.TURNPublicIP = publicIP
+		return c
+	}
+}
+
+func WithTURNRealm(v string) WithFn {
+	return func(c Config) Config {
+		c.TURNRealm = v
+		return c
+	}
+}
+
+func WithPeerStoreFile(v string) WithFn {
+	return func(c Config) Config {
+		c.PeerStoreFile = v
+		return c
+	}
+}
+
+func WithMailStoreFile(v string) WithFn {
+	return func(c Config) Config {
+		c.MailStoreFile = v
+		return c
+	}
+}
+
+func WithEvictionQuorum(v int) WithFn {
+	return func(c Config) Config {
+		c.EvictionQuorum = v
+		return c
+	}
+}
+
+func WithInvite(v string) WithFn {
+	return func(c Config) Config {
+		c.Invite = v
+		return c
+	}
+}
+
+func WithInviteOnly(v bool) WithFn {
+	return func(c Config) Config {
+		c.InviteOnly = v
+		return c
+	}
+}
+
+func WithPolicyRule(v string) WithFn {
+	return func(c Config) Config {
+		c.PolicyRules = append(c.PolicyRules, v)
+		return c
+	}
+}
+
+func WithTURNUser(username, password string) WithFn {
+	return func(c Config) Config {
+		users := make(map[string]string, len(c.TURNUsers)+1)
+		for k, v := range c.TURNUsers {
+			users[k] = v
+		}
+		users[username] = password
+		c.TURNUsers = users
+		return c
+	}
+}
+
+// ParseICEServer parses "url[,username,credential[,credentialType]]".
+// Several URLs of the same server are separated by spaces.
+func ParseICEServer(v string) (ICEServer, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) != 1 && len(parts) != 3 && len(parts) != 4 {
+		return ICEServer{}, fmt.Errorf("invalid ICE server '%s'", v)
+	}
+
+	srv := ICEServer{
+		URLs:           strings.Fields(parts[0]),
+		CredentialType: CredentialTypePassword,
+	}
+	if len(srv.URLs) == 0 {
+		return ICEServer{}, fmt.Errorf("invalid ICE server '%s': no URLs", v)
+	}
+	if len(parts) == 1 {
+		return srv, nil
+	}
+
+	srv.Username = parts[1]
+	srv.Credential = parts[2]
+	if len(parts) == 4 {
+		srv.CredentialType = parts[3]
+	}
+	switch srv.CredentialType {
+	case CredentialTypePassword, CredentialTypeOauth:
+	default:
+		return ICEServer{}, fmt.Errorf("invalid ICE server '%s': unknown credential type '%s'", v, srv.CredentialType)
+	}
+
+	return srv, nil
+}
+
 func NewConfig(with ...WithFn) Config {
 	conf := Config{
-		ID:                 defaultID,
 		ChatPort:           defaultChatPort,
 		ListenPort:         "",
+		EntryPoint:         "",
 		PrivateAuthKeyFile: defaultPrivateAuthKeyFile,
 		PublickAuthKeyFile: defaultPublicAuthKeyFile,
+		TURNRealm:          defaultTURNRealm,
+		PeerStoreFile:      defaultPeerStoreFile,
+		MailStoreFile:      defaultMailStoreFile,
 	}
 
 	for _, fn := range with {
@@ -1,10 +1,9 @@
 package network
 
 import (
-	"crypto/ecdsa"
+	"context"
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/asn1"
+	"net"
 	"time"
 	"udisend/pkg/logger"
 	"udisend/pkg/span"
@@ -14,78 +13,124 @@ func sendChallenge(d dispatcher, in incomeSignal) {
 	ctx := span.Init("sendChallenge <Recipient:%s>", in.From)
 	logger.Debugf(ctx, "Start...")
 
+	if d.isBlocked(in.From) {
+		logger.Warnf(ctx, "Evicted peer!")
+		d.disconnect(in.From)
+		return
+	}
+	memb, ok := d.getInteraction(in.From)
+	if !ok {
+		return
+	}
+	if err := d.checkPolicy(in.From, memb.remoteAddr); err != nil {
+		logger.Warnf(ctx, "d.checkPolicy: %v", err)
+		d.disconnect(in.From)
+		return
+	}
+	inv, err := d.checkInvite(in.From, in.Payload)
+	if err != nil {
+		logger.Warnf(ctx, "d.checkInvite: %v", err)
+		d.disconnect(in.From)
+		return
+	}
+
+	challengePeer(d, in.From, func(ctx context.Context) {
+		if err := d.redeemInvite(inv); err != nil {
+			logger.Warnf(ctx, "d.redeemInvite: %v", err)
+			d.disconnect(in.From)
+			return
+		}
+
+		d.rememberPeer(in.From)
+		if key, ok := d.admitMember(in.From); ok {
+			shareAuthKeys(d, memberKeys{key}, in.From)
+		}
+		// Verified now, so the newcomer may be told about the cluster.
+		d.compareAndSwapInteractionState(in.From, NotVerified, NotConnected)
+		// The newcomer is going to meet everybody else.
+		sendAuthKeys(d, in.From, d.authKeys(nil))
+		syncMembers(d, in.From)
+
+		go connectWithOther(d, in.From)
+	})
+
+	logger.Debugf(ctx, "...End")
+}
+
+// challengePeer asks a peer to sign a random challenge with the key it
+// has presented, and calls passed once the signature checks out. A peer
+// that fails is disconnected; one that doesn't answer is dropped once
+// the handshake times out.
+func challengePeer(d dispatcher, ID string, passed func(ctx context.Context)) {
 	challenge := []byte(rand.Text() + rand.Text())
 
 	d.addReaction(3*time.Second,
 		func(nextIn incomeSignal) bool {
-			if nextIn.From != in.From {
+			if nextIn.From != ID {
 				return false
 			}
 			if nextIn.Type != SignalTypeTestChallenge {
 				return false
 			}
 
-			ctx := span.Init("testChallenge of '%s'", in.From)
+			ctx := span.Init("testChallenge of '%s'", ID)
 			logger.Debugf(ctx, "Start...")
 
-			var sig signature
-			if _, err := asn1.Unmarshal(nextIn.Payload, &sig); err != nil {
-				logger.Errorf(ctx, "asn1.Unmarshal: %v", err)
+			pubAuth := d.candidateAuthKey(nextIn.From)
+			if pubAuth == nil {
+				logger.Warnf(ctx, "Unknown auth key!")
+				d.disconnect(ID)
 				return true
 			}
 
-			pubAuth := d.memberAuthKey(nextIn.From)
-
-			hash := sha256.Sum256(challenge)
-			if !ecdsa.Verify(
-				pubAuth,
-				hash[:],
-				sig.R,
-				sig.S,
-			) {
+			if !verifyPayload(pubAuth, tagChallenge, challenge, nextIn.Payload) {
 				logger.Warnf(ctx, "Failed!")
+				d.disconnect(ID)
 				return true
 			}
 
-			logger.Debugf(ctx, "Success!")
+			// Fingerprint rules are checked once the key is proven: it
+			// may have been unknown when the peer was let in.
+			var addr net.Addr
+			if memb, ok := d.getInteraction(ID); ok {
+				addr = memb.remoteAddr
+			}
+			if err := d.checkPolicy(ID, addr); err != nil {
+				logger.Warnf(ctx, "d.checkPolicy: %v", err)
+				d.disconnect(ID)
+				return true
+			}
 
-			d.compareAndSwapInteractionState(in.From, NotVerified, NotConnected)
-			go connectWithOther(d, in.From)
+			logger.Debugf(ctx, "Success!")
+			passed(ctx)
 			logger.Debugf(ctx, "...End")
 			return true
 		})
 
 	d.send(
-		in.From,
+		ID,
 		networkSignal{
 			Type:    SignalTypeSolveChallenge,
 			Payload: challenge,
 		},
 	)
-
-	logger.Debugf(ctx, "...End")
 }
 
+// solveChallenge signs a challenge, but only for a peer the node is
+// shaking hands with, and only once: otherwise the answers would make
+// an oracle signing whatever anybody likes.
 func solveChallenge(n dispatcher, in incomeSignal) {
 	ctx := span.Init("solving challange of '%s'", in.From)
 	logger.Debugf(ctx, "Start...")
 
-	hash := sha256.Sum256(in.Payload)
-
-	r, s, err := ecdsa.Sign(
-		rand.Reader,
-		n.privateAuthKey(),
-		hash[:],
-	)
-	if err != nil {
-		logger.Errorf(ctx, "ecdsa.Sign: %v", err)
+	if !n.answerChallenge(in.From) {
+		logger.Warnf(ctx, "Unexpected challenge!")
 		return
 	}
 
-	sig := signature{R: r, S: s}
-	sigBytes, err := asn1.Marshal(sig)
+	sigBytes, err := signPayload(n.privateAuthKey(), tagChallenge, in.Payload)
 	if err != nil {
-		logger.Errorf(ctx, "asn1.Marshal: %v", err)
+		logger.Errorf(ctx, "signPayload: %v", err)
 		return
 	}
 
@@ -0,0 +1,45 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChallengeIsAnsweredOnlyDuringHandshake(t *testing.T) {
+	n := testNetwork(t)
+	ID := testNodeID(t)
+	n.interactions.interactions[ID] = &interaction{id: ID, challengeUntil: time.Now().Add(handshakeTimeout)}
+
+	if !n.answerChallenge(ID) {
+		t.Fatalf("challenge of a handshake isn't answered")
+	}
+	if n.answerChallenge(ID) {
+		t.Fatalf("second challenge is answered")
+	}
+	n.expectChallenge(ID)
+	if !n.answerChallenge(ID) {
+		t.Fatalf("challenge after asking to be verified isn't answered")
+	}
+
+	n.interactions.interactions[ID].challengeUntil = time.Now().Add(-time.Second)
+	if n.answerChallenge(ID) {
+		t.Fatalf("challenge after the handshake is answered")
+	}
+	if n.answerChallenge(testNodeID(t)) {
+		t.Fatalf("challenge of a stranger is answered")
+	}
+}
+
+func TestChallengeAnswerIsNoVote(t *testing.T) {
+	key, ID := testKey(t)
+	v := evictionVote{Candidate: testNodeID(t), Reporter: ID, Time: time.Now()}
+
+	// A peer passes the vote off as a challenge.
+	var err error
+	if v.Signature, err = signPayload(key, tagChallenge, v.signed()); err != nil {
+		t.Fatalf("signPayload: %v", err)
+	}
+	if v.verify(&key.PublicKey) {
+		t.Fatalf("answer to a challenge passes for a vote")
+	}
+}
@@ -0,0 +1,141 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	mathrand "math/rand/v2"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// broadcastSignals are the only signals that may be flooded. Everything
+// else is meant for a single member.
+var broadcastSignals = map[signalType]bool{
+	SignalTypeDisconnectCandidate: true,
+	SignalTypeSyncMembers:         true,
+}
+
+// flood is a cluster-wide announcement. Every member passes it to a few
+// random neighbours until the TTL runs out; the ID lets members drop
+// copies they have already seen.
+type flood struct {
+	ID  string
+	TTL uint8
+	networkSignal
+}
+
+func (f flood) marshal() []byte {
+	var w payloadWriter
+	w.string(f.ID)
+	w.uvarint(uint64(f.TTL))
+	w.uvarint(uint64(signalCodes[f.Type]))
+	w.bytes(f.Payload)
+	return w.buf
+}
+
+func (f *flood) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	f.ID = r.string(maxMessageIDLength)
+	f.TTL = uint8(r.uvarint(uint64(broadcastTTL)))
+	code := uint8(r.uvarint(255))
+	f.Payload = r.bytes(maxFrameSize)
+	if err := r.close(); err != nil {
+		return err
+	}
+
+	t, ok := signalTypes[code]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownSignalType, code)
+	}
+	f.Type = t
+	return nil
+}
+
+// clusterBroadcast announces a signal to the whole cluster.
+func (i *interactions) clusterBroadcast(s networkSignal) {
+	ctx := span.Init("interactions.clusterBroadcast <Type:%s>", s.Type)
+
+	if !broadcastSignals[s.Type] {
+		logger.Warnf(ctx, "Signal can't be broadcast")
+		return
+	}
+
+	f := flood{
+		ID:            rand.Text(),
+		TTL:           uint8(broadcastTTL),
+		networkSignal: s,
+	}
+	i.broadcastSeen.firstSeen(f.ID)
+	i.spread(ctx, f, "")
+}
+
+// spread passes a flood to at most broadcastFanout neighbours. It never
+// waits: a neighbour whose queue is full just misses this copy, and
+// others are likely to pass it along anyway.
+func (i *interactions) spread(ctx context.Context, f flood, from string) {
+	payload := f.marshal()
+
+	i.interactionsMu.RLock()
+	defer i.interactionsMu.RUnlock()
+
+	targets := make([]*interaction, 0, len(i.interactions))
+	for ID, member := range i.interactions {
+		if ID == from || !member.capabilities.supports(SignalTypeBroadcast) {
+			continue
+		}
+		member.mu.RLock()
+		connected := member.state == Connected
+		member.mu.RUnlock()
+		if connected {
+			targets = append(targets, member)
+		}
+	}
+	mathrand.Shuffle(len(targets), func(a, b int) { targets[a], targets[b] = targets[b], targets[a] })
+	targets = targets[:min(len(targets), broadcastFanout)]
+
+	for _, member := range targets {
+		select {
+		case member.send <- networkSignal{Type: SignalTypeBroadcast, Payload: payload}:
+		default:
+			logger.Debugf(ctx, "Queue of '%s' is full, skipped", member.id)
+		}
+	}
+	logger.Debugf(ctx, "Passed to %d neighbours", len(targets))
+}
+
+// acceptBroadcast handles a flood: hands the signal to its handler and
+// passes it on.
+func acceptBroadcast(d dispatcher, s incomeSignal) {
+	var f flood
+	if err := f.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "acceptBroadcast <From:%s>: f.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("acceptBroadcast <From:%s> <Type:%s>", s.From, f.Type)
+	if !broadcastSignals[f.Type] {
+		logger.Warnf(ctx, "Signal can't be broadcast")
+		return
+	}
+	if !d.firstBroadcast(f.ID) {
+		logger.Debugf(ctx, "Duplicate")
+		return
+	}
+	if !d.permitsSignal(f.Type) {
+		logger.Debugf(ctx, "Signal is denied")
+		return
+	}
+
+	if f.TTL > 1 {
+		f.TTL--
+		d.spread(ctx, f, s.From)
+	}
+	// The neighbour stays the sender: handlers ask it about whatever
+	// they miss.
+	d.deliver(incomeSignal{From: s.From, networkSignal: f.networkSignal})
+}
+
+func (i *interactions) firstBroadcast(ID string) bool {
+	return i.broadcastSeen.firstSeen(ID)
+}
@@ -0,0 +1,193 @@
+package network
+
+import (
+	"fmt"
+	"slices"
+)
+
+const (
+	minProtocolVersion = 1
+
+	codecBinary     = "binary/1"
+	compressionNone = "none"
+)
+
+var (
+	supportedCodecs      = []string{codecBinary}
+	supportedCompression = []string{compressionNone}
+)
+
+type hello struct {
+	ID string
+	// ListenAddr is where the peer accepts bootstrap connections. The
+	// host part may be empty when the peer doesn't know its address.
+	ListenAddr   string
+	MinVersion   uint8
+	MaxVersion   uint8
+	Signals      []signalType
+	Codecs       []string
+	Compression  []string
+	MaxFrameSize int
+}
+
+// capabilities are what both peers support. Codecs and compression are
+// only checked for a common choice: each side has a single one so far.
+type capabilities struct {
+	version      uint8
+	signals      map[signalType]bool
+	maxFrameSize int
+}
+
+func localHello(ID, listenAddr string) hello {
+	signals := make([]signalType, 0, len(signalCodes))
+	for t := range signalCodes {
+		signals = append(signals, t)
+	}
+	slices.SortFunc(signals, func(a, b signalType) int {
+		return int(signalCodes[a]) - int(signalCodes[b])
+	})
+
+	return hello{
+		ID:           ID,
+		ListenAddr:   listenAddr,
+		MinVersion:   minProtocolVersion,
+		MaxVersion:   protocolVersion,
+		Signals:      signals,
+		Codecs:       supportedCodecs,
+		Compression:  supportedCompression,
+		MaxFrameSize: maxFrameSize,
+	}
+}
+
+func (c capabilities) supports(t signalType) bool {
+	return c.signals[t]
+}
+
+func negotiate(local, remote hello) (capabilities, error) {
+	version := min(local.MaxVersion, remote.MaxVersion)
+	if version < max(local.MinVersion, remote.MinVersion) {
+		return capabilities{}, fmt.Errorf(
+			"%w: versions [%d..%d] and [%d..%d] don't overlap",
+			ErrIncompatiblePeer,
+			local.MinVersion, local.MaxVersion,
+			remote.MinVersion, remote.MaxVersion,
+		)
+	}
+
+	signals := make(map[signalType]bool, len(local.Signals))
+	for _, t := range remote.Signals {
+		if slices.Contains(local.Signals, t) {
+			signals[t] = true
+		}
+	}
+	for t := range handshakeSignals {
+		if !signals[t] {
+			return capabilities{}, fmt.Errorf("%w: '%s' isn't supported", ErrIncompatiblePeer, t)
+		}
+	}
+
+	if _, ok := firstCommon(local.Codecs, remote.Codecs); !ok {
+		return capabilities{}, fmt.Errorf("%w: no common codec", ErrIncompatiblePeer)
+	}
+	if _, ok := firstCommon(local.Compression, remote.Compression); !ok {
+		return capabilities{}, fmt.Errorf("%w: no common compression", ErrIncompatiblePeer)
+	}
+
+	return capabilities{
+		version:      version,
+		signals:      signals,
+		maxFrameSize: min(local.MaxFrameSize, remote.MaxFrameSize),
+	}, nil
+}
+
+// firstCommon walks local preferences in order, so both peers pick
+// the same value as long as they share the same preference lists.
+func firstCommon(local, remote []string) (string, bool) {
+	for _, v := range local {
+		if slices.Contains(remote, v) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func exchangeHello(
+	myID, listenAddr string,
+	send func(networkSignal) error,
+	receive func() (networkSignal, error),
+) (hello, capabilities, error) {
+	local := localHello(myID, listenAddr)
+
+	// Both sides speak first, so the send mustn't depend on the
+	// transport having room to buffer it.
+	sent := make(chan error, 1)
+	go func() {
+		sent <- send(networkSignal{
+			Type:    SignalTypeHello,
+			Payload: local.marshal(),
+		})
+	}()
+
+	s, err := receive()
+	if err != nil {
+		return hello{}, capabilities{}, err
+	}
+	if err := <-sent; err != nil {
+		return hello{}, capabilities{}, err
+	}
+	if s.Type != SignalTypeHello {
+		return hello{}, capabilities{}, fmt.Errorf("%w: expected '%s', got '%s'", ErrInvalidMessage, SignalTypeHello, s.Type)
+	}
+
+	var remote hello
+	if err := remote.unmarshal(s.Payload); err != nil {
+		return hello{}, capabilities{}, err
+	}
+	if remote.ID == myID {
+		return hello{}, capabilities{}, ErrInvalidPeerID
+	}
+
+	caps, err := negotiate(local, remote)
+	if err != nil {
+		return hello{}, capabilities{}, err
+	}
+
+	return remote, caps, nil
+}
+
+func (h hello) marshal() []byte {
+	var w payloadWriter
+	w.string(h.ID)
+	w.string(h.ListenAddr)
+	w.uvarint(uint64(h.MinVersion))
+	w.uvarint(uint64(h.MaxVersion))
+	w.uvarint(uint64(len(h.Signals)))
+	for _, t := range h.Signals {
+		w.uvarint(uint64(signalCodes[t]))
+	}
+	w.strings(h.Codecs)
+	w.strings(h.Compression)
+	w.uvarint(uint64(h.MaxFrameSize))
+	return w.buf
+}
+
+func (h *hello) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	h.ID = r.id()
+	h.ListenAddr = r.string(maxAddrLength)
+	h.MinVersion = uint8(r.uvarint(255))
+	h.MaxVersion = uint8(r.uvarint(255))
+	count := r.uvarint(255)
+	h.Signals = h.Signals[:0]
+	for range count {
+		// Codes unknown to this build are skipped: they can't be
+		// part of the negotiated set anyway.
+		if t, ok := signalTypes[uint8(r.uvarint(255))]; ok {
+			h.Signals = append(h.Signals, t)
+		}
+	}
+	h.Codecs = r.strings(16, 32)
+	h.Compression = r.strings(16, 32)
+	h.MaxFrameSize = int(r.uvarint(1 << 31))
+	return r.close()
+}
@@ -0,0 +1,51 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := localHello("local", "")
+
+	tests := []struct {
+		name    string
+		change  func(h *hello)
+		version uint8
+		want    error
+	}{
+		{"same build", func(h *hello) {}, protocolVersion, nil},
+		{"older peer", func(h *hello) { h.MaxVersion = minProtocolVersion }, minProtocolVersion, nil},
+		{"newer peer", func(h *hello) { h.MinVersion, h.MaxVersion = protocolVersion+1, protocolVersion+2 }, 0, ErrIncompatiblePeer},
+		{"no common codec", func(h *hello) { h.Codecs = []string{"json/1"} }, 0, ErrIncompatiblePeer},
+		{"no common compression", func(h *hello) { h.Compression = []string{"zstd"} }, 0, ErrIncompatiblePeer},
+		{"no handshake signals", func(h *hello) { h.Signals = []signalType{SignalTypeChat} }, 0, ErrIncompatiblePeer},
+		{"smaller frames", func(h *hello) { h.MaxFrameSize = 1024 }, protocolVersion, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := localHello("remote", "")
+			tt.change(&remote)
+
+			caps, err := negotiate(local, remote)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if err != nil {
+				return
+			}
+			if caps.version != tt.version {
+				t.Errorf("version: got %d, want %d", caps.version, tt.version)
+			}
+			if caps.maxFrameSize != min(local.MaxFrameSize, remote.MaxFrameSize) {
+				t.Errorf("frame size: got %d", caps.maxFrameSize)
+			}
+			for _, st := range remote.Signals {
+				if !caps.supports(st) {
+					t.Errorf("'%s' isn't supported", st)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+	"udisend/pkg/crypt"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// ChatMessage is a line of a conversation. The author is always the
+// member that sent it: a message claiming anybody else is dropped.
+type ChatMessage struct {
+	ID string `json:"id"`
+	// Room is empty for direct messages.
+	Room      string    `json:"room,omitempty"`
+	Author    string    `json:"author"`
+	Timestamp time.Time `json:"timestamp"`
+	// Clock is the causal context of the message: the latest message of
+	// every author in the conversation the author had seen, the message
+	// itself for the author.
+	Clock VectorClock `json:"clock"`
+	// Prev is the author's previous message in the conversation, zero for
+	// the first one since the author started.
+	Prev uint64 `json:"prev,omitempty"`
+	Body string `json:"body"`
+}
+
+func (m ChatMessage) marshal() []byte {
+	var w payloadWriter
+	w.string(m.ID)
+	w.string(m.Room)
+	w.string(m.Author)
+	w.uvarint(uint64(m.Timestamp.UnixMilli()))
+	m.Clock.marshal(&w)
+	w.uvarint(m.Prev)
+	w.string(m.Body)
+	return w.buf
+}
+
+func (m *ChatMessage) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	m.ID = r.string(maxMessageIDLength)
+	m.Room = r.string(maxMessageIDLength)
+	m.Author = r.id()
+	m.Timestamp = time.UnixMilli(int64(r.uvarint(1<<63 - 1)))
+	m.Clock = unmarshalClock(&r)
+	m.Prev = r.uvarint(1<<64 - 1)
+	m.Body = r.string(maxChatBodyLength)
+	if err := r.close(); err != nil {
+		return err
+	}
+	if m.Clock[m.Author] <= m.Prev {
+		return fmt.Errorf("%w: clock %d of the author isn't past %d", ErrInvalidMessage, m.Clock[m.Author], m.Prev)
+	}
+	return nil
+}
+
+// chatFeed hands received messages to everyone subscribed. A subscriber
+// that doesn't keep up misses messages rather than stalls the others.
+type chatFeed struct {
+	mu   sync.Mutex
+	subs map[chan ChatMessage]struct{}
+}
+
+func (f *chatFeed) subscribe() chan ChatMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.subs == nil {
+		f.subs = make(map[chan ChatMessage]struct{})
+	}
+	ch := make(chan ChatMessage, chatBufferSize)
+	f.subs[ch] = struct{}{}
+	return ch
+}
+
+func (f *chatFeed) unsubscribe(ch chan ChatMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.subs, ch)
+	close(ch)
+}
+
+func (f *chatFeed) publish(m ChatMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ch := range f.subs {
+		select {
+		case ch <- m:
+		default:
+			logger.Debugf(nil, "Chat message '%s' is dropped for a slow subscriber", m.ID)
+		}
+	}
+}
+
+// SendChat sends a message to a member, directly or through the mesh.
+func (n *Network) SendChat(to, body string) (ChatMessage, error) {
+	if !crypt.ValidNodeID(to) {
+		return ChatMessage{}, fmt.Errorf("%w: malformed ID '%s'", ErrInvalidPeerID, to)
+	}
+	if to == n.ID {
+		return ChatMessage{}, fmt.Errorf("%w: '%s' is the node itself", ErrInvalidPeerID, to)
+	}
+	if len(body) == 0 || len(body) > maxChatBodyLength {
+		return ChatMessage{}, fmt.Errorf("%w: body of %d bytes", ErrInvalidChatMessage, len(body))
+	}
+	// An offline member gets the message later, but only if its key is
+	// known to seal the message with.
+	if n.memberAuthKey(to) == nil && !n.isMember(to) {
+		return ChatMessage{}, fmt.Errorf("%w: '%s'", ErrUnknownMember, to)
+	}
+
+	m := ChatMessage{
+		ID:        rand.Text(),
+		Author:    n.ID,
+		Timestamp: time.Now(),
+		Body:      body,
+	}
+	n.conversations.stamp(conversationKey{peer: to}, &m)
+	n.sendChat(to, m)
+	return m, nil
+}
+
+// ChatMessages streams messages sent to the node until the context is
+// done.
+func (n *Network) ChatMessages(ctx context.Context) <-chan ChatMessage {
+	in := n.chat.subscribe()
+	out := make(chan ChatMessage)
+
+	go func() {
+		defer close(out)
+		defer n.chat.unsubscribe(in)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m := <-in:
+				select {
+				case out <- m:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+func acceptChat(d dispatcher, s incomeSignal) {
+	var m ChatMessage
+	if err := m.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "acceptChat <From:%s>: m.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("acceptChat <From:%s> <ID:%s>", s.From, m.ID)
+	if m.Author != s.From {
+		logger.Warnf(ctx, "Author '%s' isn't the sender!", m.Author)
+		return
+	}
+	if m.Room != "" && !d.isRoomMember(m.Room, m.Author) {
+		logger.Debugf(ctx, "Author isn't a member of the room '%s'", m.Room)
+		return
+	}
+
+	d.receiveChat(m)
+	logger.Debugf(ctx, "Received")
+}
+
+// receiveChat acknowledges every copy of a message, since the author
+// retransmits until an acknowledgement gets through, but publishes it
+// once, after the messages it follows. Copies come from the author and
+// from every mailbox.
+func (i *interactions) receiveChat(m ChatMessage) {
+	i.acknowledge(m, StatusDelivered)
+	if !i.chatSeen.firstSeen(m.ID) {
+		logger.Debugf(nil, "Chat message '%s' is a duplicate", m.ID)
+		return
+	}
+	for _, m := range i.conversations.receive(conversationOf(m), m) {
+		i.chat.publish(m)
+	}
+}
@@ -0,0 +1,192 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// The chat endpoint is for local clients:
+//
+//	POST /messages {"to": ID, "body": text} sends a message and answers with it;
+//	POST /messages {"room": ID, "body": text} sends it to a room instead;
+//	GET /messages streams received messages as JSON lines;
+//	GET /messages/{id} answers with statuses of a sent message by recipient;
+//	POST /messages/{id}/read {"author": ID} tells the author it's read;
+//	GET /history?with=ID or GET /history?room=ID answers with recent
+//	messages of a conversation in the order every member shows them.
+type chatPost struct {
+	To   string `json:"to"`
+	Room string `json:"room"`
+	Body string `json:"body"`
+}
+
+type chatRead struct {
+	Author string `json:"author"`
+}
+
+// serveChat binds the chat endpoint. An address without a host is bound
+// to the loopback, since the endpoint doesn't authenticate clients.
+func (n *Network) serveChat(ctx context.Context) error {
+	addr := n.config.chatAddr
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("net.SplitHostPort: %w", err)
+	}
+	if host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	ctx = span.Extend(ctx, "network.serveChat <Addr:%s>", addr)
+	logger.Debugf(ctx, "Start...")
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("net.Listen: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /messages", n.postChat)
+	mux.HandleFunc("GET /messages", n.streamChat)
+	mux.HandleFunc("GET /messages/{id}", n.chatStatus)
+	mux.HandleFunc("POST /messages/{id}/read", n.readChat)
+	mux.HandleFunc("GET /history", n.chatHistory)
+	srv := &http.Server{
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			logger.Warnf(ctx, "srv.Close: %v", err)
+		}
+	}()
+
+	go func() {
+		defer logger.Debugf(ctx, "...End")
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf(ctx, "srv.Serve: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+func (n *Network) postChat(w http.ResponseWriter, r *http.Request) {
+	// Escaping may make a body several times longer in JSON.
+	body := http.MaxBytesReader(w, r.Body, int64(maxChatBodyLength)*8)
+
+	var p chatPost
+	if err := json.NewDecoder(body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		m   ChatMessage
+		err error
+	)
+	if p.Room != "" {
+		m, err = n.SendRoom(p.Room, p.Body)
+	} else {
+		m, err = n.SendChat(p.To, p.Body)
+	}
+	switch {
+	case errors.Is(err, ErrUnknownMember), errors.Is(err, ErrUnknownRoom):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		logger.Warnf(r.Context(), "postChat: Encode: %v", err)
+	}
+}
+
+func (n *Network) streamChat(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Warnf(ctx, "streamChat: Flush: %v", err)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	for m := range n.ChatMessages(ctx) {
+		if err := enc.Encode(m); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (n *Network) chatStatus(w http.ResponseWriter, r *http.Request) {
+	statuses, err := n.MessageStatus(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		logger.Warnf(r.Context(), "chatStatus: Encode: %v", err)
+	}
+}
+
+func (n *Network) readChat(w http.ResponseWriter, r *http.Request) {
+	var p chatRead
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(idLength)*8)).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := n.MarkRead(p.Author, r.PathValue("id"))
+	switch {
+	case errors.Is(err, ErrUnknownMember):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (n *Network) chatHistory(w http.ResponseWriter, r *http.Request) {
+	var (
+		history []ChatMessage
+		err     error
+	)
+	if room := r.URL.Query().Get("room"); room != "" {
+		history, err = n.RoomHistory(room)
+	} else {
+		history, err = n.ChatHistory(r.URL.Query().Get("with"))
+	}
+	switch {
+	case errors.Is(err, ErrUnknownRoom):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		logger.Warnf(r.Context(), "chatHistory: Encode: %v", err)
+	}
+}
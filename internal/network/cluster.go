@@ -8,11 +8,20 @@ import (
 type cluster struct {
 	mu      sync.RWMutex
 	members map[string]*ecdsa.PublicKey
+	// presented keys are claimed by peers that haven't passed the
+	// challenge yet.
+	presented map[string]*ecdsa.PublicKey
+	// challenged are members the node has checked with a challenge
+	// itself. Keys passed around by others may be made up, as anybody can
+	// generate as many of them as it likes.
+	challenged map[string]bool
 }
 
 func NewCluster() *cluster {
 	return &cluster{
-		members: make(map[string]*ecdsa.PublicKey),
+		members:    make(map[string]*ecdsa.PublicKey),
+		presented:  make(map[string]*ecdsa.PublicKey),
+		challenged: make(map[string]bool),
 	}
 }
 
@@ -27,3 +36,90 @@ func (c *cluster) MemberAuthKey(ID string) *ecdsa.PublicKey {
 
 	return key
 }
+
+// present remembers a key claimed by a not verified peer. The key of a
+// known member is never replaced.
+func (c *cluster) present(ID string, key *ecdsa.PublicKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.members[ID]; ok {
+		return
+	}
+	c.presented[ID] = key
+}
+
+// candidateKey is the key a challenge is checked against.
+func (c *cluster) candidateKey(ID string) *ecdsa.PublicKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if key, ok := c.members[ID]; ok {
+		return key
+	}
+	return c.presented[ID]
+}
+
+// admit makes a presented key a member's one once the member has passed
+// the challenge, and reports whether the key is new.
+func (c *cluster) admit(ID string) (memberKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.members[ID]; ok {
+		c.challenged[ID] = true
+		return memberKey{ID: ID, PubKey: key}, false
+	}
+	key, ok := c.presented[ID]
+	if !ok {
+		return memberKey{}, false
+	}
+	delete(c.presented, ID)
+	c.members[ID] = key
+	c.challenged[ID] = true
+	return memberKey{ID: ID, PubKey: key}, true
+}
+
+func (c *cluster) isChallenged(ID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.challenged[ID]
+}
+
+// add records keys of unknown members and returns the ones that were new.
+func (c *cluster) add(keys memberKeys) memberKeys {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var added memberKeys
+	for _, k := range keys {
+		if _, ok := c.members[k.ID]; ok {
+			continue
+		}
+		delete(c.presented, k.ID)
+		c.members[k.ID] = k.PubKey
+		added = append(added, k)
+	}
+	return added
+}
+
+// keys returns keys of the requested members, or of all of them when
+// nothing is requested.
+func (c *cluster) keys(IDs []string) memberKeys {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var out memberKeys
+	if len(IDs) == 0 {
+		for ID, key := range c.members {
+			out = append(out, memberKey{ID: ID, PubKey: key})
+		}
+		return out
+	}
+	for _, ID := range IDs {
+		if key, ok := c.members[ID]; ok {
+			out = append(out, memberKey{ID: ID, PubKey: key})
+		}
+	}
+	return out
+}
@@ -0,0 +1,287 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"udisend/pkg/crypt"
+)
+
+// Frame layout:
+//
+//	| version:1 | type:1 | flags:1 | length:4 | payload:length |
+const (
+	frameHeaderSize = 7
+	protocolVersion = 1
+)
+
+var signalCodes = map[signalType]uint8{
+	SignalTypeDoVerify:               1,
+	SignalTypeProvidePubKey:          2,
+	SignalTypePubKeyProvided:         3,
+	SignalTypeSolveChallenge:         4,
+	SignalTypeTestChallenge:          5,
+	SignalTypeNewConnection:          6,
+	SignalTypeGenerateConnectionSign: 7,
+	SignalTypeSendConnectionSign:     8,
+	SignalTypeMakeOffer:              9,
+	SignalTypeSendOffer:              10,
+	SignalTypeHandleOffer:            11,
+	SignalTypeSendAnswer:             12,
+	SignalTypeHandleAnswer:           13,
+	SignalTypeConnectionEstablished:  14,
+	SignalTypePing:                   15,
+	SignalTypePong:                   16,
+	SignalTypeDisconnectCandidate:    17,
+	SignalTypeHello:                  18,
+	SignalTypeSendICECandidate:       19,
+	SignalTypeHandleICECandidate:     20,
+	SignalTypeReconnect:              21,
+	SignalTypeProbe:                  22,
+	SignalTypeProbeAck:               23,
+	SignalTypeProbeRequest:           24,
+	SignalTypeSyncMembers:            25,
+	SignalTypeFindNode:               26,
+	SignalTypeFoundNode:              27,
+	SignalTypeFindValue:              28,
+	SignalTypeFoundValue:             29,
+	SignalTypeRouted:                 30,
+	SignalTypeBroadcast:              31,
+	SignalTypeChat:                   32,
+	SignalTypeRoomEvent:              33,
+	SignalTypeRoomSync:               34,
+	SignalTypeDeposit:                35,
+	SignalTypeMail:                   36,
+	SignalTypeReceipt:                37,
+}
+
+var signalTypes = func() map[uint8]signalType {
+	out := make(map[uint8]signalType, len(signalCodes))
+	for t, code := range signalCodes {
+		out[code] = t
+	}
+	return out
+}()
+
+type frameHeader struct {
+	version uint8
+	code    uint8
+	flags   uint8
+	length  uint32
+}
+
+func (h frameHeader) put(b []byte) {
+	b[0] = h.version
+	b[1] = h.code
+	b[2] = h.flags
+	binary.BigEndian.PutUint32(b[3:], h.length)
+}
+
+func parseFrameHeader(b []byte) (frameHeader, error) {
+	if len(b) < frameHeaderSize {
+		return frameHeader{}, fmt.Errorf("%w: header of %d bytes", ErrFrameTruncated, len(b))
+	}
+
+	h := frameHeader{
+		version: b[0],
+		code:    b[1],
+		flags:   b[2],
+		length:  binary.BigEndian.Uint32(b[3:]),
+	}
+	if h.version < minProtocolVersion || h.version > protocolVersion {
+		return frameHeader{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, h.version)
+	}
+	if h.length > uint32(maxFrameSize) {
+		return frameHeader{}, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, h.length)
+	}
+
+	return h, nil
+}
+
+// encodeSignal frames a signal for a peer that speaks the version. The
+// hello goes out with minProtocolVersion, as the peer's range isn't known
+// yet; everything after it uses the negotiated one.
+func encodeSignal(version uint8, s networkSignal) ([]byte, error) {
+	if version < minProtocolVersion || version > protocolVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	code, ok := signalCodes[s.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownSignalType, s.Type)
+	}
+	if len(s.Payload) > maxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(s.Payload))
+	}
+
+	out := make([]byte, frameHeaderSize, frameHeaderSize+len(s.Payload))
+	frameHeader{
+		version: version,
+		code:    code,
+		length:  uint32(len(s.Payload)),
+	}.put(out)
+
+	return append(out, s.Payload...), nil
+}
+
+func decodeSignal(b []byte) (networkSignal, error) {
+	h, err := parseFrameHeader(b)
+	if err != nil {
+		return networkSignal{}, err
+	}
+
+	body := b[frameHeaderSize:]
+	if len(body) < int(h.length) {
+		return networkSignal{}, fmt.Errorf("%w: want %d bytes, got %d", ErrFrameTruncated, h.length, len(body))
+	}
+	if len(body) > int(h.length) {
+		return networkSignal{}, fmt.Errorf("%w: %d trailing bytes", ErrInvalidFrame, len(body)-int(h.length))
+	}
+
+	return h.signal(body)
+}
+
+func writeSignal(w io.Writer, version uint8, s networkSignal) error {
+	b, err := encodeSignal(version, s)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func readSignal(r io.Reader) (networkSignal, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return networkSignal{}, fmt.Errorf("%w: %v", ErrFrameTruncated, err)
+		}
+		return networkSignal{}, err
+	}
+
+	h, err := parseFrameHeader(header)
+	if err != nil {
+		return networkSignal{}, err
+	}
+
+	body := make([]byte, h.length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return networkSignal{}, fmt.Errorf("%w: %v", ErrFrameTruncated, err)
+	}
+
+	return h.signal(body)
+}
+
+func (h frameHeader) signal(body []byte) (networkSignal, error) {
+	t, ok := signalTypes[h.code]
+	if !ok {
+		return networkSignal{}, fmt.Errorf("%w: code %d", ErrUnknownSignalType, h.code)
+	}
+
+	return networkSignal{Type: t, Payload: body}, nil
+}
+
+type payloadWriter struct {
+	buf []byte
+}
+
+func (w *payloadWriter) bytes(b []byte) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *payloadWriter) string(s string) {
+	w.bytes([]byte(s))
+}
+
+func (w *payloadWriter) strings(v []string) {
+	w.uvarint(uint64(len(v)))
+	for _, s := range v {
+		w.string(s)
+	}
+}
+
+func (w *payloadWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+type payloadReader struct {
+	buf []byte
+	err error
+}
+
+func (r *payloadReader) bytes(limit int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	l, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = ErrPayloadTruncated
+		return nil
+	}
+	if l > uint64(limit) {
+		r.err = fmt.Errorf("%w: %d > %d", ErrFieldTooLarge, l, limit)
+		return nil
+	}
+	r.buf = r.buf[n:]
+	if uint64(len(r.buf)) < l {
+		r.err = ErrPayloadTruncated
+		return nil
+	}
+
+	out := r.buf[:l]
+	r.buf = r.buf[l:]
+	return out
+}
+
+func (r *payloadReader) string(limit int) string {
+	return string(r.bytes(limit))
+}
+
+func (r *payloadReader) strings(count, limit int) []string {
+	n := r.uvarint(uint64(count))
+	if r.err != nil {
+		return nil
+	}
+	out := make([]string, 0, n)
+	for range n {
+		out = append(out, r.string(limit))
+	}
+	return out
+}
+
+func (r *payloadReader) uvarint(limit uint64) uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = ErrPayloadTruncated
+		return 0
+	}
+	if v > limit {
+		r.err = fmt.Errorf("%w: %d > %d", ErrFieldTooLarge, v, limit)
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *payloadReader) id() string {
+	v := r.string(idLength)
+	if r.err == nil && !crypt.ValidNodeID(v) {
+		r.err = fmt.Errorf("%w: malformed ID '%s'", ErrInvalidPeerID, v)
+	}
+	return v
+}
+
+func (r *payloadReader) close() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.buf) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidMessage, len(r.buf))
+	}
+	return nil
+}
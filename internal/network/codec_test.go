@@ -0,0 +1,270 @@
+package network
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"udisend/pkg/crypt"
+)
+
+func TestSignalRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		signal networkSignal
+	}{
+		{"empty payload", networkSignal{Type: SignalTypePing}},
+		{"short payload", networkSignal{Type: SignalTypeChat, Payload: []byte("hello")}},
+		{"max payload", networkSignal{Type: SignalTypeRouted, Payload: make([]byte, maxFrameSize)}},
+	}
+	for st := range signalCodes {
+		tests = append(tests, struct {
+			name   string
+			signal networkSignal
+		}{string(st), networkSignal{Type: st, Payload: []byte{1, 2, 3}}})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := encodeSignal(protocolVersion, tt.signal)
+			if err != nil {
+				t.Fatalf("encodeSignal: %v", err)
+			}
+
+			got, err := decodeSignal(b)
+			if err != nil {
+				t.Fatalf("decodeSignal: %v", err)
+			}
+			assertSignal(t, got, tt.signal)
+
+			var buf bytes.Buffer
+			if err := writeSignal(&buf, protocolVersion, tt.signal); err != nil {
+				t.Fatalf("writeSignal: %v", err)
+			}
+			got, err = readSignal(&buf)
+			if err != nil {
+				t.Fatalf("readSignal: %v", err)
+			}
+			assertSignal(t, got, tt.signal)
+		})
+	}
+}
+
+func TestEncodeSignalErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		signal networkSignal
+		want   error
+	}{
+		{"unknown type", networkSignal{Type: "Unknown"}, ErrUnknownSignalType},
+		{"oversize payload", networkSignal{Type: SignalTypeChat, Payload: make([]byte, maxFrameSize+1)}, ErrFrameTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := encodeSignal(protocolVersion, tt.signal); !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeSignalVersion(t *testing.T) {
+	s := networkSignal{Type: SignalTypePing}
+	for version := uint8(minProtocolVersion); version <= protocolVersion; version++ {
+		b, err := encodeSignal(version, s)
+		if err != nil {
+			t.Fatalf("encodeSignal(%d): %v", version, err)
+		}
+		if b[0] != version {
+			t.Fatalf("frame of version %d has version %d", version, b[0])
+		}
+	}
+	for _, version := range []uint8{minProtocolVersion - 1, protocolVersion + 1} {
+		if _, err := encodeSignal(version, s); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Fatalf("encodeSignal(%d): got error %v, want %v", version, err, ErrUnsupportedVersion)
+		}
+	}
+}
+
+func TestDecodeSignalErrors(t *testing.T) {
+	valid, err := encodeSignal(protocolVersion, networkSignal{Type: SignalTypeChat, Payload: []byte("hello")})
+	if err != nil {
+		t.Fatalf("encodeSignal: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+		// A stream has no frame boundaries, so trailing bytes are just
+		// the start of the next frame.
+		datagramOnly bool
+	}{
+		{"empty", nil, ErrFrameTruncated, false},
+		{"short header", valid[:frameHeaderSize-1], ErrFrameTruncated, false},
+		{"short body", valid[:len(valid)-1], ErrFrameTruncated, false},
+		{"trailing bytes", append(slices.Clone(valid), 0), ErrInvalidFrame, true},
+		{"version too old", withHeader(valid, func(b []byte) { b[0] = minProtocolVersion - 1 }), ErrUnsupportedVersion, false},
+		{"version too new", withHeader(valid, func(b []byte) { b[0] = protocolVersion + 1 }), ErrUnsupportedVersion, false},
+		{"unknown code", withHeader(valid, func(b []byte) { b[1] = 255 }), ErrUnknownSignalType, false},
+		{"oversize length", withHeader(valid, func(b []byte) {
+			binary.BigEndian.PutUint32(b[3:], uint32(maxFrameSize)+1)
+		}), ErrFrameTooLarge, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeSignal(tt.frame); !errors.Is(err, tt.want) {
+				t.Fatalf("decodeSignal: got error %v, want %v", err, tt.want)
+			}
+			if tt.datagramOnly {
+				return
+			}
+			if _, err := readSignal(bytes.NewReader(tt.frame)); err == nil {
+				t.Fatalf("readSignal: no error")
+			}
+		})
+	}
+}
+
+func TestReadSignalStream(t *testing.T) {
+	signals := []networkSignal{
+		{Type: SignalTypePing, Payload: []byte{1}},
+		{Type: SignalTypePong},
+		{Type: SignalTypeChat, Payload: []byte("hello")},
+	}
+
+	var buf bytes.Buffer
+	for _, s := range signals {
+		if err := writeSignal(&buf, protocolVersion, s); err != nil {
+			t.Fatalf("writeSignal: %v", err)
+		}
+	}
+	for _, want := range signals {
+		got, err := readSignal(&buf)
+		if err != nil {
+			t.Fatalf("readSignal: %v", err)
+		}
+		assertSignal(t, got, want)
+	}
+	if _, err := readSignal(&buf); !errors.Is(err, io.EOF) {
+		t.Fatalf("got error %v at the end, want EOF", err)
+	}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	var w payloadWriter
+	w.string("ID")
+	w.bytes([]byte{0, 1, 2})
+	w.bytes(nil)
+	w.strings([]string{"a", "bc"})
+	w.uvarint(0)
+	w.uvarint(1<<64 - 1)
+
+	r := payloadReader{buf: w.buf}
+	if got := r.string(8); got != "ID" {
+		t.Errorf("string: got %q", got)
+	}
+	if got := r.bytes(8); !bytes.Equal(got, []byte{0, 1, 2}) {
+		t.Errorf("bytes: got %v", got)
+	}
+	if got := r.bytes(8); len(got) != 0 {
+		t.Errorf("empty bytes: got %v", got)
+	}
+	if got := r.strings(2, 2); !slices.Equal(got, []string{"a", "bc"}) {
+		t.Errorf("strings: got %v", got)
+	}
+	if got := r.uvarint(0); got != 0 {
+		t.Errorf("uvarint: got %d", got)
+	}
+	if got := r.uvarint(1<<64 - 1); got != 1<<64-1 {
+		t.Errorf("uvarint: got %d", got)
+	}
+	if err := r.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func TestPayloadReaderErrors(t *testing.T) {
+	var w payloadWriter
+	w.string("hello")
+	w.uvarint(300)
+	valid := w.buf
+
+	tests := []struct {
+		name string
+		buf  []byte
+		read func(r *payloadReader)
+		want error
+	}{
+		{"empty", nil, func(r *payloadReader) { r.string(8) }, ErrPayloadTruncated},
+		{"short field", valid[:3], func(r *payloadReader) { r.string(8) }, ErrPayloadTruncated},
+		{"short uvarint", []byte{0x80}, func(r *payloadReader) { r.uvarint(1) }, ErrPayloadTruncated},
+		{"string too long", valid, func(r *payloadReader) { r.string(4) }, ErrFieldTooLarge},
+		{"uvarint too large", valid, func(r *payloadReader) { r.string(8); r.uvarint(299) }, ErrFieldTooLarge},
+		{"too many strings", []byte{3, 0, 0, 0}, func(r *payloadReader) { r.strings(2, 8) }, ErrFieldTooLarge},
+		{"trailing bytes", valid, func(r *payloadReader) { r.string(8) }, ErrInvalidMessage},
+		{"malformed ID", valid, func(r *payloadReader) { r.id(); r.uvarint(300) }, ErrInvalidPeerID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := payloadReader{buf: tt.buf}
+			tt.read(&r)
+			if err := r.close(); !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func withHeader(frame []byte, change func(b []byte)) []byte {
+	out := slices.Clone(frame)
+	change(out)
+	return out
+}
+
+func assertSignal(t *testing.T, got, want networkSignal) {
+	t.Helper()
+	if got.Type != want.Type {
+		t.Errorf("type: got '%s', want '%s'", got.Type, want.Type)
+	}
+	if !bytes.Equal(got.Payload, want.Payload) {
+		t.Errorf("payload: got %d bytes, want %d", len(got.Payload), len(want.Payload))
+	}
+}
+
+func TestUnmarshalForeignConnectionKey(t *testing.T) {
+	key, from := testKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey: %v", err)
+	}
+	ecdsaPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	to := testNodeID(t)
+
+	var sign payloadWriter
+	sign.string(to)
+	sign.string(from)
+	sign.string("sign")
+	sign.strings(nil)
+	sign.bytes(ecdsaPEM)
+	if err := new(connectionSign).unmarshal(sign.buf); !errors.Is(err, crypt.ErrNotRSAKey) {
+		t.Errorf("connectionSign: got %v, want %v", err, crypt.ErrNotRSAKey)
+	}
+
+	var offer payloadWriter
+	offer.string(to)
+	offer.string(from)
+	offer.string("sign")
+	offer.bytes(ecdsaPEM)
+	offer.bytes([]byte("sdp"))
+	if err := new(rtcOffer).unmarshal(offer.buf); !errors.Is(err, crypt.ErrNotRSAKey) {
+		t.Errorf("rtcOffer: got %v, want %v", err, crypt.ErrNotRSAKey)
+	}
+}
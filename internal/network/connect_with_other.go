@@ -13,31 +13,63 @@ func connectWithOther(d dispatcher, ID string) {
 	var confirmedConnections atomic.Int32
 	var signsProvided atomic.Int32
 
-	signsAreReadyCtx, signsAreReady := context.WithCancel(context.Background())
+	// Only connected neighbours are asked for signs, so the cluster may
+	// be larger than the number of connections that can be made now.
+	var neighbours []*interaction
+	d.rangeInteraction(func(memb *interaction) {
+		memb.mu.RLock()
+		defer memb.mu.RUnlock()
+		if memb.id != ID && memb.state == Connected {
+			neighbours = append(neighbours, memb)
+		}
+	})
 
-	reqConns := min(minNetworkConns, d.clusterSize())
+	reqConns := min(minNetworkConns, d.clusterSize(), len(neighbours))
 	logger.Debugf(ctx, "Required %d connections", reqConns)
+	if reqConns == 0 {
+		d.compareAndSwapInteractionState(ID, NotConnected, Connected)
+		return
+	}
 
-	d.addReaction(waitingSignTimeout,
+	// Signs come from every neighbour, so the slowest one sets the pace.
+	signTimeout := d.timeout(2, waitingSignTimeout)
+	signsAreReadyCtx, signsAreReady := context.WithCancel(context.Background())
+
+	d.addReaction(signTimeout,
 		func(nextS incomeSignal) bool {
 			if nextS.Type != SignalTypeSendConnectionSign {
 				return false
 			}
-			if ID != string(nextS.Payload[:idLength]) {
+			var sign connectionSign
+			if err := sign.unmarshal(nextS.Payload); err != nil {
+				return false
+			}
+			if ID != sign.To {
 				return false
 			}
 			ctx := span.Init("waitingSign for=%s", ID)
 			logger.Debugf(ctx, "Received sign from=%s", nextS.From)
+
+			payload := nextS.Payload
+			if len(sign.StunServers) == 0 && len(d.stunServers()) > 0 {
+				// The member can't help with STUN, so the introducer
+				// advertises its own servers instead.
+				sign.StunServers = d.stunServers()
+				if b, err := sign.marshal(); err == nil {
+					payload = b
+				}
+			}
+
 			signsProvided.Add(1)
 			go func() {
 				select {
-				case <-time.After(waitingSignTimeout):
+				case <-time.After(signTimeout):
 					logger.Warnf(ctx, "Timeout!")
 				case <-signsAreReadyCtx.Done():
 					logger.Debugf(ctx, "Going to send sign from=%s", nextS.From)
 					d.send(ID, networkSignal{
 						Type:    SignalTypeMakeOffer,
-						Payload: nextS.Payload,
+						Payload: payload,
 					})
 				}
 			}()
@@ -51,9 +83,13 @@ func connectWithOther(d dispatcher, ID string) {
 			return false
 		})
 
+	// Once signs are in, offers, answers and reports take a few more
+	// trips through the neighbours, and ICE with the challenge follow,
+	// which round trips don't tell about.
+	establishTimeout := signTimeout + d.timeout(6, waitingConnectionEstablishingTimeout) + handshakeTimeout
 	connectionsEstablishedCtx, connectionsEstablished := context.WithCancel(context.Background())
 	d.addReaction(
-		waitingConnectionEstablishingTimeout,
+		establishTimeout,
 		func(s incomeSignal) bool {
 			if s.Type != SignalTypeConnectionEstablished {
 				return false
@@ -72,27 +108,20 @@ func connectWithOther(d dispatcher, ID string) {
 			return false
 		})
 
-	d.rangeInteraction(func(memb *interaction) {
-		if memb.id == ID {
-			return
-		}
-
-		memb.send <- networkSignal{
+	for _, memb := range neighbours {
+		d.send(memb.id, networkSignal{
 			Type:    SignalTypeGenerateConnectionSign,
 			Payload: []byte(ID),
-		}
-	})
+		})
+	}
 
 	go func() {
 		ctx := span.Init("waiting connection establishing of %s", ID)
 		select {
-		case <-time.After(waitingConnectionEstablishingTimeout):
+		case <-time.After(establishTimeout):
 			logger.Warnf(ctx, "Timeout!")
 			d.disconnect(ID)
-			go d.clusterBroadcast(networkSignal{
-				Type:    SignalTypeDisconnectCandidate,
-				Payload: []byte(ID),
-			})
+			go reportCandidate(d, ID)
 		case <-connectionsEstablishedCtx.Done():
 			logger.Debugf(ctx, "All connections established!")
 			d.compareAndSwapInteractionState(ID, NotConnected, Connected)
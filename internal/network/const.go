@@ -1,6 +1,9 @@
 package network
 
-import "time"
+import (
+	"time"
+	"udisend/pkg/crypt"
+)
 
 var (
 	minNetworkConns = 5
@@ -11,15 +14,165 @@ var (
 
 	waitRTCAnswer = 30 * time.Second
 
+	waitCandidatesTimeout = 30 * time.Second
+
 	waitingConnectionEstablishingTimeout = 30 * time.Second
 
+	pingInterval = 5 * time.Second
+
+	maxMissedPongs = 3
+
+	minSignalTimeout = 5 * time.Second
+
+	processingAllowance = 2 * time.Second
+
 	maxMessagesPerMinute = 600
 
-	idLength = 52
+	dialTimeout = 10 * time.Second
+
+	handshakeTimeout = 10 * time.Second
+
+	sendBufferSize = 64
+
+	defaultWorkersNum = 4
+
+	eventsBufferSize = 64
+
+	reconnectCheckInterval = time.Second
+
+	reconnectBaseDelay = time.Second
+
+	reconnectMaxDelay = time.Minute
+
+	maxReconnectAttempts = 10
+
+	maxReconnectIDs = 64
+
+	swimInterval = time.Second
+
+	swimProbeTimeout = 500 * time.Millisecond
+
+	swimIndirectTimeout = 500 * time.Millisecond
+
+	swimIndirectProbes = 3
+
+	swimSuspicionMult = 4.0
+
+	swimRetransmitMult = 3
+
+	swimTombstoneTTL = 5 * time.Minute
+
+	maxPiggyback = 16
+
+	idLength = crypt.NodeIDLength
 
 	maxStunServerLength = 128
 
+	maxStunServers = 8
+
+	maxAddrLength = 256
+
+	maxStoredAddrs = 4
+
+	maxStoredICEPairs = 4
+
+	maxBootstrapAddrs = 16
+
+	peerStoreFlushInterval = 30 * time.Second
+
+	evictionVoteTTL = 10 * time.Minute
+
+	evictionBanTTL = 24 * time.Hour
+
+	minEvictionQuorum = 2
+
+	maxSignatureLength = 128
+
+	maxClockSkew = 5 * time.Minute
+
+	maxFingerprintLength = 64
+
+	maxNonceLength = 64
+
+	dhtBucketSize = 8
+
+	dhtMaxHops = 16
+
+	dhtMaxIntroducers = 16
+
+	dhtLookupTimeout = 5 * time.Second
+
+	dhtLookupAttempts = 3
+
+	routedTTL = 16
+
+	routedPaths = 3
+
+	routedSeenTTL = 2 * time.Minute
+
+	broadcastTTL = 8
+
+	broadcastFanout = 4
+
+	broadcastSeenTTL = 5 * time.Minute
+
+	maxSeenMessages = 1 << 16
+
+	maxMessageIDLength = 64
+
+	maxChatBodyLength = 4096
+
+	chatBufferSize = 64
+
+	maxRoomNameLength = 128
+
+	maxRoomMembers = 256
+
+	mailTTL = 7 * 24 * time.Hour
+
+	mailFlushInterval = 30 * time.Second
+
+	mailboxReplicas = 3
+
+	maxMailboxLetters = 256
+
+	maxMailboxBytes = 4 << 20
+
+	maxMailboxRecipients = 1024
+
+	maxMailboxAuthorLetters = 64
+
+	maxHeldLetters = 4096
+
+	maxHeldBytes = 64 << 20
+
+	maxSealedLength = 32 << 10
+
+	receiptTimeout = 5 * time.Second
+
+	receiptRetryInterval = time.Second
+
+	maxRetransmits = 3
+
+	maxTrackedMessages = 4096
+
+	causalWait = time.Minute
+
+	causalCheckInterval = time.Second
+
+	maxHeldMessages = 256
+
+	maxHistoryMessages = 1024
+
+	dataChannelLabel = "private"
+
 	signLength = 52
 
 	pubKeyLength = 512
+
+	authKeyLength = 512
+
+	maxMemberKeys = 1024
+
+	maxFrameSize = 1 << 20
 )
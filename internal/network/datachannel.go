@@ -0,0 +1,230 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+
+	"github.com/pion/webrtc/v4"
+)
+
+type dataChannelConnection struct {
+	id        string
+	pc        *webrtc.PeerConnection
+	dc        *webrtc.DataChannel
+	messages  chan networkSignal
+	closed    chan struct{}
+	closeOnce sync.Once
+	// version is minProtocolVersion until the hello is exchanged.
+	version uint8
+}
+
+func newDataChannelConnection(
+	ID string,
+	pc *webrtc.PeerConnection,
+	dc *webrtc.DataChannel,
+) *dataChannelConnection {
+	c := &dataChannelConnection{
+		id:       ID,
+		pc:       pc,
+		dc:       dc,
+		messages: make(chan networkSignal, sendBufferSize),
+		closed:   make(chan struct{}),
+		version:  minProtocolVersion,
+	}
+
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		s, err := decodeSignal(msg.Data)
+		if err != nil {
+			logger.Warnf(nil, "dataChannelConnection <ID:%s>: decodeSignal: %v", ID, err)
+			return
+		}
+		select {
+		case c.messages <- s:
+		case <-c.closed:
+		}
+	})
+
+	dc.OnClose(c.close)
+
+	return c
+}
+
+func (c *dataChannelConnection) ID() string {
+	return c.id
+}
+
+func (c *dataChannelConnection) Interact(
+	ctx context.Context,
+	out <-chan networkSignal,
+) <-chan incomeSignal {
+	ctx = span.Extend(ctx, "dataChannelConnection.Interact")
+	in := make(chan incomeSignal)
+
+	go func() {
+		defer func() {
+			c.close()
+			c.dc.Close()
+			c.pc.Close()
+		}()
+		for s := range out {
+			b, err := encodeSignal(c.version, s)
+			if err != nil {
+				logger.Errorf(ctx, "encodeSignal: %v", err)
+				continue
+			}
+			if err := c.dc.Send(b); err != nil {
+				logger.Warnf(ctx, "dc.Send: %v", err)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(in)
+		for {
+			select {
+			case s := <-c.messages:
+				select {
+				case in <- incomeSignal{From: c.id, networkSignal: s}:
+				case <-ctx.Done():
+					return
+				}
+			case <-c.closed:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return in
+}
+
+func (c *dataChannelConnection) sendNow(s networkSignal) error {
+	b, err := encodeSignal(c.version, s)
+	if err != nil {
+		return err
+	}
+	return c.dc.Send(b)
+}
+
+func (c *dataChannelConnection) receive(timeout time.Duration) (networkSignal, error) {
+	select {
+	case s := <-c.messages:
+		return s, nil
+	case <-c.closed:
+		return networkSignal{}, io.EOF
+	case <-time.After(timeout):
+		return networkSignal{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *dataChannelConnection) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+func joinMesh(d dispatcher, conn *dataChannelConnection, introducer string, report bool) {
+	ctx := span.Init("joinMesh <ID:%s>", conn.ID())
+	logger.Debugf(ctx, "Start...")
+
+	remote, caps, err := exchangeHello(
+		d.myID(),
+		d.listenAddress(),
+		conn.sendNow,
+		func() (networkSignal, error) { return conn.receive(handshakeTimeout) },
+	)
+	if err == nil && remote.ID != conn.ID() {
+		err = fmt.Errorf("%w: expected '%s', got '%s'", ErrInvalidPeerID, conn.ID(), remote.ID)
+	}
+	if err == nil && d.isBlocked(remote.ID) {
+		err = fmt.Errorf("%w: '%s'", ErrBlockedPeer, remote.ID)
+	}
+	if err == nil {
+		err = d.checkPolicy(remote.ID, nil)
+	}
+	if err != nil {
+		logger.Warnf(ctx, "exchangeHello: %v", err)
+		conn.close()
+		conn.pc.Close()
+		return
+	}
+
+	conn.version = caps.version
+
+	connCtx, disconnect := context.WithCancel(context.Background())
+	conn.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		logger.Debugf(ctx, "Connection change state to '%s'", state.String())
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			disconnect()
+		}
+	})
+
+	if err := d.addConnection(connCtx, conn, caps, disconnect); err != nil {
+		logger.Warnf(ctx, "d.addConnection: %v", err)
+		disconnect()
+		conn.close()
+		conn.pc.Close()
+		return
+	}
+	rememberRoute(d.knownPeers(), conn, remote.ListenAddr)
+
+	if d.memberAuthKey(conn.ID()) == nil {
+		requestAuthKeys(d, introducer, conn.ID())
+	}
+	// The neighbour's key comes from others, so it's checked here too:
+	// the neighbour stays unverified until it passes, and is dropped if
+	// it doesn't.
+	sendAuthKeys(d, conn.ID(), memberKeys{{ID: d.myID(), PubKey: &d.privateAuthKey().PublicKey}})
+	challengePeer(d, conn.ID(), func(context.Context) {
+		d.admitMember(conn.ID())
+		d.compareAndSwapInteractionState(conn.ID(), NotVerified, Connected)
+
+		if report {
+			d.send(introducer, networkSignal{
+				Type:    SignalTypeConnectionEstablished,
+				Payload: []byte(conn.ID()),
+			})
+		}
+	})
+
+	logger.Debugf(ctx, "...End")
+}
+
+// rememberRoute stores the candidate pair that carried the connection,
+// and the bootstrap address of the peer when the pair leads straight to
+// it rather than through a relay.
+func rememberRoute(peers *peerStore, conn *dataChannelConnection, listenAddr string) {
+	if peers == nil {
+		return
+	}
+	peers.seen(conn.ID())
+
+	sctp := conn.pc.SCTP()
+	if sctp == nil {
+		return
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return
+	}
+	peers.addICEPair(conn.ID(), icePair{
+		Local:  pair.Local.String(),
+		Remote: pair.Remote.String(),
+	})
+
+	if pair.Remote.Typ == webrtc.ICECandidateTypeRelay {
+		return
+	}
+	observed := &net.UDPAddr{IP: net.ParseIP(pair.Remote.Address)}
+	peers.addAddr(conn.ID(), advertisedAddr(listenAddr, observed))
+}
@@ -0,0 +1,501 @@
+package network
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+	"slices"
+	"sync"
+	"time"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// Lookups are recursive rather than iterative: a node can only talk to
+// its neighbours, so a query walks the mesh hop by hop, each hop passing
+// it to a contact closer to the target by the XOR metric. The reply goes
+// back along the recorded path, and every hop it crosses learns a route.
+
+type dhtKey [sha256.Size]byte
+
+type dhtValueKind uint8
+
+const (
+	dhtAuthKey dhtValueKind = iota + 1
+	dhtAddrs
+)
+
+type dhtQuery struct {
+	Seq    uint64
+	Target string
+	Kind   dhtValueKind
+	// Path is the way the query came, the origin first.
+	Path []string
+}
+
+type dhtReply struct {
+	Seq       uint64
+	Target    string
+	Responder string
+	Found     bool
+	// Introducers are neighbours of the target, which can pass signals
+	// to it.
+	Introducers []string
+	Value       []byte
+	// Path is the rest of the way back, the origin first.
+	Path []string
+}
+
+// contact is a route to a node that isn't necessarily a neighbour: via
+// is the neighbour signals to it are passed to.
+type contact struct {
+	ID   string
+	key  dhtKey
+	via  string
+	seen time.Time
+}
+
+type routingTable struct {
+	mu      sync.Mutex
+	self    dhtKey
+	seq     uint64
+	buckets [sha256.Size * 8][]contact
+}
+
+func newRoutingTable(ID string) *routingTable {
+	return &routingTable{self: keyOf(ID)}
+}
+
+func keyOf(ID string) dhtKey {
+	return sha256.Sum256([]byte(ID))
+}
+
+func (k dhtKey) xor(other dhtKey) dhtKey {
+	var out dhtKey
+	for idx := range k {
+		out[idx] = k[idx] ^ other[idx]
+	}
+	return out
+}
+
+func (k dhtKey) less(other dhtKey) bool {
+	return slices.Compare(k[:], other[:]) < 0
+}
+
+// bucketOf is the length of the common prefix with the own key.
+func (t *routingTable) bucketOf(key dhtKey) int {
+	d := t.self.xor(key)
+	for idx, b := range d {
+		if b != 0 {
+			return idx*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return len(t.buckets) - 1
+}
+
+// learn remembers a route. Like in Kademlia, a full bucket keeps its old
+// contacts, but a route through the node itself beats a relayed one.
+func (t *routingTable) learn(ID, via string) {
+	key := keyOf(ID)
+	if key == t.self {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idx := t.bucketOf(key)
+	bucket := t.buckets[idx]
+	c := contact{ID: ID, key: key, via: via, seen: time.Now()}
+
+	if pos := slices.IndexFunc(bucket, func(c contact) bool { return c.ID == ID }); pos >= 0 {
+		if bucket[pos].via == ID && via != ID {
+			c.via = ID
+		}
+		bucket = append(slices.Delete(bucket, pos, pos+1), c)
+	} else if len(bucket) < dhtBucketSize {
+		bucket = append(bucket, c)
+	} else if via == ID {
+		pos := slices.IndexFunc(bucket, func(c contact) bool { return c.via != c.ID })
+		if pos < 0 {
+			return
+		}
+		bucket = append(slices.Delete(bucket, pos, pos+1), c)
+	}
+	t.buckets[idx] = bucket
+}
+
+// forget drops a node and every route through it.
+func (t *routingTable) forget(ID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for idx, bucket := range t.buckets {
+		t.buckets[idx] = slices.DeleteFunc(bucket, func(c contact) bool {
+			return c.ID == ID || c.via == ID
+		})
+	}
+}
+
+// nextHop picks a neighbour to pass a query to: the one routing to the
+// contact closest to the target. Routes are learned from traffic, so a
+// young table may know nobody closer than the node itself; the query
+// then makes a detour rather than giving up, and the path keeps it from
+// going in circles.
+func (t *routingTable) nextHop(target string, neighbours, exclude []string) (string, bool) {
+	key := keyOf(target)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var best dhtKey
+	var bestVia string
+	consider := func(ID, via string, k dhtKey) {
+		if slices.Contains(exclude, ID) || slices.Contains(exclude, via) {
+			return
+		}
+		if !slices.Contains(neighbours, via) {
+			return
+		}
+		if d := k.xor(key); bestVia == "" || d.less(best) {
+			best, bestVia = d, via
+		}
+	}
+
+	for _, ID := range neighbours {
+		consider(ID, ID, keyOf(ID))
+	}
+	for _, bucket := range t.buckets {
+		for _, c := range bucket {
+			consider(c.ID, c.via, c.key)
+		}
+	}
+	return bestVia, bestVia != ""
+}
+
+func (t *routingTable) knows(ID string) bool {
+	key := keyOf(ID)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return slices.ContainsFunc(t.buckets[t.bucketOf(key)], func(c contact) bool { return c.ID == ID })
+}
+
+func (t *routingTable) nextSeq() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	return t.seq
+}
+
+func (q dhtQuery) marshal() []byte {
+	var w payloadWriter
+	w.uvarint(q.Seq)
+	w.string(q.Target)
+	w.uvarint(uint64(q.Kind))
+	w.strings(q.Path)
+	return w.buf
+}
+
+func (q *dhtQuery) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	q.Seq = r.uvarint(1<<64 - 1)
+	q.Target = r.id()
+	q.Kind = dhtValueKind(r.uvarint(255))
+	q.Path = readIDs(&r, dhtMaxHops)
+	return r.close()
+}
+
+func (p dhtReply) marshal() []byte {
+	var w payloadWriter
+	w.uvarint(p.Seq)
+	w.string(p.Target)
+	w.string(p.Responder)
+	if p.Found {
+		w.uvarint(1)
+	} else {
+		w.uvarint(0)
+	}
+	w.strings(p.Introducers)
+	w.bytes(p.Value)
+	w.strings(p.Path)
+	return w.buf
+}
+
+func (p *dhtReply) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	p.Seq = r.uvarint(1<<64 - 1)
+	p.Target = r.id()
+	p.Responder = r.id()
+	p.Found = r.uvarint(1) == 1
+	p.Introducers = readIDs(&r, dhtMaxIntroducers)
+	p.Value = r.bytes(maxFrameSize)
+	p.Path = readIDs(&r, dhtMaxHops)
+	return r.close()
+}
+
+func readIDs(r *payloadReader, limit int) []string {
+	count := r.uvarint(uint64(limit))
+	IDs := make([]string, 0, count)
+	for range count {
+		IDs = append(IDs, r.id())
+	}
+	return IDs
+}
+
+// answerLookup handles FindNode and FindValue: it either answers the
+// query or passes it on.
+func answerLookup(d dispatcher, s incomeSignal) {
+	var q dhtQuery
+	if err := q.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "answerLookup <From:%s>: q.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("answerLookup <Target:%s> <From:%s>", q.Target, s.From)
+	if len(q.Path) == 0 || q.Path[len(q.Path)-1] != s.From {
+		logger.Warnf(ctx, "Path doesn't end with the sender!")
+		return
+	}
+	if slices.Contains(q.Path, d.myID()) {
+		logger.Debugf(ctx, "Loop")
+		return
+	}
+
+	routes := d.routes()
+	for _, ID := range q.Path {
+		routes.learn(ID, s.From)
+	}
+
+	reply := dhtReply{Seq: q.Seq, Target: q.Target, Responder: d.myID(), Path: q.Path}
+	replyType := SignalTypeFoundNode
+	if s.Type == SignalTypeFindValue {
+		replyType = SignalTypeFoundValue
+		reply.Value, reply.Found = d.dhtValue(q.Kind, q.Target)
+	} else if q.Target == d.myID() {
+		reply.Found = true
+		reply.Introducers = d.connectedPeers()
+		reply.Introducers = reply.Introducers[:min(len(reply.Introducers), dhtMaxIntroducers)]
+	}
+
+	if !reply.Found && len(q.Path) < dhtMaxHops {
+		next, ok := routes.nextHop(q.Target, d.connectedPeers(), q.Path)
+		if ok {
+			q.Path = append(q.Path, d.myID())
+			d.send(next, networkSignal{Type: s.Type, Payload: q.marshal()})
+			logger.Debugf(ctx, "Passed to '%s'", next)
+			return
+		}
+	}
+
+	// Either the answer or the closest node known to have none.
+	d.send(s.From, networkSignal{Type: replyType, Payload: reply.marshal()})
+	logger.Debugf(ctx, "Answered, found=%t", reply.Found)
+}
+
+// returnLookup passes a reply one hop back toward the origin.
+func returnLookup(d dispatcher, s incomeSignal) {
+	var p dhtReply
+	if err := p.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "returnLookup <From:%s>: p.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("returnLookup <Target:%s> <From:%s>", p.Target, s.From)
+	if len(p.Path) == 0 || p.Path[len(p.Path)-1] != d.myID() {
+		logger.Warnf(ctx, "Not on the path!")
+		return
+	}
+	// Everything behind the sender is reachable through it: the
+	// responder and, when found, the target with its neighbours.
+	routes := d.routes()
+	routes.learn(p.Responder, s.From)
+	if p.Found && s.Type == SignalTypeFoundNode {
+		routes.learn(p.Target, s.From)
+		for _, ID := range p.Introducers {
+			routes.learn(ID, s.From)
+		}
+	}
+
+	p.Path = p.Path[:len(p.Path)-1]
+	if len(p.Path) == 0 {
+		// It's the origin; the waiting lookup picks the reply up.
+		return
+	}
+	d.send(p.Path[len(p.Path)-1], networkSignal{Type: s.Type, Payload: p.marshal()})
+}
+
+// lookup sends a query and waits for the reply. Queries walk greedily
+// and may run into a dead end, so a negative reply is retried through
+// other neighbours.
+func lookup(ctx context.Context, d dispatcher, t signalType, target string, kind dhtValueKind) (dhtReply, error) {
+	ctx = span.Extend(ctx, "lookup <Type:%s> <Target:%s>", t, target)
+	routes := d.routes()
+
+	var tried []string
+	var p dhtReply
+	for range dhtLookupAttempts {
+		next, ok := routes.nextHop(target, d.connectedPeers(), tried)
+		if !ok {
+			break
+		}
+		tried = append(tried, next)
+
+		var err error
+		if p, err = ask(ctx, d, t, next, dhtQuery{
+			Seq:    routes.nextSeq(),
+			Target: target,
+			Kind:   kind,
+			Path:   []string{d.myID()},
+		}); err != nil {
+			return dhtReply{}, err
+		}
+		logger.Debugf(ctx, "'%s' replied, found=%t", next, p.Found)
+		if p.Found {
+			return p, nil
+		}
+	}
+
+	if len(tried) == 0 {
+		return dhtReply{}, ErrNoRoute
+	}
+	return p, nil
+}
+
+func ask(ctx context.Context, d dispatcher, t signalType, next string, q dhtQuery) (dhtReply, error) {
+	replyType := SignalTypeFoundNode
+	if t == SignalTypeFindValue {
+		replyType = SignalTypeFoundValue
+	}
+
+	replies := make(chan dhtReply, 1)
+	d.addReaction(dhtLookupTimeout, func(s incomeSignal) bool {
+		if s.Type != replyType {
+			return false
+		}
+		var p dhtReply
+		if err := p.unmarshal(s.Payload); err != nil {
+			return false
+		}
+		if p.Seq != q.Seq || p.Target != q.Target || len(p.Path) != 1 || p.Path[0] != d.myID() {
+			return false
+		}
+		replies <- p
+		return true
+	})
+	d.send(next, networkSignal{Type: t, Payload: q.marshal()})
+
+	select {
+	case p := <-replies:
+		return p, nil
+	case <-time.After(dhtLookupTimeout):
+		return dhtReply{}, ErrLookupTimeout
+	case <-ctx.Done():
+		return dhtReply{}, ctx.Err()
+	}
+}
+
+// findNode locates a member and returns its neighbours.
+func findNode(ctx context.Context, d dispatcher, ID string) ([]string, error) {
+	if ID == d.myID() {
+		return d.connectedPeers(), nil
+	}
+	p, err := lookup(ctx, d, SignalTypeFindNode, ID, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Found {
+		return nil, fmt.Errorf("%w: '%s'", ErrNotFound, ID)
+	}
+	return p.Introducers, nil
+}
+
+func findValue(ctx context.Context, d dispatcher, kind dhtValueKind, ID string) ([]byte, error) {
+	if v, ok := d.dhtValue(kind, ID); ok {
+		return v, nil
+	}
+	p, err := lookup(ctx, d, SignalTypeFindValue, ID, kind)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Found {
+		return nil, fmt.Errorf("%w: '%s'", ErrNotFound, ID)
+	}
+	return p.Value, nil
+}
+
+// dhtValue is what the node can tell about a member by itself.
+func (i *interactions) dhtValue(kind dhtValueKind, ID string) ([]byte, bool) {
+	switch kind {
+	case dhtAuthKey:
+		key := i.memberAuthKey(ID)
+		if key == nil {
+			return nil, false
+		}
+		b, err := memberKeys{{ID: ID, PubKey: key}}.marshal()
+		if err != nil {
+			return nil, false
+		}
+		return b, true
+	case dhtAddrs:
+		var addrs []string
+		if ID == i.ID && i.listenAddr != "" {
+			addrs = append(addrs, i.listenAddr)
+		}
+		addrs = append(addrs, i.peers.addrs(ID)...)
+		if len(addrs) == 0 {
+			return nil, false
+		}
+		var w payloadWriter
+		w.strings(addrs)
+		return w.buf, true
+	}
+	return nil, false
+}
+
+func (i *interactions) routes() *routingTable {
+	return i.routing
+}
+
+// FindNode locates a member anywhere in the cluster and returns its
+// current neighbours, which can introduce others to it.
+func (n *Network) FindNode(ctx context.Context, ID string) ([]string, error) {
+	return findNode(ctx, n, ID)
+}
+
+// FindAuthKey looks up the auth key of a member.
+func (n *Network) FindAuthKey(ctx context.Context, ID string) (*ecdsa.PublicKey, error) {
+	return findAuthKey(ctx, n, ID)
+}
+
+// findAuthKey can trust whoever answers: a key that doesn't match the ID
+// is refused when unmarshalled.
+func findAuthKey(ctx context.Context, d dispatcher, ID string) (*ecdsa.PublicKey, error) {
+	b, err := findValue(ctx, d, dhtAuthKey, ID)
+	if err != nil {
+		return nil, err
+	}
+	var keys memberKeys
+	if err := keys.unmarshal(b); err != nil {
+		return nil, err
+	}
+	if len(keys) != 1 || keys[0].ID != ID {
+		return nil, fmt.Errorf("%w: foreign key", ErrInvalidMessage)
+	}
+	d.addMembers(keys)
+	return keys[0].PubKey, nil
+}
+
+// FindAddrs looks up bootstrap addresses of a member.
+func (n *Network) FindAddrs(ctx context.Context, ID string) ([]string, error) {
+	b, err := findValue(ctx, n, dhtAddrs, ID)
+	if err != nil {
+		return nil, err
+	}
+	r := payloadReader{buf: b}
+	addrs := r.strings(maxStoredAddrs+1, maxAddrLength)
+	return addrs, r.close()
+}
@@ -1,25 +1,68 @@
 package network
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"net"
 	"time"
 	"udisend/pkg/logger"
 	"udisend/pkg/span"
+
+	"github.com/pion/webrtc/v4"
 )
 
 type clusterKeeper interface {
 	clusterSize() int
 	memberAuthKey(ID string) *ecdsa.PublicKey
+	presentAuthKey(ID string, key *ecdsa.PublicKey)
+	candidateAuthKey(ID string) *ecdsa.PublicKey
+	admitMember(ID string) (memberKey, bool)
+	addMembers(keys memberKeys) memberKeys
+	authKeys(IDs []string) memberKeys
+	applyGossip(updates []memberUpdate)
+	piggyback(to string) []memberUpdate
+	nextProbeSeq() uint64
+	membersSnapshot() []memberUpdate
+	knownPeers() *peerStore
+	rememberPeer(ID string)
+	addVote(v evictionVote) (added, evicted bool)
+	canVote(ID string) bool
+	evict(ID string)
+	isBlocked(ID string) bool
+	checkInvite(ID string, payload []byte) (invite, error)
+	redeemInvite(inv invite) error
+	checkPolicy(ID string, addr net.Addr) error
+	routes() *routingTable
+	dhtValue(kind dhtValueKind, ID string) ([]byte, bool)
+	firstSeen(ID string) bool
+	wasSeen(ID string) bool
+	permitsSignal(t signalType) bool
+	firstBroadcast(ID string) bool
+	receiveChat(m ChatMessage)
+	applyRoomEvent(e roomEvent) bool
+	mergeRoom(from string, in *room)
+	roomSnapshot(roomID string) ([]byte, bool)
+	isRoomMember(roomID, ID string) bool
+	holdLetter(l letter) error
+	receiveReceipt(from string, r receipt)
 }
 
 type interactor interface {
 	addReaction(timeout time.Duration, fn func(s incomeSignal) bool)
+	addConnection(ctx context.Context, conn connection, caps capabilities, disconnect func()) error
 	getInteraction(ID string) (*interaction, bool)
 	rangeInteraction(fn func(memb *interaction))
 	send(ID string, msg networkSignal)
 	disconnect(ID string)
 	clusterBroadcast(networkSignal)
 	compareAndSwapInteractionState(ID string, old, new interactionState)
+	expectChallenge(ID string)
+	answerChallenge(ID string) bool
+	timeout(rounds int, fallback time.Duration, peers ...string) time.Duration
+	connectedPeers() []string
+	forward(ctx context.Context, e envelope)
+	deliver(s incomeSignal)
+	spread(ctx context.Context, f flood, from string)
 }
 
 type dispatcher interface {
@@ -27,14 +70,42 @@ type dispatcher interface {
 	interactor
 	privateAuthKey() *ecdsa.PrivateKey
 	myID() string
-	stunServer() string
+	listenAddress() string
+	stunServers() []string
+	iceServers(remoteStun []string) []webrtc.ICEServer
+	newPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, error)
 }
 
 var handlers = map[signalType]func(dispatcher, incomeSignal){
 	SignalTypeDoVerify:               sendChallenge,
+	SignalTypeProvidePubKey:          provideAuthKeys,
+	SignalTypePubKeyProvided:         acceptAuthKeys,
 	SignalTypeSolveChallenge:         solveChallenge,
 	SignalTypeGenerateConnectionSign: generateConnectionSign,
 	SignalTypeMakeOffer:              makeOffer,
+	SignalTypeSendOffer:              relayOffer,
+	SignalTypeSendAnswer:             relayAnswer,
+	SignalTypeSendICECandidate:       relayICECandidate,
+	SignalTypeReconnect:              introduce,
+	SignalTypePing:                   answerPing,
+	SignalTypePong:                   handlePong,
+	SignalTypeProbe:                  answerProbe,
+	SignalTypeProbeAck:               acceptProbeAck,
+	SignalTypeProbeRequest:           probeFor,
+	SignalTypeSyncMembers:            acceptMembers,
+	SignalTypeDisconnectCandidate:    countVote,
+	SignalTypeFindNode:               answerLookup,
+	SignalTypeFindValue:              answerLookup,
+	SignalTypeFoundNode:              returnLookup,
+	SignalTypeFoundValue:             returnLookup,
+	SignalTypeRouted:                 acceptRouted,
+	SignalTypeBroadcast:              acceptBroadcast,
+	SignalTypeChat:                   acceptChat,
+	SignalTypeRoomEvent:              acceptRoomEvent,
+	SignalTypeRoomSync:               acceptRoomSync,
+	SignalTypeDeposit:                acceptDeposit,
+	SignalTypeMail:                   acceptMail,
+	SignalTypeReceipt:                acceptReceipt,
 }
 
 func (i *interactions) dispatch(s incomeSignal) {
@@ -1,9 +1,12 @@
 package network
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
+	"sync"
+	"time"
 	"udisend/pkg/crypt"
 	"udisend/pkg/logger"
 	"udisend/pkg/span"
@@ -15,6 +18,8 @@ type offerer struct {
 	privateRSA *rsa.PrivateKey
 	pubRSA     *rsa.PublicKey
 	offer      rtcOffer
+	introducer string
+	candidates *remoteCandidates
 }
 
 type answerer struct {
@@ -23,6 +28,23 @@ type answerer struct {
 	answer     rtcAnswer
 }
 
+// closeUnlessOpened closes the peer connection unless its data channel
+// opens in time: an answer or a channel that never comes would leave
+// ICE agents and sockets behind. The returned func reports the opening.
+func closeUnlessOpened(ctx context.Context, pc *webrtc.PeerConnection, timeout time.Duration) func() {
+	opened := make(chan struct{})
+	var once sync.Once
+	go func() {
+		select {
+		case <-opened:
+		case <-time.After(timeout):
+			logger.Warnf(ctx, "Data channel isn't open in time")
+			pc.Close()
+		}
+	}()
+	return func() { once.Do(func() { close(opened) }) }
+}
+
 func makeOffer(n dispatcher, s incomeSignal) {
 	var connSign connectionSign
 	err := connSign.unmarshal(s.Payload)
@@ -34,26 +56,41 @@ func makeOffer(n dispatcher, s incomeSignal) {
 	logger.Debugf(ctx, "Start...")
 
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{connSign.StunServer},
-			},
-		},
+		ICEServers: n.iceServers(connSign.StunServers),
+	}
+
+	pc, err := n.newPeerConnection(config)
+	if err != nil {
+		logger.Errorf(ctx, "webrtc.NewPeerConnection: %v", err)
+		return
 	}
 
-	pc, err := webrtc.NewPeerConnection(config)
+	dc, err := pc.CreateDataChannel(dataChannelLabel, nil)
 	if err != nil {
-		logger.Errorf(ctx, "webrtc.NewPeerConnection <stubServer:%s>: %v", connSign.StunServer, err)
+		logger.Errorf(ctx, "pc.CreateDataChannel: %v", err)
+		pc.Close()
 		return
 	}
 
-	dc, err := pc.CreateDataChannel("private", nil)
+	answerTimeout := n.timeout(2, waitRTCAnswer, s.From)
+	opened := closeUnlessOpened(ctx, pc, answerTimeout+handshakeTimeout)
+	conn := newDataChannelConnection(connSign.From, pc, dc)
+	dc.OnOpen(func() {
+		opened()
+		joinMesh(n, conn, s.From, false)
+	})
+
+	privateKey, publicKey, err := crypt.GenerateRSAKeys()
 	if err != nil {
-		logger.Errorf(ctx, "pc.CreateDataChannel <stubServer:%s>: %v", connSign.StunServer, err)
+		logger.Errorf(ctx, "crypt.GenerateRSAKeys: %v", err)
 		pc.Close()
 		return
 	}
 
+	candidates := &remoteCandidates{}
+	awaitCandidates(n, s.From, connSign.From, privateKey, candidates)
+	trickleCandidates(n, pc, s.From, connSign.From, connSign.PubKey)
+
 	of, err := pc.CreateOffer(nil)
 	if err != nil {
 		dc.Close()
@@ -68,12 +105,8 @@ func makeOffer(n dispatcher, s incomeSignal) {
 		return
 	}
 
-	privateKey, publicKey, err := crypt.GenerateRSAKeys()
-	if err != nil {
-		return
-	}
 	n.addReaction(
-		waitRTCAnswer,
+		answerTimeout,
 		func(nextS incomeSignal) bool {
 			if nextS.Type != SignalTypeHandleAnswer {
 				return false
@@ -91,7 +124,7 @@ func makeOffer(n dispatcher, s incomeSignal) {
 				return false
 			}
 
-			remoteSD, err := crypt.DecryptMessage(answ.RemoteSD, privateKey)
+			remoteSD, err := crypt.OpenMessage(answ.RemoteSD, privateKey)
 			if err != nil {
 				return false
 			}
@@ -107,12 +140,25 @@ func makeOffer(n dispatcher, s incomeSignal) {
 				return false
 			}
 
+			if err := candidates.ready(pc); err != nil {
+				logger.Warnf(ctx, "candidates.ready: %v", err)
+			}
+
 			return true
 		},
 	)
 
-	encrypted, err := crypt.EncryptMessage([]byte(of.SDP), connSign.PubKey)
+	localSD, err := json.Marshal(pc.LocalDescription())
+	if err != nil {
+		logger.Errorf(ctx, "json.Marshal: %v", err)
+		pc.Close()
+		return
+	}
+
+	encrypted, err := crypt.SealMessage(localSD, connSign.PubKey)
 	if err != nil {
+		logger.Errorf(ctx, "crypt.SealMessage: %v", err)
+		pc.Close()
 		return
 	}
 
@@ -124,6 +170,8 @@ func makeOffer(n dispatcher, s incomeSignal) {
 		RemoteSD: encrypted,
 	}.marshal()
 	if err != nil {
+		logger.Errorf(ctx, "rtcOffer.marshal: %v", err)
+		pc.Close()
 		return
 	}
 
@@ -139,6 +187,10 @@ func generateConnectionSign(n dispatcher, s incomeSignal) {
 	recipient := string(s.Payload)
 	ctx := span.Init("generateConnectionSign <Recipient:%s>", recipient)
 	logger.Debugf(ctx, "Start...")
+	if !crypt.ValidNodeID(recipient) {
+		logger.Warnf(ctx, "Malformed recipient ID!")
+		return
+	}
 	sign := rand.Text() + rand.Text()
 
 	private, public, err := crypt.GenerateRSAKeys()
@@ -146,8 +198,11 @@ func generateConnectionSign(n dispatcher, s incomeSignal) {
 		return
 	}
 
+	candidates := &remoteCandidates{}
+	awaitCandidates(n, s.From, recipient, private, candidates)
+
 	n.addReaction(
-		waitOfferTimeout,
+		n.timeout(3, waitOfferTimeout, s.From),
 		func(nextS incomeSignal) bool {
 			if nextS.Type != SignalTypeHandleOffer {
 				return false
@@ -170,6 +225,8 @@ func generateConnectionSign(n dispatcher, s incomeSignal) {
 				privateRSA: private,
 				pubRSA:     public,
 				offer:      offer,
+				introducer: nextS.From,
+				candidates: candidates,
 			})
 
 			return true
@@ -177,16 +234,16 @@ func generateConnectionSign(n dispatcher, s incomeSignal) {
 	)
 
 	payload, err := connectionSign{
-		To:         recipient,
-		From:       n.myID(),
-		Sign:       sign,
-		StunServer: n.stunServer(),
-		PubKey:     public,
+		To:          recipient,
+		From:        n.myID(),
+		Sign:        sign,
+		StunServers: n.stunServers(),
+		PubKey:      public,
 	}.marshal()
 	if err != nil {
 		return
 	}
-	n.send(recipient, networkSignal{
+	n.send(s.From, networkSignal{
 		Type:    SignalTypeSendConnectionSign,
 		Payload: payload,
 	})
@@ -199,34 +256,43 @@ func handleOffer(n dispatcher, c offerer) {
 	logger.Debugf(ctx, "Start...")
 
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{n.stunServer()},
-			},
-		},
+		ICEServers: n.iceServers(nil),
 	}
 
-	pc, err := webrtc.NewPeerConnection(config)
+	pc, err := n.newPeerConnection(config)
 	if err != nil {
 		logger.Errorf(ctx, "webrtc.NewPeerConnection: %v", err)
 		return
 	}
 
-	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		if state == webrtc.PeerConnectionStateClosed {
-			//			disconnect()
+	// The offerer waits for the answer as long, and the channel opens
+	// after that.
+	opened := closeUnlessOpened(ctx, pc, n.timeout(2, waitRTCAnswer, c.introducer)+handshakeTimeout)
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() != dataChannelLabel {
+			logger.Warnf(ctx, "Unexpected data channel '%s'", dc.Label())
+			dc.Close()
+			return
 		}
-		logger.Debugf(ctx, "Connection change state to '%s'", state.String())
+		conn := newDataChannelConnection(c.offer.From, pc, dc)
+		dc.OnOpen(func() {
+			opened()
+			joinMesh(n, conn, c.introducer, true)
+		})
 	})
 
 	sd := webrtc.SessionDescription{}
-	sdByted, err := crypt.DecryptMessage(c.offer.RemoteSD, c.privateRSA)
+	sdByted, err := crypt.OpenMessage(c.offer.RemoteSD, c.privateRSA)
 	if err != nil {
+		logger.Errorf(ctx, "crypt.OpenMessage: %v", err)
+		pc.Close()
 		return
 	}
 
 	err = json.Unmarshal(sdByted, &sd)
 	if err != nil {
+		logger.Errorf(ctx, "json.Unmarshal: %v", err)
+		pc.Close()
 		return
 	}
 
@@ -237,6 +303,11 @@ func handleOffer(n dispatcher, c offerer) {
 		return
 	}
 
+	if err := c.candidates.ready(pc); err != nil {
+		logger.Warnf(ctx, "candidates.ready: %v", err)
+	}
+	trickleCandidates(n, pc, c.introducer, c.offer.From, c.offer.PubKey)
+
 	answ, err := pc.CreateAnswer(nil)
 	if err != nil {
 		logger.Errorf(ctx, "pc.CreateAnswer: %v", err)
@@ -244,8 +315,6 @@ func handleOffer(n dispatcher, c offerer) {
 		return
 	}
 
-	gatherComplete := webrtc.GatheringCompletePromise(pc)
-
 	err = pc.SetLocalDescription(answ)
 	if err != nil {
 		logger.Errorf(ctx, "pc.SetLocalDescription: %v", err)
@@ -253,16 +322,68 @@ func handleOffer(n dispatcher, c offerer) {
 		return
 	}
 
-	<-gatherComplete
+	localSD, err := json.Marshal(pc.LocalDescription())
+	if err != nil {
+		logger.Errorf(ctx, "json.Marshal: %v", err)
+		pc.Close()
+		return
+	}
+
+	encrypted, err := crypt.SealMessage(localSD, c.offer.PubKey)
+	if err != nil {
+		logger.Errorf(ctx, "crypt.SealMessage: %v", err)
+		pc.Close()
+		return
+	}
 
-	n.send(c.offer.From, networkSignal{
+	n.send(c.introducer, networkSignal{
 		Type: SignalTypeSendAnswer,
 		Payload: rtcAnswer{
 			To:       c.offer.From,
 			From:     n.myID(),
-			RemoteSD: []byte(answ.SDP),
+			RemoteSD: encrypted,
 		}.marshal(),
 	})
 
 	logger.Debugf(ctx, "...End")
 }
+
+func relayOffer(n dispatcher, s incomeSignal) {
+	var offer rtcOffer
+	if err := offer.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "relayOffer <From:%s>: offer.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("relayOffer <From:%s> <To:%s>", offer.From, offer.To)
+	if offer.From != s.From {
+		logger.Warnf(ctx, "Sender mismatch!")
+		return
+	}
+
+	n.send(offer.To, networkSignal{
+		Type:    SignalTypeHandleOffer,
+		Payload: s.Payload,
+	})
+	logger.Debugf(ctx, "Relayed")
+}
+
+func relayAnswer(n dispatcher, s incomeSignal) {
+	var answ rtcAnswer
+	if err := answ.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "relayAnswer <From:%s>: answ.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("relayAnswer <From:%s> <To:%s>", answ.From, answ.To)
+	if answ.From != s.From {
+		logger.Warnf(ctx, "Sender mismatch!")
+		return
+	}
+
+	n.send(answ.To, networkSignal{
+		Type:    SignalTypeHandleAnswer,
+		Payload: s.Payload,
+	})
+	logger.Debugf(ctx, "Relayed")
+}
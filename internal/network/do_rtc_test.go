@@ -0,0 +1,36 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestCloseUnlessOpened(t *testing.T) {
+	newPC := func(t *testing.T) *webrtc.PeerConnection {
+		t.Helper()
+		pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatalf("webrtc.NewPeerConnection: %v", err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	timeout := 50 * time.Millisecond
+
+	abandoned := newPC(t)
+	closeUnlessOpened(context.Background(), abandoned, timeout)
+
+	opened := newPC(t)
+	closeUnlessOpened(context.Background(), opened, timeout)()
+
+	time.Sleep(5 * timeout)
+	if got := abandoned.ConnectionState(); got != webrtc.PeerConnectionStateClosed {
+		t.Fatalf("abandoned connection is %s", got)
+	}
+	if got := opened.ConnectionState(); got == webrtc.PeerConnectionStateClosed {
+		t.Fatalf("opened connection is closed")
+	}
+}
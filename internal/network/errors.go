@@ -4,4 +4,44 @@ import "errors"
 
 var (
 	ErrInvalidMessage = errors.New("invalid message")
+	ErrInvalidPeerID  = errors.New("invalid peer ID")
+
+	ErrInvalidFrame       = errors.New("invalid frame")
+	ErrFrameTruncated     = errors.New("frame truncated")
+	ErrFrameTooLarge      = errors.New("frame too large")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrUnknownSignalType  = errors.New("unknown signal type")
+	ErrPayloadTruncated   = errors.New("payload truncated")
+	ErrFieldTooLarge      = errors.New("payload field too large")
+
+	ErrIncompatiblePeer = errors.New("incompatible peer")
+
+	ErrInvalidTURNConfig = errors.New("invalid TURN server config")
+
+	ErrNoEntryPoint = errors.New("no entry point to join through")
+	ErrBlockedPeer  = errors.New("peer is evicted from the cluster")
+
+	ErrAlreadyConnected = errors.New("peer is already connected")
+	ErrChallengeFailed  = errors.New("peer failed the challenge")
+
+	ErrInvalidInvite = errors.New("invalid invite")
+	ErrInviteExpired = errors.New("invite expired")
+	ErrInviteUsed    = errors.New("invite already used")
+
+	ErrInvalidPolicyRule = errors.New("invalid policy rule")
+	ErrDeniedPeer        = errors.New("peer is denied by policy")
+
+	ErrNoRoute       = errors.New("no route")
+	ErrNotFound      = errors.New("not found")
+	ErrLookupTimeout = errors.New("lookup timed out")
+
+	ErrInvalidChatMessage = errors.New("invalid chat message")
+	ErrUnknownMember      = errors.New("unknown member")
+
+	ErrInvalidRoom   = errors.New("invalid room")
+	ErrUnknownRoom   = errors.New("unknown room")
+	ErrNotRoomMember = errors.New("not a room member")
+
+	ErrInvalidLetter = errors.New("invalid letter")
+	ErrMailboxFull   = errors.New("mailbox is full")
 )
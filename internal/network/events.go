@@ -0,0 +1,90 @@
+package network
+
+import (
+	"time"
+	"udisend/pkg/logger"
+)
+
+type EventType uint8
+
+const (
+	EventPeerConnected EventType = iota
+	EventPeerLost
+	EventReconnecting
+	EventReconnected
+	EventReconnectFailed
+	EventMemberJoined
+	EventMemberSuspected
+	EventMemberFailed
+	EventMemberLeft
+	EventMemberEvicted
+	EventRoomInvited
+	EventRoomJoined
+	EventRoomLeft
+	EventRoomRenamed
+	EventMessageStatus
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPeerConnected:
+		return "PeerConnected"
+	case EventPeerLost:
+		return "PeerLost"
+	case EventReconnecting:
+		return "Reconnecting"
+	case EventReconnected:
+		return "Reconnected"
+	case EventReconnectFailed:
+		return "ReconnectFailed"
+	case EventMemberJoined:
+		return "MemberJoined"
+	case EventMemberSuspected:
+		return "MemberSuspected"
+	case EventMemberFailed:
+		return "MemberFailed"
+	case EventMemberLeft:
+		return "MemberLeft"
+	case EventMemberEvicted:
+		return "MemberEvicted"
+	case EventRoomInvited:
+		return "RoomInvited"
+	case EventRoomJoined:
+		return "RoomJoined"
+	case EventRoomLeft:
+		return "RoomLeft"
+	case EventRoomRenamed:
+		return "RoomRenamed"
+	case EventMessageStatus:
+		return "MessageStatus"
+	}
+	return "Unknown"
+}
+
+type Event struct {
+	Type   EventType
+	PeerID string
+	// Attempt and Delay are set for EventReconnecting.
+	Attempt int
+	Delay   time.Duration
+	// Room is set for room events.
+	Room string
+	// Message and Status are set for EventMessageStatus; PeerID is the
+	// recipient then.
+	Message string
+	Status  MessageStatus
+}
+
+// Events streams connectivity, membership and room changes. Events are dropped when nobody
+// keeps up with reading them.
+func (n *Network) Events() <-chan Event {
+	return n.events
+}
+
+func (i *interactions) emit(e Event) {
+	select {
+	case i.events <- e:
+	default:
+		logger.Debugf(nil, "Event '%s' is dropped <Peer:%s>", e.Type, e.PeerID)
+	}
+}
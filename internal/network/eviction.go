@@ -0,0 +1,225 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"sync"
+	"time"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// evictionVote is a member's report that a candidate misbehaves. Votes
+// are signed by reporters, so nobody can vote on behalf of others, and
+// a candidate is evicted only when enough distinct members agree.
+type evictionVote struct {
+	Candidate string
+	Reporter  string
+	Time      time.Time
+	Signature []byte
+}
+
+type evictions struct {
+	mu sync.Mutex
+	// votes are candidate -> reporter -> vote.
+	votes   map[string]map[string]evictionVote
+	blocked map[string]time.Time
+	quorum  int
+}
+
+func (v evictionVote) signed() []byte {
+	var w payloadWriter
+	w.string(v.Candidate)
+	w.string(v.Reporter)
+	w.uvarint(uint64(v.Time.Unix()))
+	return w.buf
+}
+
+func (v evictionVote) marshal() []byte {
+	w := payloadWriter{buf: v.signed()}
+	w.bytes(v.Signature)
+	return w.buf
+}
+
+func (v *evictionVote) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	v.Candidate = r.id()
+	v.Reporter = r.id()
+	v.Time = time.Unix(int64(r.uvarint(1<<40)), 0)
+	v.Signature = r.bytes(maxSignatureLength)
+	return r.close()
+}
+
+func (v *evictionVote) sign(key *ecdsa.PrivateKey) error {
+	var err error
+	v.Signature, err = signPayload(key, tagVote, v.signed())
+	return err
+}
+
+func (v evictionVote) verify(key *ecdsa.PublicKey) bool {
+	return verifyPayload(key, tagVote, v.signed(), v.Signature)
+}
+
+// reportCandidate votes for eviction of a peer on behalf of the node.
+func reportCandidate(d dispatcher, candidate string) {
+	ctx := span.Init("reportCandidate <Candidate:%s>", candidate)
+
+	v := evictionVote{
+		Candidate: candidate,
+		Reporter:  d.myID(),
+		Time:      time.Now(),
+	}
+	if err := v.sign(d.privateAuthKey()); err != nil {
+		logger.Errorf(ctx, "v.sign: %v", err)
+		return
+	}
+
+	added, evicted := d.addVote(v)
+	if !added {
+		return
+	}
+	// Every member counts votes itself, so each vote has to reach all
+	// of them.
+	d.clusterBroadcast(networkSignal{
+		Type:    SignalTypeDisconnectCandidate,
+		Payload: v.marshal(),
+	})
+	if evicted {
+		d.evict(v.Candidate)
+	}
+	logger.Debugf(ctx, "Reported")
+}
+
+// countVote handles a DisconnectCandidate signal: a vote that someone in
+// the cluster cast and that came by broadcast.
+func countVote(d dispatcher, s incomeSignal) {
+	var v evictionVote
+	if err := v.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "countVote <From:%s>: v.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("countVote <Candidate:%s> <Reporter:%s>", v.Candidate, v.Reporter)
+	if v.Candidate == v.Reporter {
+		logger.Warnf(ctx, "Self-report")
+		return
+	}
+	if v.Candidate == d.myID() {
+		return
+	}
+	if age := time.Since(v.Time); age > evictionVoteTTL || age < -evictionVoteTTL {
+		logger.Debugf(ctx, "Stale vote")
+		return
+	}
+	if !d.canVote(v.Reporter) {
+		logger.Debugf(ctx, "Reporter can't vote")
+		return
+	}
+
+	key := d.memberAuthKey(v.Reporter)
+	if key == nil {
+		// The vote is lost here, but the broadcast goes on to others
+		// who may know the reporter.
+		requestAuthKeys(d, s.From, v.Reporter)
+		return
+	}
+	if !v.verify(key) {
+		logger.Warnf(ctx, "Invalid signature!")
+		return
+	}
+
+	if _, evicted := d.addVote(v); evicted {
+		d.evict(v.Candidate)
+	}
+}
+
+// addVote records a vote and reports whether it was new and whether the
+// candidate has just reached the quorum.
+func (i *interactions) addVote(v evictionVote) (added, evicted bool) {
+	quorum := i.evictionQuorum()
+
+	i.evictions.mu.Lock()
+	defer i.evictions.mu.Unlock()
+
+	if _, ok := i.evictions.blocked[v.Candidate]; ok {
+		return false, false
+	}
+
+	votes, ok := i.evictions.votes[v.Candidate]
+	if !ok {
+		votes = make(map[string]evictionVote)
+		i.evictions.votes[v.Candidate] = votes
+	}
+	for reporter, old := range votes {
+		if time.Since(old.Time) > evictionVoteTTL {
+			delete(votes, reporter)
+		}
+	}
+	if old, ok := votes[v.Reporter]; ok && !v.Time.After(old.Time) {
+		return false, false
+	}
+	votes[v.Reporter] = v
+
+	logger.Debugf(nil, "%d of %d votes against '%s'", len(votes), quorum, v.Candidate)
+	return true, len(votes) >= quorum
+}
+
+// evictionQuorum is the configured number of votes, or a majority of the
+// node and the members that can vote by default. It's never less than
+// two, so that no single member can evict anybody.
+func (i *interactions) evictionQuorum() int {
+	quorum := i.evictions.quorum
+	if quorum <= 0 {
+		var voters int
+		for _, ID := range i.aliveMembers() {
+			if i.canVote(ID) {
+				voters++
+			}
+		}
+		quorum = (voters+1)/2 + 1
+	}
+	return max(quorum, minEvictionQuorum)
+}
+
+// canVote reports whether votes of the member count: it has to be alive
+// and to have passed a challenge of the node, so that a member can't
+// vote again under keys it has made up.
+func (i *interactions) canVote(ID string) bool {
+	return i.isMember(ID) && i.cluster.isChallenged(ID)
+}
+
+func (i *interactions) evict(ID string) {
+	ctx := span.Init("interactions.evict <ID:%s>", ID)
+
+	until := time.Now().Add(evictionBanTTL)
+	i.evictions.mu.Lock()
+	delete(i.evictions.votes, ID)
+	i.evictions.blocked[ID] = until
+	i.evictions.mu.Unlock()
+
+	i.peers.setBlocked(ID, until)
+	i.confirmDead(ID)
+	i.disconnect(ID)
+	i.emit(Event{Type: EventMemberEvicted, PeerID: ID})
+	logger.Warnf(ctx, "Evicted")
+}
+
+func (i *interactions) isBlocked(ID string) bool {
+	i.evictions.mu.Lock()
+	defer i.evictions.mu.Unlock()
+
+	until, ok := i.evictions.blocked[ID]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(i.evictions.blocked, ID)
+		return false
+	}
+	return true
+}
+
+func (i *interactions) block(ID string, until time.Time) {
+	i.evictions.mu.Lock()
+	defer i.evictions.mu.Unlock()
+	i.evictions.blocked[ID] = until
+}
@@ -0,0 +1,49 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCountVoteOnlyFromChallengedMembers(t *testing.T) {
+	n := testNetwork(t)
+	candidate := testNodeID(t)
+
+	vote := func(admitted bool) {
+		t.Helper()
+		key, ID := testKey(t)
+		if admitted {
+			n.presentAuthKey(ID, &key.PublicKey)
+			n.admitMember(ID)
+		} else {
+			// Keys passed around by others, of members that look alive.
+			n.addMembers(memberKeys{{ID: ID, PubKey: &key.PublicKey}})
+			n.memberJoined(ID)
+		}
+
+		v := evictionVote{Candidate: candidate, Reporter: ID, Time: time.Now()}
+		if err := v.sign(key); err != nil {
+			t.Fatalf("v.sign: %v", err)
+		}
+		countVote(&n.interactions, incomeSignal{
+			From:          ID,
+			networkSignal: networkSignal{Type: SignalTypeDisconnectCandidate, Payload: v.marshal()},
+		})
+	}
+
+	vote(true)
+	for range 3 {
+		vote(false)
+	}
+	if n.isBlocked(candidate) {
+		t.Fatalf("evicted by votes of made up members")
+	}
+	if got := len(n.evictions.votes[candidate]); got != 1 {
+		t.Fatalf("%d votes are counted, want 1", got)
+	}
+
+	vote(true)
+	if !n.isBlocked(candidate) {
+		t.Fatalf("not evicted by a quorum of challenged members")
+	}
+}
@@ -1,6 +1,21 @@
 package network
 
-import "time"
+import (
+	"time"
+	"udisend/pkg/logger"
+)
+
+var handshakeSignals = map[signalType]bool{
+	SignalTypeDoVerify:       true,
+	SignalTypePubKeyProvided: true,
+	SignalTypeSolveChallenge: true,
+	SignalTypeTestChallenge:  true,
+}
+
+var livenessSignals = map[signalType]bool{
+	SignalTypePing: true,
+	SignalTypePong: true,
+}
 
 func (i *interaction) muteNotVerifiedFilter(in <-chan incomeSignal) <-chan incomeSignal {
 	out := make(chan incomeSignal)
@@ -12,8 +27,8 @@ func (i *interaction) muteNotVerifiedFilter(in <-chan incomeSignal) <-chan incom
 			state := i.state
 			i.mu.RUnlock()
 
-			if state == NotVerified {
-				return
+			if state == NotVerified && !handshakeSignals[msg.Type] && !livenessSignals[msg.Type] {
+				continue
 			}
 			out <- msg
 		}
@@ -24,6 +39,40 @@ func (i *interaction) muteNotVerifiedFilter(in <-chan incomeSignal) <-chan incom
 
 }
 
+func (i *interaction) unsupportedSignalFilter(in <-chan incomeSignal) <-chan incomeSignal {
+	out := make(chan incomeSignal)
+
+	go func() {
+		defer close(out)
+		for msg := range in {
+			if !i.capabilities.supports(msg.Type) {
+				logger.Warnf(nil, "Drop unnegotiated signal <From:%s> <Type:%s>", msg.From, msg.Type)
+				continue
+			}
+			out <- msg
+		}
+	}()
+
+	return out
+}
+
+func (i *interaction) policyFilter(in <-chan incomeSignal) <-chan incomeSignal {
+	out := make(chan incomeSignal)
+
+	go func() {
+		defer close(out)
+		for msg := range in {
+			if !i.policy.permits(PolicySignal, msg.Type.String()) {
+				logger.Debugf(nil, "Drop denied signal <From:%s> <Type:%s>", msg.From, msg.Type)
+				continue
+			}
+			out <- msg
+		}
+	}()
+
+	return out
+}
+
 func (i *interaction) messagesPerMinuteFilter(in <-chan incomeSignal) <-chan incomeSignal {
 	out := make(chan incomeSignal)
 
@@ -0,0 +1,35 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"udisend/pkg/crypt"
+)
+
+func testKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	ID, err := crypt.NodeID(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("crypt.NodeID: %v", err)
+	}
+	return key, ID
+}
+
+func testNodeID(t *testing.T) string {
+	t.Helper()
+	_, ID := testKey(t)
+	return ID
+}
+
+// testNetwork is a node that isn't running, for tests of its state.
+func testNetwork(t *testing.T) *Network {
+	t.Helper()
+	key, ID := testKey(t)
+	return New(ID, &key.PublicKey, key)
+}
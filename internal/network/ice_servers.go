@@ -0,0 +1,41 @@
+package network
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Servers policy: every side gathers candidates through its own
+// configured servers, so TURN credentials never leave the node. Peers
+// only advertise their STUN URLs in a connection sign, and those are
+// used as a fallback by a node that has no STUN server of its own.
+func (i *interactions) iceServers(remoteStun []string) []webrtc.ICEServer {
+	out := append([]webrtc.ICEServer(nil), i.iceServerList...)
+	if len(i.stunServers()) > 0 || len(remoteStun) == 0 {
+		return out
+	}
+	return append(out, webrtc.ICEServer{URLs: remoteStun})
+}
+
+// stunServers are advertised in connection signs, so they're cut to what
+// a peer accepts: a sign with a longer list or URL is dropped whole.
+func (i *interactions) stunServers() []string {
+	var out []string
+	for _, s := range i.iceServerList {
+		for _, url := range s.URLs {
+			if !isStunURL(url) || len(url) > maxStunServerLength {
+				continue
+			}
+			if len(out) == maxStunServers {
+				return out
+			}
+			out = append(out, url)
+		}
+	}
+	return out
+}
+
+func isStunURL(url string) bool {
+	return strings.HasPrefix(url, "stun:") || strings.HasPrefix(url, "stuns:")
+}
@@ -0,0 +1,62 @@
+package network
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"udisend/pkg/crypt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestStunServersFitSign(t *testing.T) {
+	longURL := "stun:" + strings.Repeat("a", maxStunServerLength) + ":3478"
+	var many []string
+	for k := range maxStunServers + 2 {
+		many = append(many, fmt.Sprintf("stun:stun%d.example.com:3478", k))
+	}
+
+	tests := []struct {
+		name    string
+		servers []webrtc.ICEServer
+		want    []string
+	}{
+		{"none", nil, nil},
+		{"TURN only", []webrtc.ICEServer{{URLs: []string{"turn:example.com:3478"}}}, nil},
+		{"mixed", []webrtc.ICEServer{
+			{URLs: []string{"stun:a.example.com:3478", "turn:a.example.com:3478"}},
+			{URLs: []string{"stuns:b.example.com:5349"}},
+		}, []string{"stun:a.example.com:3478", "stuns:b.example.com:5349"}},
+		{"too long URL", []webrtc.ICEServer{{URLs: []string{longURL, "stun:a.example.com:3478"}}}, []string{"stun:a.example.com:3478"}},
+		{"too many URLs", []webrtc.ICEServer{{URLs: many}}, many[:maxStunServers]},
+	}
+
+	_, pubKey, err := crypt.GenerateRSAKeys()
+	if err != nil {
+		t.Fatalf("crypt.GenerateRSAKeys: %v", err)
+	}
+	ID := testNodeID(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := interactions{iceServerList: tt.servers}
+			got := i.stunServers()
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+
+			b, err := connectionSign{To: ID, From: ID, Sign: "sign", StunServers: got, PubKey: pubKey}.marshal()
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var sign connectionSign
+			if err := sign.unmarshal(b); err != nil {
+				t.Fatalf("peer drops the sign: %v", err)
+			}
+			if !slices.Equal(sign.StunServers, got) {
+				t.Fatalf("peer got %v, want %v", sign.StunServers, got)
+			}
+		})
+	}
+}
@@ -3,23 +3,46 @@ package network
 import (
 	"context"
 	"crypto/ecdsa"
+	"fmt"
+	"net"
 	"sync"
 	"time"
 	"udisend/pkg/logger"
 	"udisend/pkg/span"
+
+	"github.com/pion/webrtc/v4"
 )
 
 type interactions struct {
 	ID             string
+	listenAddr     string
 	interactionsMu sync.RWMutex
 	interactions   map[string]*interaction
 	signUp         func([]byte) []byte
 	cluster        *cluster
 	inbox          chan incomeSignal
+	stopped        <-chan struct{}
 	reactionsMu    sync.Mutex
 	reactions      []*Reaction
-	stnServer      string
+	iceServerList  []webrtc.ICEServer
 	privateAuth    *ecdsa.PrivateKey
+	rtcAPI         *webrtc.API
+	events         chan Event
+	reconnect      reconnector
+	membership     membership
+	peers          *peerStore
+	evictions      evictions
+	invites        invites
+	policy         *policy
+	routing        *routingTable
+	routedSeen     *seenCache
+	broadcastSeen  *seenCache
+	chat           chatFeed
+	rooms          rooms
+	mail           *mailStore
+	chatSeen       *seenCache
+	receipts       receipts
+	conversations  conversations
 }
 
 type Reaction struct {
@@ -30,29 +53,46 @@ type Reaction struct {
 
 type interaction struct {
 	id         string
+	remoteAddr net.Addr
+	// listenAddr is the bootstrap address the peer advertises. It's
+	// stored once the peer passes the challenge.
+	listenAddr string
+	policy     *policy
 	mu         sync.RWMutex
 	state      interactionState
-	decode     func(b []byte) ([]byte, error)
-	encode     func(b []byte) ([]byte, error)
-	disconnect func()
-	send       chan<- networkSignal
+	// challengeUntil is when the node stops answering a challenge of the
+	// peer: one is only expected during a handshake.
+	challengeUntil time.Time
+	capabilities   capabilities
+	liveness       liveness
+	decode         func(b []byte) ([]byte, error)
+	encode         func(b []byte) ([]byte, error)
+	disconnect     func()
+	send           chan<- networkSignal
 }
 
 func (i *interactions) Run(ctx context.Context, countOfWorkers int) {
 	ctx = span.Extend(ctx, "interactions.Run")
 	logger.Debugf(ctx, "Start...")
 	i.inbox = make(chan incomeSignal)
+	// The inbox is never closed: connections keep writing into it until
+	// they notice the stop themselves.
+	i.stopped = ctx.Done()
 
 	go func() {
 		<-ctx.Done()
-		close(i.inbox)
 		logger.Debugf(ctx, "...End")
 	}()
 
 	for range countOfWorkers {
 		go func() {
-			for s := range i.inbox {
-				i.dispatch(s)
+			for {
+				select {
+				case <-i.stopped:
+					return
+				case s := <-i.inbox:
+					i.dispatch(s)
+				}
 			}
 		}()
 	}
@@ -78,6 +118,8 @@ const (
 
 func (i *interaction) applyFilters(in <-chan incomeSignal) <-chan incomeSignal {
 	filters := []func(in <-chan incomeSignal) <-chan incomeSignal{
+		i.unsupportedSignalFilter,
+		i.policyFilter,
 		i.muteNotVerifiedFilter,
 		i.messagesPerMinuteFilter,
 	}
@@ -90,23 +132,6 @@ func (i *interaction) applyFilters(in <-chan incomeSignal) <-chan incomeSignal {
 	return out
 }
 
-func (n *interactions) clusterBroadcast(s networkSignal) {
-	ctx := span.Init("interactions.clusterBroadcast")
-
-	n.interactionsMu.RLock()
-	logger.Debugf(ctx, "Interactions read locked")
-	defer func() {
-		n.interactionsMu.RUnlock()
-		logger.Debugf(ctx, "Interactions read unlocked")
-	}()
-
-	logger.Debugf(ctx, "Iterating...")
-	for _, member := range n.interactions {
-		member.send <- s
-	}
-	logger.Debugf(ctx, "...Iterating completed")
-}
-
 func (i *interactions) disconnect(ID string) {
 	ctx := span.Init("interactions.disconnect <ID:%s>", ID)
 
@@ -139,19 +164,34 @@ func (i *interactions) send(ID string, s networkSignal) {
 
 	i.interactionsMu.RLock()
 	logger.Debugf(ctx, "Interactions read locked")
+
+	logger.Debugf(ctx, "Searching...")
+	m, ok := i.interactions[ID]
+	if !ok {
+		i.interactionsMu.RUnlock()
+		logger.Debugf(ctx, "Not a neighbour, routing")
+		i.route(ID, s)
+		return
+	}
 	defer func() {
 		i.interactionsMu.RUnlock()
 		logger.Debugf(ctx, "Interactions read unlocked")
 	}()
 
-	logger.Debugf(ctx, "Searching...")
-	m, ok := i.interactions[ID]
-	if !ok {
-		logger.Debugf(
-			nil,
-			"Not found",
-			ID,
-		)
+	if !m.capabilities.supports(s.Type) {
+		logger.Warnf(ctx, "Signal isn't supported by peer")
+		return
+	}
+	// The peer may be holding somebody else's ID until it's verified.
+	m.mu.RLock()
+	state := m.state
+	m.mu.RUnlock()
+	if state == NotVerified && !handshakeSignals[s.Type] && !livenessSignals[s.Type] {
+		logger.Warnf(ctx, "Peer isn't verified")
+		return
+	}
+	if len(s.Payload) > m.capabilities.maxFrameSize {
+		logger.Warnf(ctx, "Payload exceeds peer's frame size (%d > %d)", len(s.Payload), m.capabilities.maxFrameSize)
 		return
 	}
 
@@ -168,17 +208,45 @@ func (i *interactions) send(ID string, s networkSignal) {
 	}
 }
 
+// addConnection starts interacting over a connection. An ID that already
+// has an interaction is refused: the one in place may be verified, and a
+// newcomer claiming the ID mustn't take it over. A peer that has really
+// reconnected comes back once the stale interaction is dropped.
 func (i *interactions) addConnection(
 	ctx context.Context,
 	conn connection,
+	caps capabilities,
 	disconnect func(),
-) {
+) error {
 	ctx = span.Extend(ctx, "interactions.addConnection <ID:%s>", conn.ID())
-	out := make(chan networkSignal)
+	out := make(chan networkSignal, sendBufferSize)
+	newI := interaction{
+		id:           conn.ID(),
+		capabilities: caps,
+		policy:       i.policy,
+		send:         out,
+		disconnect:   disconnect,
+		// The peer challenges the node as soon as it's connected.
+		challengeUntil: time.Now().Add(handshakeTimeout),
+	}
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		newI.remoteAddr = c.RemoteAddr()
+	}
+	if c, ok := conn.(interface{ ListenAddr() string }); ok {
+		newI.listenAddr = c.ListenAddr()
+	}
+
+	i.interactionsMu.Lock()
+	if _, ok := i.interactions[conn.ID()]; ok {
+		i.interactionsMu.Unlock()
+		return fmt.Errorf("%w: '%s'", ErrAlreadyConnected, conn.ID())
+	}
+	i.interactions[conn.ID()] = &newI
+	i.interactionsMu.Unlock()
+
 	go func() {
 		<-ctx.Done()
 		logger.Debugf(ctx, "Context closed!")
-		close(out)
 
 		i.interactionsMu.Lock()
 		logger.Debugf(ctx, "Interactions locked")
@@ -187,26 +255,61 @@ func (i *interactions) addConnection(
 			logger.Debugf(ctx, "Interactions unlocked")
 		}()
 
+		// Senders hold the read lock, so nobody writes to a closed channel.
+		close(out)
+
+		// The interaction may have been removed by disconnect already,
+		// and the peer may have reconnected meanwhile.
+		if i.interactions[conn.ID()] != &newI {
+			return
+		}
 		delete(i.interactions, conn.ID())
+		i.routing.forget(conn.ID())
+
+		newI.mu.RLock()
+		state := newI.state
+		newI.mu.RUnlock()
+		if state == Connected {
+			i.markLost(conn.ID())
+			i.emit(Event{Type: EventPeerLost, PeerID: conn.ID()})
+		}
+		if state != NotVerified {
+			// Other neighbours of the peer may still reach it, so it's
+			// only suspected until gossip says otherwise.
+			i.suspect(conn.ID())
+		}
 	}()
 
-	newI := interaction{
-		send:       out,
-		disconnect: disconnect,
-	}
-
-	i.interactionsMu.Lock()
-	i.interactions[conn.ID()] = &newI
-	i.interactionsMu.Unlock()
-
 	connInbox := conn.Interact(ctx, out)
+	go i.heartbeat(ctx, &newI)
+
+	// A peer that doesn't pass the challenge in time is dropped: the
+	// heartbeat would keep it around for good otherwise.
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(handshakeTimeout):
+			newI.mu.RLock()
+			state := newI.state
+			newI.mu.RUnlock()
+			if state == NotVerified {
+				logger.Warnf(ctx, "Not verified in time")
+				disconnect()
+			}
+		}
+	}()
 
 	go func() {
 		defer disconnect()
 		for in := range newI.applyFilters(connInbox) {
-			i.inbox <- in
+			select {
+			case i.inbox <- in:
+			case <-i.stopped:
+				return
+			}
 		}
 	}()
+	return nil
 }
 
 func (n *interactions) getInteraction(ID string) (*interaction, bool) {
@@ -223,8 +326,8 @@ func (n *interactions) getInteraction(ID string) (*interaction, bool) {
 	return memb, ok
 }
 
-func (i *interactions) rangeInteractions(fn func(memb *interaction)) {
-	ctx := span.Init("interactions.rangeInteractions")
+func (i *interactions) rangeInteraction(fn func(memb *interaction)) {
+	ctx := span.Init("interactions.rangeInteraction")
 
 	i.interactionsMu.RLock()
 	logger.Debugf(ctx, "Interactions read locked")
@@ -240,6 +343,17 @@ func (i *interactions) rangeInteractions(fn func(memb *interaction)) {
 	logger.Debugf(ctx, "...End")
 }
 
+func (i *interactions) interactionIDs() []string {
+	i.interactionsMu.RLock()
+	defer i.interactionsMu.RUnlock()
+
+	IDs := make([]string, 0, len(i.interactions))
+	for ID := range i.interactions {
+		IDs = append(IDs, ID)
+	}
+	return IDs
+}
+
 func (i *interactions) compareAndSwapInteractionState(ID string, old, new interactionState) {
 	ctx := span.Init("interactions.compareAndSwapInteractionState <ID:%s>", ID)
 
@@ -271,15 +385,58 @@ func (i *interactions) compareAndSwapInteractionState(ID string, old, new intera
 
 	memb.state = new
 	logger.Debugf(ctx, "State changed")
+
+	if new == Connected {
+		i.emit(Event{Type: EventPeerConnected, PeerID: ID})
+		i.markFound(ID)
+	}
+}
+
+// expectChallenge lets the peer challenge the node once more, when the
+// node has asked to be verified.
+func (i *interactions) expectChallenge(ID string) {
+	memb, ok := i.getInteraction(ID)
+	if !ok {
+		return
+	}
+	memb.mu.Lock()
+	defer memb.mu.Unlock()
+	memb.challengeUntil = time.Now().Add(handshakeTimeout)
+}
+
+// answerChallenge reports whether a challenge of the peer is expected,
+// and takes the expectation back.
+func (i *interactions) answerChallenge(ID string) bool {
+	memb, ok := i.getInteraction(ID)
+	if !ok {
+		return false
+	}
+	memb.mu.Lock()
+	defer memb.mu.Unlock()
+	if time.Now().After(memb.challengeUntil) {
+		return false
+	}
+	memb.challengeUntil = time.Time{}
+	return true
 }
 
+// clusterSize is the number of other members believed to be alive.
 func (i *interactions) clusterSize() int {
-	return len(i.cluster.members)
+	i.membership.mu.Lock()
+	defer i.membership.mu.Unlock()
+
+	var size int
+	for _, state := range i.membership.states {
+		if !state.status.gone() {
+			size++
+		}
+	}
+	return size
 }
 
 func (i *interactions) memberAuthKey(ID string) *ecdsa.PublicKey {
 	ctx := span.Init("interactions.memberAuthKey <ID:%s>", ID)
-	i.cluster.mu.RLocker()
+	i.cluster.mu.RLock()
 	defer i.cluster.mu.RUnlock()
 	logger.Debugf(ctx, "Searching...")
 	pubKey, ok := i.cluster.members[ID]
@@ -295,8 +452,16 @@ func (i *interactions) myID() string {
 	return i.ID
 }
 
-func (i *interactions) stunServer() string {
-	return i.stnServer
+func (i *interactions) listenAddress() string {
+	return i.listenAddr
+}
+
+func (i *interactions) knownPeers() *peerStore {
+	return i.peers
+}
+
+func (i *interactions) newPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	return i.rtcAPI.NewPeerConnection(config)
 }
 
 func (i *interactions) addReaction(timeout time.Duration, fn func(s incomeSignal) bool) {
@@ -309,25 +474,25 @@ func (i *interactions) addReaction(timeout time.Duration, fn func(s incomeSignal
 		logger.Debugf(ctx, "Reactions unlocked")
 	}()
 
-	for idx := range i.reactions {
-		if !i.reactions[idx].done {
-			continue
+	// Finished reactions are dropped rather than re-used: their timers
+	// are still running and would finish a new reaction too early. A
+	// reaction that is busy right now is alive by definition.
+	alive := i.reactions[:0]
+	for _, r := range i.reactions {
+		if r.mu.TryLock() {
+			done := r.done
+			r.mu.Unlock()
+			if done {
+				continue
+			}
 		}
-		logger.Debugf(ctx, "Re-use old reaction")
-		i.reactions[idx].fn = fn
-		i.reactions[idx].done = false
-		go func() {
-			<-time.After(timeout)
-			i.reactions[idx].mu.Lock()
-			defer i.reactions[idx].mu.Unlock()
-			i.reactions[idx].done = true
-		}()
-		return
+		alive = append(alive, r)
 	}
+	clear(i.reactions[len(alive):])
 
 	logger.Debugf(ctx, "Append reactions")
 	react := &Reaction{fn: fn}
-	i.reactions = append(i.reactions, react)
+	i.reactions = append(alive, react)
 
 	go func() {
 		<-time.After(timeout)
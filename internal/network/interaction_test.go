@@ -0,0 +1,57 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// silentConnection never says anything, as a peer squatting an ID does.
+type silentConnection struct {
+	id  string
+	out <-chan networkSignal
+}
+
+func (c *silentConnection) ID() string {
+	return c.id
+}
+
+func (c *silentConnection) Interact(_ context.Context, out <-chan networkSignal) <-chan incomeSignal {
+	c.out = out
+	return make(chan incomeSignal)
+}
+
+func TestNotVerifiedPeer(t *testing.T) {
+	timeout := handshakeTimeout
+	handshakeTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { handshakeTimeout = timeout })
+
+	n := testNetwork(t)
+	caps, err := negotiate(localHello(n.ID, ""), localHello(n.ID, ""))
+	if err != nil {
+		t.Fatalf("negotiate: %v", err)
+	}
+	conn := &silentConnection{id: testNodeID(t)}
+	ctx, disconnect := context.WithCancel(context.Background())
+	defer disconnect()
+	if err := n.addConnection(ctx, conn, caps, disconnect); err != nil {
+		t.Fatalf("n.addConnection: %v", err)
+	}
+
+	n.send(conn.id, networkSignal{Type: SignalTypeChat, Payload: []byte("chat")})
+	n.send(conn.id, networkSignal{Type: SignalTypeSolveChallenge, Payload: []byte("challenge")})
+	if s := <-conn.out; s.Type != SignalTypeSolveChallenge {
+		t.Fatalf("%s is sent to a peer that isn't verified", s.Type)
+	}
+
+	deadline := time.Now().Add(5 * handshakeTimeout)
+	for {
+		if _, ok := n.getInteraction(conn.id); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peer isn't dropped after the handshake timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,174 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+	"udisend/pkg/crypt"
+)
+
+// invite admits a newcomer to an invite-only cluster. It's signed by a
+// member, so any member who knows the inviter's key can check it. A
+// single-use invite is redeemed only by the inviter itself, since nobody
+// else knows whether it has been used already.
+type invite struct {
+	EntryPoint  string
+	Inviter     string
+	Fingerprint string
+	Expires     time.Time
+	Nonce       []byte
+	SingleUse   bool
+	Signature   []byte
+}
+
+type invites struct {
+	mu         sync.Mutex
+	inviteOnly bool
+	// used are nonces of redeemed single-use invites until they expire.
+	used map[string]time.Time
+}
+
+// MintInvite issues an invite token to join the cluster through
+// entryPoint on behalf of the key owner.
+func MintInvite(
+	privateAuth *ecdsa.PrivateKey,
+	entryPoint string,
+	ttl time.Duration,
+	singleUse bool,
+) (string, error) {
+	ID, err := crypt.NodeID(&privateAuth.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("crypt.NodeID: %w", err)
+	}
+	fingerprint, err := crypt.Fingerprint(&privateAuth.PublicKey)
+	if err != nil {
+		return "", fmt.Errorf("crypt.Fingerprint: %w", err)
+	}
+
+	inv := invite{
+		EntryPoint:  entryPoint,
+		Inviter:     ID,
+		Fingerprint: fingerprint,
+		Expires:     time.Now().Add(ttl),
+		Nonce:       []byte(rand.Text()),
+		SingleUse:   singleUse,
+	}
+	if inv.Signature, err = signPayload(privateAuth, tagInvite, inv.signed()); err != nil {
+		return "", fmt.Errorf("signPayload: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(inv.marshal()), nil
+}
+
+func parseInvite(token string) (invite, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return invite{}, fmt.Errorf("%w: %v", ErrInvalidInvite, err)
+	}
+	var inv invite
+	if err := inv.unmarshal(b); err != nil {
+		return invite{}, fmt.Errorf("%w: %v", ErrInvalidInvite, err)
+	}
+	return inv, nil
+}
+
+func (inv invite) signed() []byte {
+	var w payloadWriter
+	w.string(inv.EntryPoint)
+	w.string(inv.Inviter)
+	w.string(inv.Fingerprint)
+	w.uvarint(uint64(inv.Expires.Unix()))
+	w.bytes(inv.Nonce)
+	if inv.SingleUse {
+		w.uvarint(1)
+	} else {
+		w.uvarint(0)
+	}
+	return w.buf
+}
+
+func (inv invite) marshal() []byte {
+	w := payloadWriter{buf: inv.signed()}
+	w.bytes(inv.Signature)
+	return w.buf
+}
+
+func (inv *invite) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	inv.EntryPoint = r.string(maxAddrLength)
+	inv.Inviter = r.id()
+	inv.Fingerprint = r.string(maxFingerprintLength)
+	inv.Expires = time.Unix(int64(r.uvarint(1<<40)), 0)
+	inv.Nonce = r.bytes(maxNonceLength)
+	inv.SingleUse = r.uvarint(1) == 1
+	inv.Signature = r.bytes(maxSignatureLength)
+	return r.close()
+}
+
+// checkInvite decides whether a peer may pass verification. Known members
+// don't need an invite to come back.
+func (i *interactions) checkInvite(ID string, payload []byte) (invite, error) {
+	if !i.invites.inviteOnly || i.memberAuthKey(ID) != nil {
+		return invite{}, nil
+	}
+	if len(payload) == 0 {
+		return invite{}, fmt.Errorf("%w: no invite", ErrInvalidInvite)
+	}
+
+	var inv invite
+	if err := inv.unmarshal(payload); err != nil {
+		return invite{}, fmt.Errorf("%w: %v", ErrInvalidInvite, err)
+	}
+	if time.Now().After(inv.Expires) {
+		return invite{}, ErrInviteExpired
+	}
+
+	key := i.memberAuthKey(inv.Inviter)
+	if key == nil {
+		return invite{}, fmt.Errorf("%w: unknown inviter '%s'", ErrInvalidInvite, inv.Inviter)
+	}
+	if fingerprint, err := crypt.Fingerprint(key); err != nil || fingerprint != inv.Fingerprint {
+		return invite{}, fmt.Errorf("%w: fingerprint mismatch", ErrInvalidInvite)
+	}
+	if !verifyPayload(key, tagInvite, inv.signed(), inv.Signature) {
+		return invite{}, fmt.Errorf("%w: bad signature", ErrInvalidInvite)
+	}
+
+	if inv.SingleUse {
+		if inv.Inviter != i.ID {
+			return invite{}, fmt.Errorf("%w: single-use invite is redeemed by the inviter only", ErrInvalidInvite)
+		}
+		i.invites.mu.Lock()
+		_, used := i.invites.used[string(inv.Nonce)]
+		i.invites.mu.Unlock()
+		if used {
+			return invite{}, ErrInviteUsed
+		}
+	}
+
+	return inv, nil
+}
+
+// redeemInvite spends a single-use invite once its holder is verified.
+func (i *interactions) redeemInvite(inv invite) error {
+	if !inv.SingleUse {
+		return nil
+	}
+
+	i.invites.mu.Lock()
+	defer i.invites.mu.Unlock()
+
+	for nonce, expires := range i.invites.used {
+		if time.Now().After(expires) {
+			delete(i.invites.used, nonce)
+		}
+	}
+	if _, ok := i.invites.used[string(inv.Nonce)]; ok {
+		return ErrInviteUsed
+	}
+	i.invites.used[string(inv.Nonce)] = inv.Expires
+	return nil
+}
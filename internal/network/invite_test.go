@@ -0,0 +1,46 @@
+package network
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+	"udisend/pkg/crypt"
+)
+
+func TestCheckInviteSignature(t *testing.T) {
+	key, ID := testKey(t)
+	n := New(ID, &key.PublicKey, key, WithInviteOnly(true))
+	newcomer := testNodeID(t)
+
+	token, err := MintInvite(key, "10.0.0.1:7000", time.Hour, false)
+	if err != nil {
+		t.Fatalf("MintInvite: %v", err)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatalf("DecodeString: %v", err)
+	}
+	if _, err := n.checkInvite(newcomer, b); err != nil {
+		t.Fatalf("n.checkInvite: %v", err)
+	}
+
+	// A member made to solve the invite as a challenge.
+	fingerprint, err := crypt.Fingerprint(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("crypt.Fingerprint: %v", err)
+	}
+	inv := invite{
+		EntryPoint:  "10.0.0.1:7000",
+		Inviter:     ID,
+		Fingerprint: fingerprint,
+		Expires:     time.Now().Add(time.Hour),
+		Nonce:       []byte("nonce"),
+	}
+	if inv.Signature, err = signPayload(key, tagChallenge, inv.signed()); err != nil {
+		t.Fatalf("signPayload: %v", err)
+	}
+	if _, err := n.checkInvite(newcomer, inv.marshal()); !errors.Is(err, ErrInvalidInvite) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidInvite)
+	}
+}
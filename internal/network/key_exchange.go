@@ -0,0 +1,148 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// provideAuthKeys answers a request for keys of members the requester
+// hasn't met. An empty request asks for every known key.
+func provideAuthKeys(d dispatcher, s incomeSignal) {
+	ctx := span.Init("provideAuthKeys <From:%s>", s.From)
+	logger.Debugf(ctx, "Start...")
+
+	r := payloadReader{buf: s.Payload}
+	IDs := r.strings(maxMemberKeys, idLength)
+	if err := r.close(); err != nil {
+		logger.Warnf(ctx, "Invalid payload: %v", err)
+		return
+	}
+
+	keys := d.authKeys(IDs)
+	if len(keys) == 0 {
+		logger.Debugf(ctx, "Nothing to provide")
+		return
+	}
+	sendAuthKeys(d, s.From, keys)
+
+	logger.Debugf(ctx, "...End")
+}
+
+// acceptAuthKeys records keys sent by a peer. A not verified peer may only
+// present its own key, which is admitted once the challenge is solved.
+// Keys from verified peers are trusted and spread further.
+func acceptAuthKeys(d dispatcher, s incomeSignal) {
+	ctx := span.Init("acceptAuthKeys <From:%s>", s.From)
+	logger.Debugf(ctx, "Start...")
+
+	var keys memberKeys
+	if err := keys.unmarshal(s.Payload); err != nil {
+		logger.Warnf(ctx, "keys.unmarshal: %v", err)
+		return
+	}
+
+	memb, ok := d.getInteraction(s.From)
+	if !ok {
+		return
+	}
+	memb.mu.RLock()
+	state := memb.state
+	memb.mu.RUnlock()
+
+	if state == NotVerified {
+		if len(keys) != 1 || keys[0].ID != s.From {
+			logger.Warnf(ctx, "Not verified peer presents foreign keys!")
+			return
+		}
+		d.presentAuthKey(s.From, keys[0].PubKey)
+		logger.Debugf(ctx, "Key is presented")
+		return
+	}
+
+	added := d.addMembers(keys)
+	logger.Debugf(ctx, "%d of %d keys are new", len(added), len(keys))
+	if len(added) > 0 {
+		shareAuthKeys(d, added, s.From)
+	}
+
+	logger.Debugf(ctx, "...End")
+}
+
+// shareAuthKeys passes keys to every connected neighbour but the one they
+// came from. Members forward only keys that are new to them, so spreading
+// stops once everybody knows.
+func shareAuthKeys(d dispatcher, keys memberKeys, except string) {
+	var neighbours []string
+	d.rangeInteraction(func(memb *interaction) {
+		memb.mu.RLock()
+		defer memb.mu.RUnlock()
+		if memb.state == Connected && memb.id != except {
+			neighbours = append(neighbours, memb.id)
+		}
+	})
+
+	for _, ID := range neighbours {
+		sendAuthKeys(d, ID, keys)
+	}
+}
+
+func sendAuthKeys(d dispatcher, to string, keys memberKeys) {
+	for len(keys) > 0 {
+		chunk := keys[:min(len(keys), maxMemberKeys)]
+		keys = keys[len(chunk):]
+
+		payload, err := chunk.marshal()
+		if err != nil {
+			logger.Errorf(nil, "sendAuthKeys <To:%s>: chunk.marshal: %v", to, err)
+			return
+		}
+		d.send(to, networkSignal{
+			Type:    SignalTypePubKeyProvided,
+			Payload: payload,
+		})
+	}
+}
+
+// requestAuthKeys asks a verified peer for keys of members that are
+// unknown locally.
+func requestAuthKeys(d dispatcher, from string, IDs ...string) {
+	var w payloadWriter
+	w.strings(IDs)
+	d.send(from, networkSignal{
+		Type:    SignalTypeProvidePubKey,
+		Payload: w.buf,
+	})
+}
+
+func (i *interactions) presentAuthKey(ID string, key *ecdsa.PublicKey) {
+	i.cluster.present(ID, key)
+}
+
+func (i *interactions) candidateAuthKey(ID string) *ecdsa.PublicKey {
+	return i.cluster.candidateKey(ID)
+}
+
+func (i *interactions) admitMember(ID string) (memberKey, bool) {
+	key, ok := i.cluster.admit(ID)
+	if ok {
+		i.peers.setKey(ID, key.PubKey)
+	}
+	// The member has just proven itself, whether its key is new or not.
+	i.memberJoined(ID)
+	return key, ok
+}
+
+func (i *interactions) addMembers(keys memberKeys) memberKeys {
+	added := i.cluster.add(keys)
+	// A known key says nothing about its owner being alive: membership
+	// comes from gossip.
+	for _, k := range added {
+		i.peers.setKey(k.ID, k.PubKey)
+	}
+	return added
+}
+
+func (i *interactions) authKeys(IDs []string) memberKeys {
+	return i.cluster.keys(IDs)
+}
@@ -0,0 +1,178 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// liveness keeps heartbeat bookkeeping of a single interaction. RTT is
+// smoothed the same way TCP does it (RFC 6298).
+type liveness struct {
+	mu      sync.Mutex
+	pending map[uint64]time.Time
+	missed  int
+	srtt    time.Duration
+	rttvar  time.Duration
+	sampled bool
+}
+
+func (l *liveness) ping() (nonce uint64, missed int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending == nil {
+		l.pending = make(map[uint64]time.Time)
+	}
+	if len(l.pending) > 0 {
+		l.missed++
+	}
+	if len(l.pending) >= maxMissedPongs {
+		clear(l.pending)
+	}
+
+	nonce = rand.Uint64()
+	l.pending[nonce] = time.Now()
+	return nonce, l.missed
+}
+
+func (l *liveness) pong(nonce uint64) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sent, ok := l.pending[nonce]
+	if !ok {
+		return 0, false
+	}
+	delete(l.pending, nonce)
+	l.missed = 0
+
+	sample := time.Since(sent)
+	if !l.sampled {
+		l.srtt = sample
+		l.rttvar = sample / 2
+		l.sampled = true
+		return sample, true
+	}
+
+	diff := l.srtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	l.rttvar = (3*l.rttvar + diff) / 4
+	l.srtt = (7*l.srtt + sample) / 8
+	return sample, true
+}
+
+func (l *liveness) rtt() (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.srtt, l.sampled
+}
+
+// rto is a retransmission timeout: how long a reply may reasonably take.
+func (l *liveness) rto() (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.srtt + 4*l.rttvar, l.sampled
+}
+
+func (i *interactions) heartbeat(ctx context.Context, memb *interaction) {
+	if !memb.capabilities.supports(SignalTypePing) {
+		return
+	}
+
+	ctx = span.Extend(ctx, "interactions.heartbeat")
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		nonce, missed := memb.liveness.ping()
+		if missed >= maxMissedPongs {
+			logger.Warnf(ctx, "%d pongs are missed", missed)
+			i.disconnect(memb.id)
+			return
+		}
+
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, nonce)
+		i.send(memb.id, networkSignal{
+			Type:    SignalTypePing,
+			Payload: payload,
+		})
+	}
+}
+
+func answerPing(d dispatcher, s incomeSignal) {
+	d.send(s.From, networkSignal{
+		Type:    SignalTypePong,
+		Payload: s.Payload,
+	})
+}
+
+func handlePong(d dispatcher, s incomeSignal) {
+	ctx := span.Init("handlePong <From:%s>", s.From)
+	if len(s.Payload) != 8 {
+		logger.Warnf(ctx, "Invalid payload")
+		return
+	}
+
+	memb, ok := d.getInteraction(s.From)
+	if !ok {
+		return
+	}
+
+	sample, ok := memb.liveness.pong(binary.BigEndian.Uint64(s.Payload))
+	if !ok {
+		logger.Debugf(ctx, "Unexpected pong")
+		return
+	}
+	logger.Debugf(ctx, "RTT sample %s", sample)
+}
+
+// RTT returns a smoothed round-trip time to a direct neighbour.
+func (n *Network) RTT(ID string) (time.Duration, bool) {
+	memb, ok := n.getInteraction(ID)
+	if !ok {
+		return 0, false
+	}
+	return memb.liveness.rtt()
+}
+
+// timeout scales a wait for a reply that travels the given number of
+// round trips through the peers. Fallback is used as long as nothing
+// is measured yet, and caps the result otherwise. Without peers the
+// slowest connected neighbour is taken.
+func (i *interactions) timeout(rounds int, fallback time.Duration, peers ...string) time.Duration {
+	var (
+		worst   time.Duration
+		sampled bool
+	)
+	i.rangeInteraction(func(memb *interaction) {
+		if len(peers) > 0 && !slices.Contains(peers, memb.id) {
+			return
+		}
+		rto, ok := memb.liveness.rto()
+		if !ok {
+			return
+		}
+		sampled = true
+		worst = max(worst, rto)
+	})
+	if !sampled {
+		return fallback
+	}
+
+	return min(fallback, max(minSignalTimeout, time.Duration(rounds)*worst+processingAllowance))
+}
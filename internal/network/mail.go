@@ -0,0 +1,558 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+	"udisend/pkg/crypt"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// Messages for members that are offline are sealed for the recipient and
+// signed by the author. The author keeps them in its outbox and deposits
+// copies with mailbox peers, the members closest to the recipient by ID,
+// so that the recipient gets them even if the author is gone by then.
+
+type letter struct {
+	ID      string
+	Author  string
+	To      string
+	Expires time.Time
+	// Sealed is the message encrypted for the recipient.
+	Sealed    []byte
+	Signature []byte
+}
+
+func (l letter) signed() []byte {
+	var w payloadWriter
+	w.string(l.ID)
+	w.string(l.Author)
+	w.string(l.To)
+	w.uvarint(uint64(l.Expires.UnixMilli()))
+	w.bytes(l.Sealed)
+	return w.buf
+}
+
+func (l letter) marshal() []byte {
+	w := payloadWriter{buf: l.signed()}
+	w.bytes(l.Signature)
+	return w.buf
+}
+
+func (l *letter) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	l.ID = r.string(maxMessageIDLength)
+	l.Author = r.id()
+	l.To = r.id()
+	l.Expires = time.UnixMilli(int64(r.uvarint(1<<63 - 1)))
+	l.Sealed = r.bytes(maxSealedLength)
+	l.Signature = r.bytes(maxSignatureLength)
+	return r.close()
+}
+
+// additional binds the sealed message to its envelope, so it can't be
+// passed off as a letter to somebody else.
+func (l letter) additional() []byte {
+	var w payloadWriter
+	w.string(l.ID)
+	w.string(l.Author)
+	w.string(l.To)
+	return w.buf
+}
+
+func (l letter) size() int {
+	return len(l.Sealed)
+}
+
+// mailStore holds letters of the node for offline members in the outbox,
+// and letters of others in the mailbox. It survives restarts when it has
+// a file.
+type mailStore struct {
+	mu   sync.Mutex
+	path string
+	// outbox is keyed by recipient as well, since a room message makes a
+	// letter for every member that is offline.
+	outbox  map[letterKey]letter
+	mailbox map[string]map[string]letter
+	// authors counts held letters by author, so that nobody fills the
+	// mailbox up alone.
+	authors     map[string]int
+	heldLetters int
+	heldBytes   int
+	dirty       bool
+}
+
+type letterKey struct {
+	ID string
+	To string
+}
+
+type mailRecord struct {
+	Outbox bool   `json:"outbox,omitempty"`
+	Letter []byte `json:"letter"`
+}
+
+func newMailStore(path string) *mailStore {
+	return &mailStore{
+		path:    path,
+		outbox:  make(map[letterKey]letter),
+		mailbox: make(map[string]map[string]letter),
+		authors: make(map[string]int),
+	}
+}
+
+func (s *mailStore) load() error {
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records []mailRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	for _, r := range records {
+		var l letter
+		if err := l.unmarshal(r.Letter); err != nil {
+			continue
+		}
+		if r.Outbox {
+			s.post(l)
+		} else {
+			s.hold(l)
+		}
+	}
+	s.mu.Lock()
+	s.dirty = false
+	s.mu.Unlock()
+	return nil
+}
+
+// save writes the store through a temporary file, as the peer store does.
+func (s *mailStore) save() error {
+	s.mu.Lock()
+	if s.path == "" || !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	var records []mailRecord
+	for _, l := range s.outbox {
+		records = append(records, mailRecord{Outbox: true, Letter: l.marshal()})
+	}
+	for _, letters := range s.mailbox {
+		for _, l := range letters {
+			records = append(records, mailRecord{Letter: l.marshal()})
+		}
+	}
+	b, err := json.Marshal(records)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// post puts a letter of the node into the outbox.
+func (s *mailStore) post(l letter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.outbox[letterKey{ID: l.ID, To: l.To}] = l
+	s.dirty = true
+}
+
+// hold keeps a letter for its recipient within the quotas. When the
+// mailbox as a whole is full, the oldest letters make room.
+func (s *mailStore) hold(l letter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters, ok := s.mailbox[l.To]
+	if !ok && len(s.mailbox) >= maxMailboxRecipients {
+		return fmt.Errorf("%w: too many recipients", ErrMailboxFull)
+	}
+	if _, ok := letters[l.ID]; ok {
+		return nil
+	}
+
+	size := l.size()
+	for _, held := range letters {
+		size += held.size()
+	}
+	if len(letters) >= maxMailboxLetters || size > maxMailboxBytes {
+		return fmt.Errorf("%w: quota of '%s' is exhausted", ErrMailboxFull, l.To)
+	}
+	if s.authors[l.Author] >= maxMailboxAuthorLetters {
+		return fmt.Errorf("%w: quota of author '%s' is exhausted", ErrMailboxFull, l.Author)
+	}
+
+	for s.heldLetters >= maxHeldLetters || s.heldBytes+l.size() > maxHeldBytes {
+		s.release(s.oldest())
+	}
+	if letters, ok = s.mailbox[l.To]; !ok {
+		letters = make(map[string]letter)
+		s.mailbox[l.To] = letters
+	}
+	letters[l.ID] = l
+	s.authors[l.Author]++
+	s.heldLetters++
+	s.heldBytes += l.size()
+	s.dirty = true
+	return nil
+}
+
+// oldest is the held letter that expires first, which is the one held
+// for the longest. Must be called with the lock held.
+func (s *mailStore) oldest() letter {
+	var out letter
+	for _, letters := range s.mailbox {
+		for _, l := range letters {
+			if out.ID == "" || l.Expires.Before(out.Expires) {
+				out = l
+			}
+		}
+	}
+	return out
+}
+
+// drop forgets a letter the recipient has got, whether it's the node's
+// own or held for somebody else.
+func (s *mailStore) drop(ID, to string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := letterKey{ID: ID, To: to}
+	if _, ok := s.outbox[key]; ok {
+		delete(s.outbox, key)
+		s.dirty = true
+	}
+	if l, ok := s.mailbox[to][ID]; ok {
+		s.release(l)
+	}
+}
+
+// release forgets a held letter. Must be called with the lock held.
+func (s *mailStore) release(l letter) {
+	letters := s.mailbox[l.To]
+	delete(letters, l.ID)
+	if len(letters) == 0 {
+		delete(s.mailbox, l.To)
+	}
+	if s.authors[l.Author]--; s.authors[l.Author] <= 0 {
+		delete(s.authors, l.Author)
+	}
+	s.heldLetters--
+	s.heldBytes -= l.size()
+	s.dirty = true
+}
+
+// letters returns letters for the recipient, both the node's own and
+// held for others. They are kept until the recipient acknowledges them.
+func (s *mailStore) letters(to string) []letter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []letter
+	for key, l := range s.outbox {
+		if key.To == to {
+			out = append(out, l)
+		}
+	}
+	for _, l := range s.mailbox[to] {
+		out = append(out, l)
+	}
+	return out
+}
+
+// recipients lists everybody there are letters for.
+func (s *mailStore) recipients() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []string
+	for _, l := range s.outbox {
+		out = append(out, l.To)
+	}
+	for to := range s.mailbox {
+		out = append(out, to)
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+func (s *mailStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, l := range s.outbox {
+		if now.After(l.Expires) {
+			delete(s.outbox, key)
+			s.dirty = true
+		}
+	}
+	for _, letters := range s.mailbox {
+		for _, l := range letters {
+			if now.After(l.Expires) {
+				s.release(l)
+			}
+		}
+	}
+}
+
+// sendChat delivers a message to a member directly when it's online, or
+// leaves a letter for it otherwise.
+func (i *interactions) sendChat(to string, m ChatMessage) {
+	if i.isMember(to) {
+		i.receipts.track(m, to, StatusSent)
+		i.send(to, networkSignal{Type: SignalTypeChat, Payload: m.marshal()})
+		return
+	}
+	if err := i.postLetter(to, m); err != nil {
+		logger.Warnf(nil, "interactions.sendChat <To:%s>: i.postLetter: %v", to, err)
+		i.receipts.track(m, to, StatusFailed)
+		return
+	}
+	i.receipts.track(m, to, StatusPending)
+}
+
+func (i *interactions) postLetter(to string, m ChatMessage) error {
+	ctx := span.Init("interactions.postLetter <To:%s> <ID:%s>", to, m.ID)
+
+	key := i.memberAuthKey(to)
+	if key == nil {
+		return fmt.Errorf("%w: no key of '%s'", ErrUnknownMember, to)
+	}
+
+	l := letter{
+		ID:      m.ID,
+		Author:  i.ID,
+		To:      to,
+		Expires: time.Now().Add(mailTTL),
+	}
+	var err error
+	if l.Sealed, err = crypt.Seal(key, m.marshal(), l.additional()); err != nil {
+		return fmt.Errorf("crypt.Seal: %w", err)
+	}
+	if l.Signature, err = signPayload(i.privateAuth, tagLetter, l.signed()); err != nil {
+		return fmt.Errorf("signPayload: %w", err)
+	}
+
+	i.mail.post(l)
+	payload := l.marshal()
+	for _, ID := range i.mailboxes(to) {
+		i.send(ID, networkSignal{Type: SignalTypeDeposit, Payload: payload})
+		logger.Debugf(ctx, "Deposited with '%s'", ID)
+	}
+	return nil
+}
+
+// mailboxes are the members online closest to the recipient by ID. The
+// node itself isn't one of them, as it keeps the letter in the outbox
+// anyway.
+func (i *interactions) mailboxes(to string) []string {
+	candidates := slices.DeleteFunc(i.aliveMembers(), func(ID string) bool { return ID == to || ID == i.ID })
+
+	target := keyOf(to)
+	slices.SortFunc(candidates, func(a, b string) int {
+		da, db := keyOf(a).xor(target), keyOf(b).xor(target)
+		switch {
+		case da.less(db):
+			return -1
+		case db.less(da):
+			return 1
+		}
+		return 0
+	})
+	return candidates[:min(len(candidates), mailboxReplicas)]
+}
+
+// checkLetter verifies the author's signature and the expiry.
+func checkLetter(ctx context.Context, d dispatcher, l letter) error {
+	if !time.Now().Before(l.Expires) {
+		return fmt.Errorf("%w: expired", ErrInvalidLetter)
+	}
+	if time.Until(l.Expires) > mailTTL+time.Hour {
+		return fmt.Errorf("%w: expires too late", ErrInvalidLetter)
+	}
+
+	key := d.memberAuthKey(l.Author)
+	if key == nil {
+		lookupCtx, cancel := context.WithTimeout(ctx, dhtLookupTimeout*time.Duration(dhtLookupAttempts))
+		defer cancel()
+		var err error
+		if key, err = findAuthKey(lookupCtx, d, l.Author); err != nil {
+			return fmt.Errorf("findAuthKey: %w", err)
+		}
+	}
+	if !verifyPayload(key, tagLetter, l.signed(), l.Signature) {
+		return fmt.Errorf("%w: bad signature", ErrInvalidLetter)
+	}
+	return nil
+}
+
+// acceptDeposit holds a letter for a member. If the member is back
+// already, the letter goes on at once.
+func acceptDeposit(d dispatcher, s incomeSignal) {
+	var l letter
+	if err := l.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "acceptDeposit <From:%s>: l.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("acceptDeposit <Author:%s> <To:%s>", l.Author, l.To)
+	if l.To == d.myID() {
+		acceptLetter(ctx, d, s.From, l)
+		return
+	}
+	// Letters are only held for members, or anybody could store whatever
+	// they like here.
+	if d.memberAuthKey(l.To) == nil {
+		logger.Warnf(ctx, "Recipient isn't a member")
+		return
+	}
+	if err := checkLetter(ctx, d, l); err != nil {
+		logger.Warnf(ctx, "checkLetter: %v", err)
+		return
+	}
+	if err := d.holdLetter(l); err != nil {
+		logger.Warnf(ctx, "d.holdLetter: %v", err)
+		return
+	}
+	logger.Debugf(ctx, "Held")
+}
+
+// acceptMail opens a letter sent to the node.
+func acceptMail(d dispatcher, s incomeSignal) {
+	var l letter
+	if err := l.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "acceptMail <From:%s>: l.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("acceptMail <Author:%s> <From:%s>", l.Author, s.From)
+	if l.To != d.myID() {
+		logger.Warnf(ctx, "Letter for '%s'", l.To)
+		return
+	}
+	acceptLetter(ctx, d, s.From, l)
+}
+
+// acceptLetter opens a letter and acknowledges it to the author, and to
+// the mailbox peer it came from, which holds it until then.
+func acceptLetter(ctx context.Context, d dispatcher, from string, l letter) {
+	if err := checkLetter(ctx, d, l); err != nil {
+		logger.Warnf(ctx, "checkLetter: %v", err)
+		return
+	}
+	b, err := crypt.Open(d.privateAuthKey(), l.Sealed, l.additional())
+	if err != nil {
+		logger.Warnf(ctx, "crypt.Open: %v", err)
+		return
+	}
+	var m ChatMessage
+	if err := m.unmarshal(b); err != nil {
+		logger.Warnf(ctx, "m.unmarshal: %v", err)
+		return
+	}
+	if m.ID != l.ID || m.Author != l.Author {
+		logger.Warnf(ctx, "Message doesn't match the letter!")
+		return
+	}
+	if m.Room != "" && !d.isRoomMember(m.Room, m.Author) {
+		logger.Debugf(ctx, "Author isn't a member of the room '%s'", m.Room)
+		return
+	}
+
+	d.receiveChat(m)
+	if from != l.Author {
+		d.send(from, networkSignal{
+			Type:    SignalTypeReceipt,
+			Payload: receipt{ID: l.ID, Status: StatusDelivered}.marshal(),
+		})
+	}
+	logger.Debugf(ctx, "Received")
+}
+
+func (i *interactions) holdLetter(l letter) error {
+	if err := i.mail.hold(l); err != nil {
+		return err
+	}
+	if i.isMember(l.To) {
+		i.send(l.To, networkSignal{Type: SignalTypeMail, Payload: l.marshal()})
+	}
+	return nil
+}
+
+// deliverMail passes letters to a member that is online. They are sent
+// again with every flush until the member acknowledges them.
+func (i *interactions) deliverMail(to string) {
+	letters := i.mail.letters(to)
+	for _, l := range letters {
+		i.send(to, networkSignal{Type: SignalTypeMail, Payload: l.marshal()})
+	}
+	if len(letters) > 0 {
+		logger.Debugf(nil, "%d letters are sent to '%s'", len(letters), to)
+	}
+}
+
+// keepMail delivers letters to members that are back, drops expired ones
+// and flushes the store until the node stops.
+func (n *Network) keepMail(ctx context.Context) {
+	ctx = span.Extend(ctx, "network.keepMail")
+	logger.Debugf(ctx, "Start...")
+
+	ticker := time.NewTicker(mailFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := n.mail.save(); err != nil {
+				logger.Errorf(ctx, "n.mail.save: %v", err)
+			}
+			logger.Debugf(ctx, "...End")
+			return
+		case <-ticker.C:
+			n.mail.expire()
+			for _, to := range n.mail.recipients() {
+				if n.isMember(to) {
+					n.deliverMail(to)
+				}
+			}
+			if err := n.mail.save(); err != nil {
+				logger.Errorf(ctx, "n.mail.save: %v", err)
+			}
+		}
+	}
+}
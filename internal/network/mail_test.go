@@ -0,0 +1,99 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMailStoreKeepsLettersUntilDropped(t *testing.T) {
+	s := newMailStore("")
+	author, to := testNodeID(t), testNodeID(t)
+	expires := time.Now().Add(mailTTL)
+
+	s.post(letter{ID: "own", Author: author, To: to, Expires: expires})
+	if err := s.hold(letter{ID: "held", Author: testNodeID(t), To: to, Expires: expires}); err != nil {
+		t.Fatalf("s.hold: %v", err)
+	}
+
+	for range 2 {
+		if got := len(s.letters(to)); got != 2 {
+			t.Fatalf("%d letters, want 2", got)
+		}
+	}
+
+	s.drop("own", to)
+	s.drop("held", to)
+	if got := len(s.letters(to)); got != 0 {
+		t.Fatalf("%d letters after they're dropped, want 0", got)
+	}
+	if len(s.mailbox) != 0 || len(s.authors) != 0 {
+		t.Fatalf("held letters are still counted: %v", s.authors)
+	}
+}
+
+func TestMailStoreAuthorQuota(t *testing.T) {
+	s := newMailStore("")
+	author := testNodeID(t)
+	expires := time.Now().Add(mailTTL)
+
+	hold := func(ID string) error {
+		return s.hold(letter{ID: ID, Author: author, To: testNodeID(t), Expires: expires})
+	}
+	for k := range maxMailboxAuthorLetters {
+		if err := hold(fmt.Sprint(k)); err != nil {
+			t.Fatalf("s.hold: %v", err)
+		}
+	}
+	if err := hold("one more"); !errors.Is(err, ErrMailboxFull) {
+		t.Fatalf("got %v, want %v", err, ErrMailboxFull)
+	}
+
+	if err := s.hold(letter{ID: "other", Author: testNodeID(t), To: testNodeID(t), Expires: expires}); err != nil {
+		t.Fatalf("letter of another author: %v", err)
+	}
+}
+
+func TestAcceptDepositOnlyForMembers(t *testing.T) {
+	n := testNetwork(t)
+	key, author := testKey(t)
+	n.cluster.add(memberKeys{{ID: author, PubKey: &key.PublicKey}})
+
+	l := letter{ID: "letter", Author: author, To: testNodeID(t), Expires: time.Now().Add(mailTTL)}
+	var err error
+	if l.Signature, err = signPayload(key, tagLetter, l.signed()); err != nil {
+		t.Fatalf("signPayload: %v", err)
+	}
+	acceptDeposit(&n.interactions, incomeSignal{
+		From:          author,
+		networkSignal: networkSignal{Type: SignalTypeDeposit, Payload: l.marshal()},
+	})
+	if got := len(n.mail.letters(l.To)); got != 0 {
+		t.Fatalf("%d letters are held for a stranger", got)
+	}
+}
+
+func TestMailStoreEvictsOldestWhenFull(t *testing.T) {
+	limit := maxHeldLetters
+	maxHeldLetters = 3
+	t.Cleanup(func() { maxHeldLetters = limit })
+
+	s := newMailStore("")
+	now := time.Now()
+	for k := range 4 {
+		l := letter{ID: fmt.Sprint(k), Author: testNodeID(t), To: testNodeID(t), Expires: now.Add(mailTTL + time.Duration(k)*time.Minute)}
+		if err := s.hold(l); err != nil {
+			t.Fatalf("s.hold: %v", err)
+		}
+	}
+
+	if s.heldLetters != 3 {
+		t.Fatalf("%d letters are held, want 3", s.heldLetters)
+	}
+	for _, letters := range s.mailbox {
+		if _, ok := letters["0"]; ok {
+			t.Fatalf("oldest letter isn't evicted")
+		}
+	}
+}
@@ -0,0 +1,670 @@
+package network
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// Membership follows SWIM: every period a node probes one neighbour,
+// asks a few others to probe it indirectly when there's no ack, and
+// suspects it when nobody gets through. A suspect that doesn't refute
+// the suspicion in time is confirmed dead. Updates ride on probes and
+// acks, each one a limited number of times.
+//
+// Anybody may suspect a member or find it dead, but only the member
+// itself can say it's alive in a new incarnation or that it leaves, so
+// such updates carry its signature.
+
+type memberStatus uint8
+
+const (
+	memberAlive memberStatus = iota
+	memberSuspect
+	memberDead
+	memberLeft
+)
+
+func (s memberStatus) gone() bool {
+	return s == memberDead || s == memberLeft
+}
+
+type memberState struct {
+	status      memberStatus
+	incarnation uint64
+	since       time.Time
+	// signature of the update the state comes from, passed on to
+	// newcomers.
+	signature []byte
+}
+
+type memberUpdate struct {
+	ID          string
+	Status      memberStatus
+	Incarnation uint64
+	Signature   []byte
+}
+
+func (u memberUpdate) signed() []byte {
+	var w payloadWriter
+	w.string(u.ID)
+	w.uvarint(uint64(u.Status))
+	w.uvarint(u.Incarnation)
+	return w.buf
+}
+
+func (u *memberUpdate) sign(key *ecdsa.PrivateKey) error {
+	var err error
+	u.Signature, err = signPayload(key, tagMember, u.signed())
+	return err
+}
+
+func (u memberUpdate) verify(key *ecdsa.PublicKey) bool {
+	return verifyPayload(key, tagMember, u.signed(), u.Signature)
+}
+
+type gossipEntry struct {
+	update    memberUpdate
+	transmits int
+}
+
+type membership struct {
+	mu sync.Mutex
+	// incarnation of the node itself. It starts from the clock, so a
+	// restarted node always outruns gossip about its previous life.
+	incarnation uint64
+	states      map[string]*memberState
+	gossip      map[string]*gossipEntry
+	order       []string
+	seq         uint64
+}
+
+// probe is a payload of Probe, ProbeAck and ProbeRequest. Target is the
+// probed node; for a direct ack it's the sender itself.
+type probe struct {
+	Seq    uint64
+	Target string
+	Gossip []memberUpdate
+}
+
+func (p probe) marshal() []byte {
+	var w payloadWriter
+	w.uvarint(p.Seq)
+	w.string(p.Target)
+	writeUpdates(&w, p.Gossip)
+	return w.buf
+}
+
+func (p *probe) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	p.Seq = r.uvarint(math.MaxUint64)
+	p.Target = r.id()
+	p.Gossip = readUpdates(&r, maxPiggyback)
+	return r.close()
+}
+
+func writeUpdates(w *payloadWriter, updates []memberUpdate) {
+	w.uvarint(uint64(len(updates)))
+	for _, u := range updates {
+		w.string(u.ID)
+		w.uvarint(uint64(u.Status))
+		w.uvarint(u.Incarnation)
+		w.bytes(u.Signature)
+	}
+}
+
+func readUpdates(r *payloadReader, limit int) []memberUpdate {
+	count := r.uvarint(uint64(limit))
+	updates := make([]memberUpdate, 0, count)
+	for range count {
+		updates = append(updates, memberUpdate{
+			ID:          r.id(),
+			Status:      memberStatus(r.uvarint(uint64(memberLeft))),
+			Incarnation: r.uvarint(math.MaxUint64),
+			Signature:   r.bytes(maxSignatureLength),
+		})
+	}
+	return updates
+}
+
+func newMembership() membership {
+	return membership{
+		incarnation: uint64(time.Now().UnixMilli()),
+		states:      make(map[string]*memberState),
+		gossip:      make(map[string]*gossipEntry),
+	}
+}
+
+// keepMembership runs the protocol periods until the node stops.
+func (n *Network) keepMembership(ctx context.Context) {
+	ctx = span.Extend(ctx, "network.keepMembership")
+	logger.Debugf(ctx, "Start...")
+
+	n.announceAlive()
+
+	ticker := time.NewTicker(swimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debugf(ctx, "...End")
+			return
+		case <-ticker.C:
+			n.expireSuspects()
+			n.probeNext()
+		}
+	}
+}
+
+func (i *interactions) announceAlive() {
+	i.membership.mu.Lock()
+	defer i.membership.mu.Unlock()
+	i.enqueueGossip(i.selfUpdate(memberAlive))
+}
+
+// selfUpdate is the node's own status, signed. Must be called with the
+// membership lock held.
+func (i *interactions) selfUpdate(status memberStatus) memberUpdate {
+	u := memberUpdate{
+		ID:          i.ID,
+		Status:      status,
+		Incarnation: i.membership.incarnation,
+	}
+	if err := u.sign(i.privateAuth); err != nil {
+		logger.Errorf(nil, "u.sign: %v", err)
+	}
+	return u
+}
+
+// leave tells the cluster the node is going away, so nobody has to wait
+// for the suspicion to expire.
+func (i *interactions) leave() {
+	i.announceSelf(memberLeft)
+}
+
+// announceSelf broadcasts the node's own status. Gossip would spread it
+// too, but news about the node itself are worth not waiting for.
+func (i *interactions) announceSelf(status memberStatus) {
+	i.membership.mu.Lock()
+	u := i.selfUpdate(status)
+	i.membership.mu.Unlock()
+
+	var w payloadWriter
+	writeUpdates(&w, []memberUpdate{u})
+	i.clusterBroadcast(networkSignal{
+		Type:    SignalTypeSyncMembers,
+		Payload: w.buf,
+	})
+}
+
+func (i *interactions) probeNext() {
+	target, ok := i.nextProbeTarget()
+	if !ok {
+		return
+	}
+	ctx := span.Init("interactions.probeNext <Target:%s>", target)
+	logger.Debugf(ctx, "Start...")
+
+	seq := i.nextProbeSeq()
+	acked := awaitAck(i, seq, target, swimProbeTimeout+swimIndirectTimeout)
+
+	i.send(target, networkSignal{
+		Type:    SignalTypeProbe,
+		Payload: probe{Seq: seq, Target: target, Gossip: i.piggyback(target)}.marshal(),
+	})
+
+	select {
+	case <-acked:
+		logger.Debugf(ctx, "Acked")
+		return
+	case <-time.After(swimProbeTimeout):
+	}
+
+	helpers := slices.DeleteFunc(i.connectedPeers(), func(ID string) bool { return ID == target })
+	rand.Shuffle(len(helpers), func(a, b int) { helpers[a], helpers[b] = helpers[b], helpers[a] })
+	helpers = helpers[:min(len(helpers), swimIndirectProbes)]
+	logger.Debugf(ctx, "No ack, asking %d neighbours", len(helpers))
+
+	for _, helper := range helpers {
+		i.send(helper, networkSignal{
+			Type:    SignalTypeProbeRequest,
+			Payload: probe{Seq: seq, Target: target, Gossip: i.piggyback(helper)}.marshal(),
+		})
+	}
+
+	select {
+	case <-acked:
+		logger.Debugf(ctx, "Acked indirectly")
+	case <-time.After(swimIndirectTimeout):
+		logger.Warnf(ctx, "Unreachable")
+		i.suspect(target)
+	}
+}
+
+// awaitAck waits for an ack of the probe, direct or relayed.
+func awaitAck(d dispatcher, seq uint64, target string, timeout time.Duration) <-chan struct{} {
+	acked := make(chan struct{})
+	d.addReaction(timeout, func(s incomeSignal) bool {
+		if s.Type != SignalTypeProbeAck {
+			return false
+		}
+		var p probe
+		if err := p.unmarshal(s.Payload); err != nil {
+			return false
+		}
+		if p.Seq != seq || p.Target != target {
+			return false
+		}
+		close(acked)
+		return true
+	})
+	return acked
+}
+
+func answerProbe(d dispatcher, s incomeSignal) {
+	var p probe
+	if err := p.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "answerProbe <From:%s>: p.unmarshal: %v", s.From, err)
+		return
+	}
+	acceptGossip(d, s.From, p.Gossip)
+
+	if p.Target != d.myID() {
+		return
+	}
+	d.send(s.From, networkSignal{
+		Type:    SignalTypeProbeAck,
+		Payload: probe{Seq: p.Seq, Target: d.myID(), Gossip: d.piggyback(s.From)}.marshal(),
+	})
+}
+
+func acceptProbeAck(d dispatcher, s incomeSignal) {
+	var p probe
+	if err := p.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "acceptProbeAck <From:%s>: p.unmarshal: %v", s.From, err)
+		return
+	}
+	acceptGossip(d, s.From, p.Gossip)
+}
+
+// probeFor probes a neighbour on behalf of the requester and relays the
+// ack back.
+func probeFor(d dispatcher, s incomeSignal) {
+	var p probe
+	if err := p.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "probeFor <From:%s>: p.unmarshal: %v", s.From, err)
+		return
+	}
+	acceptGossip(d, s.From, p.Gossip)
+
+	ctx := span.Init("probeFor <Requester:%s> <Target:%s>", s.From, p.Target)
+	if !slices.Contains(d.connectedPeers(), p.Target) {
+		logger.Debugf(ctx, "Not a neighbour")
+		return
+	}
+
+	seq := d.nextProbeSeq()
+	acked := awaitAck(d, seq, p.Target, swimIndirectTimeout)
+	d.send(p.Target, networkSignal{
+		Type:    SignalTypeProbe,
+		Payload: probe{Seq: seq, Target: p.Target, Gossip: d.piggyback(p.Target)}.marshal(),
+	})
+
+	select {
+	case <-acked:
+		d.send(s.From, networkSignal{
+			Type:    SignalTypeProbeAck,
+			Payload: probe{Seq: p.Seq, Target: p.Target, Gossip: d.piggyback(s.From)}.marshal(),
+		})
+		logger.Debugf(ctx, "Relayed ack")
+	case <-time.After(swimIndirectTimeout):
+		logger.Debugf(ctx, "No ack")
+	}
+}
+
+func (i *interactions) nextProbeSeq() uint64 {
+	i.membership.mu.Lock()
+	defer i.membership.mu.Unlock()
+	i.membership.seq++
+	return i.membership.seq
+}
+
+// nextProbeTarget walks neighbours round-robin in a random order that
+// is reshuffled after every full round.
+func (i *interactions) nextProbeTarget() (string, bool) {
+	peers := i.connectedPeers()
+
+	i.membership.mu.Lock()
+	defer i.membership.mu.Unlock()
+
+	for len(i.membership.order) > 0 {
+		ID := i.membership.order[0]
+		i.membership.order = i.membership.order[1:]
+		if slices.Contains(peers, ID) {
+			return ID, true
+		}
+	}
+
+	if len(peers) == 0 {
+		return "", false
+	}
+	rand.Shuffle(len(peers), func(a, b int) { peers[a], peers[b] = peers[b], peers[a] })
+	i.membership.order = peers[1:]
+	return peers[0], true
+}
+
+// syncMembers hands the whole view to a newcomer. Gossip only carries
+// changes, so it wouldn't learn about quiet members otherwise.
+func syncMembers(d dispatcher, to string) {
+	updates := d.membersSnapshot()
+	for len(updates) > 0 {
+		chunk := updates[:min(len(updates), maxMemberKeys)]
+		updates = updates[len(chunk):]
+
+		var w payloadWriter
+		writeUpdates(&w, chunk)
+		d.send(to, networkSignal{
+			Type:    SignalTypeSyncMembers,
+			Payload: w.buf,
+		})
+	}
+}
+
+func acceptMembers(d dispatcher, s incomeSignal) {
+	r := payloadReader{buf: s.Payload}
+	updates := readUpdates(&r, maxMemberKeys)
+	if err := r.close(); err != nil {
+		logger.Warnf(nil, "acceptMembers <From:%s>: %v", s.From, err)
+		return
+	}
+	acceptGossip(d, s.From, updates)
+}
+
+// acceptGossip applies updates from a peer. Updates signed by members
+// whose keys are unknown yet can't be checked, so the keys are asked
+// for: the updates come again with the next rounds.
+func acceptGossip(d dispatcher, from string, updates []memberUpdate) {
+	var unknown []string
+	for _, u := range updates {
+		if len(u.Signature) > 0 && u.ID != d.myID() && d.memberAuthKey(u.ID) == nil {
+			unknown = append(unknown, u.ID)
+		}
+	}
+	if len(unknown) > 0 {
+		requestAuthKeys(d, from, unknown...)
+	}
+	d.applyGossip(updates)
+}
+
+func (i *interactions) membersSnapshot() []memberUpdate {
+	i.membership.mu.Lock()
+	defer i.membership.mu.Unlock()
+
+	out := make([]memberUpdate, 0, len(i.membership.states)+1)
+	out = append(out, i.selfUpdate(memberAlive))
+	for ID, state := range i.membership.states {
+		out = append(out, memberUpdate{
+			ID:          ID,
+			Status:      state.status,
+			Incarnation: state.incarnation,
+			Signature:   state.signature,
+		})
+	}
+	return out
+}
+
+// isMember reports whether the member is believed to be alive.
+func (i *interactions) isMember(ID string) bool {
+	i.membership.mu.Lock()
+	defer i.membership.mu.Unlock()
+
+	state, ok := i.membership.states[ID]
+	return ok && !state.status.gone()
+}
+
+func (i *interactions) aliveMembers() []string {
+	i.membership.mu.Lock()
+	defer i.membership.mu.Unlock()
+
+	out := make([]string, 0, len(i.membership.states))
+	for ID, state := range i.membership.states {
+		if !state.status.gone() {
+			out = append(out, ID)
+		}
+	}
+	return out
+}
+
+// memberJoined registers a member met for the first time. Its real
+// incarnation arrives with its own gossip.
+func (i *interactions) memberJoined(ID string) {
+	i.applyGossip([]memberUpdate{{ID: ID, Status: memberAlive}})
+}
+
+// suspect starts suspicion about a member that stopped answering.
+func (i *interactions) suspect(ID string) {
+	i.membership.mu.Lock()
+	state, ok := i.membership.states[ID]
+	var inc uint64
+	if ok {
+		inc = state.incarnation
+	}
+	i.membership.mu.Unlock()
+	if ok && state.status != memberAlive {
+		return
+	}
+
+	i.applyGossip([]memberUpdate{{ID: ID, Status: memberSuspect, Incarnation: inc}})
+}
+
+// confirmDead declares a member dead without waiting for suspicion.
+func (i *interactions) confirmDead(ID string) {
+	i.membership.mu.Lock()
+	var inc uint64
+	if state, ok := i.membership.states[ID]; ok {
+		inc = state.incarnation
+	}
+	i.membership.mu.Unlock()
+
+	i.applyGossip([]memberUpdate{{ID: ID, Status: memberDead, Incarnation: inc}})
+}
+
+func (i *interactions) expireSuspects() {
+	timeout := time.Duration(swimSuspicionMult*math.Log2(float64(i.clusterSize()+2))) * swimInterval
+
+	var dead []memberUpdate
+	i.membership.mu.Lock()
+	for ID, state := range i.membership.states {
+		if state.status == memberSuspect && time.Since(state.since) > timeout {
+			dead = append(dead, memberUpdate{ID: ID, Status: memberDead, Incarnation: state.incarnation})
+		}
+		if state.status.gone() && time.Since(state.since) > swimTombstoneTTL {
+			delete(i.membership.states, ID)
+		}
+	}
+	i.membership.mu.Unlock()
+
+	i.applyGossip(dead)
+}
+
+// applyGossip merges updates into the local view by SWIM rules: a higher
+// incarnation wins, and for the same one Dead beats Suspect beats Alive.
+// A member found dead by others isn't disconnected: if it's still
+// there, it refutes, and if it isn't, the heartbeat drops it.
+func (i *interactions) applyGossip(updates []memberUpdate) {
+	var (
+		events  []Event
+		gone    []string
+		refuted bool
+	)
+
+	i.membership.mu.Lock()
+	for _, u := range updates {
+		if u.ID == i.ID {
+			refuted = i.refute(u) || refuted
+			continue
+		}
+
+		state, known := i.membership.states[u.ID]
+		if known && !overrides(u, *state) {
+			continue
+		}
+		if !i.authentic(u, state) {
+			logger.Warnf(nil, "Unauthentic gossip about '%s' (%d at %d)", u.ID, u.Status, u.Incarnation)
+			continue
+		}
+		// An evicted member can't talk itself back in.
+		if !u.Status.gone() && i.isBlocked(u.ID) {
+			continue
+		}
+
+		wasAlive := known && !state.status.gone()
+		i.membership.states[u.ID] = &memberState{
+			status:      u.Status,
+			incarnation: u.Incarnation,
+			since:       time.Now(),
+			signature:   u.Signature,
+		}
+		i.enqueueGossip(u)
+
+		switch {
+		case u.Status == memberAlive && !wasAlive:
+			events = append(events, Event{Type: EventMemberJoined, PeerID: u.ID})
+		case u.Status == memberSuspect:
+			events = append(events, Event{Type: EventMemberSuspected, PeerID: u.ID})
+		case u.Status == memberDead && wasAlive:
+			events = append(events, Event{Type: EventMemberFailed, PeerID: u.ID})
+			i.forgetLost(u.ID)
+		case u.Status == memberLeft && wasAlive:
+			events = append(events, Event{Type: EventMemberLeft, PeerID: u.ID})
+			gone = append(gone, u.ID)
+		}
+	}
+	i.membership.mu.Unlock()
+
+	if refuted {
+		i.announceSelf(memberAlive)
+	}
+	for _, e := range events {
+		logger.Debugf(nil, "Member '%s' <ID:%s>", e.Type, e.PeerID)
+		i.emit(e)
+		if e.Type == EventMemberJoined {
+			go i.deliverMail(e.PeerID)
+		}
+	}
+	for _, ID := range gone {
+		i.forgetLost(ID)
+		i.disconnect(ID)
+	}
+}
+
+// authentic reports whether an update may come from somebody other than
+// its subject, or else is signed by the subject. Incarnations start from
+// the clock, so one far ahead of it is made up. A member seen for the
+// first time has to sign that it's alive, or anybody could make members
+// up, unless the node has challenged it itself. Must be called with the
+// membership lock held.
+func (i *interactions) authentic(u memberUpdate, state *memberState) bool {
+	if u.Incarnation > uint64(time.Now().Add(maxClockSkew).UnixMilli()) {
+		return false
+	}
+	if state == nil && !u.Status.gone() {
+		if u.Status != memberAlive {
+			return false
+		}
+		if len(u.Signature) == 0 && i.cluster.isChallenged(u.ID) {
+			return true
+		}
+	} else if u.Status != memberLeft && (u.Status != memberAlive || u.Incarnation <= state.incarnation) {
+		return true
+	}
+	key := i.cluster.MemberAuthKey(u.ID)
+	return key != nil && u.verify(key)
+}
+
+func overrides(u memberUpdate, state memberState) bool {
+	if u.Incarnation != state.incarnation {
+		return u.Incarnation > state.incarnation
+	}
+	switch u.Status {
+	case memberSuspect:
+		return state.status == memberAlive
+	case memberDead, memberLeft:
+		return !state.status.gone()
+	}
+	return false
+}
+
+// refute answers gossip about the node itself and reports whether it
+// had to. A Left is refuted too, unless the node has signed it itself.
+// Must be called with the membership lock held.
+func (i *interactions) refute(u memberUpdate) bool {
+	if u.Status == memberAlive {
+		return false
+	}
+	if u.Status == memberLeft && u.verify(&i.privateAuth.PublicKey) {
+		return false
+	}
+	if u.Incarnation < i.membership.incarnation {
+		return false
+	}
+	// Others never take incarnations far ahead of the clock, so there's
+	// no need to outrun them, and the increment can't overflow.
+	if u.Incarnation >= uint64(time.Now().Add(maxClockSkew).UnixMilli()) {
+		return false
+	}
+	i.membership.incarnation = u.Incarnation + 1
+	i.enqueueGossip(i.selfUpdate(memberAlive))
+	return true
+}
+
+// enqueueGossip must be called with the membership lock held.
+func (i *interactions) enqueueGossip(u memberUpdate) {
+	i.membership.gossip[u.ID] = &gossipEntry{update: u}
+}
+
+// piggyback takes the least spread updates for the next outgoing probe
+// or ack. Each update is sent about log(n) times and then forgotten.
+// News about the recipient go first: a suspected node refutes sooner.
+func (i *interactions) piggyback(to string) []memberUpdate {
+	limit := swimRetransmitMult * int(math.Ceil(math.Log2(float64(i.clusterSize()+2))))
+
+	i.membership.mu.Lock()
+	defer i.membership.mu.Unlock()
+
+	entries := make([]*gossipEntry, 0, len(i.membership.gossip))
+	for _, e := range i.membership.gossip {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *gossipEntry) int {
+		if (a.update.ID == to) != (b.update.ID == to) {
+			if a.update.ID == to {
+				return -1
+			}
+			return 1
+		}
+		return a.transmits - b.transmits
+	})
+
+	out := make([]memberUpdate, 0, min(len(entries), maxPiggyback))
+	for _, e := range entries[:min(len(entries), maxPiggyback)] {
+		out = append(out, e.update)
+		e.transmits++
+		if e.transmits >= limit {
+			delete(i.membership.gossip, e.update.ID)
+		}
+	}
+	return out
+}
+
+// Members returns IDs of other members that are believed to be alive.
+func (n *Network) Members() []string {
+	return n.aliveMembers()
+}
@@ -0,0 +1,161 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestApplyGossipAuthenticity(t *testing.T) {
+	now := uint64(time.Now().UnixMilli())
+	key, ID := testKey(t)
+	signed := func(status memberStatus, inc uint64) memberUpdate {
+		u := memberUpdate{ID: ID, Status: status, Incarnation: inc}
+		if err := u.sign(key); err != nil {
+			t.Fatalf("u.sign: %v", err)
+		}
+		return u
+	}
+	unsigned := func(status memberStatus, inc uint64) memberUpdate {
+		return memberUpdate{ID: ID, Status: status, Incarnation: inc}
+	}
+
+	tests := []struct {
+		name   string
+		update memberUpdate
+		want   memberStatus
+	}{
+		{"unsigned Left", unsigned(memberLeft, now), memberAlive},
+		{"signed Left", signed(memberLeft, now), memberLeft},
+		{"unsigned Alive of a new incarnation", unsigned(memberAlive, now+1), memberSuspect},
+		{"signed Alive of a new incarnation", signed(memberAlive, now+1), memberAlive},
+		{"Alive far ahead of the clock", signed(memberAlive, uint64(time.Now().Add(2*maxClockSkew).UnixMilli())), memberSuspect},
+		{"unsigned Suspect", unsigned(memberSuspect, now), memberSuspect},
+		{"unsigned Dead", unsigned(memberDead, now), memberDead},
+		{"Dead far ahead of the clock", unsigned(memberDead, math.MaxUint64), memberAlive},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := testNetwork(t)
+			n.cluster.add(memberKeys{{ID: ID, PubKey: &key.PublicKey}})
+			n.applyGossip([]memberUpdate{signed(memberAlive, now)})
+			if tt.update.Status == memberAlive {
+				n.applyGossip([]memberUpdate{unsigned(memberSuspect, now)})
+			}
+
+			n.applyGossip([]memberUpdate{tt.update})
+			if got := n.membership.states[ID].status; got != tt.want {
+				t.Fatalf("got status %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyGossipRefutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		update  func(n *Network) memberUpdate
+		refuted bool
+	}{
+		{"Suspect", func(n *Network) memberUpdate {
+			return memberUpdate{ID: n.ID, Status: memberSuspect, Incarnation: n.membership.incarnation}
+		}, true},
+		{"Left of somebody else", func(n *Network) memberUpdate {
+			return memberUpdate{ID: n.ID, Status: memberLeft, Incarnation: n.membership.incarnation}
+		}, true},
+		{"own Left", func(n *Network) memberUpdate {
+			return n.selfUpdate(memberLeft)
+		}, false},
+		{"old incarnation", func(n *Network) memberUpdate {
+			return memberUpdate{ID: n.ID, Status: memberDead, Incarnation: n.membership.incarnation - 1}
+		}, false},
+		{"incarnation far ahead of the clock", func(n *Network) memberUpdate {
+			return memberUpdate{ID: n.ID, Status: memberDead, Incarnation: math.MaxUint64}
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := testNetwork(t)
+			before := n.membership.incarnation
+			n.applyGossip([]memberUpdate{tt.update(n)})
+
+			refuted := n.membership.incarnation != before
+			if refuted != tt.refuted {
+				t.Fatalf("refuted: got %t, want %t (incarnation %d -> %d)", refuted, tt.refuted, before, n.membership.incarnation)
+			}
+			if refuted {
+				u := n.membership.gossip[n.ID].update
+				if u.Status != memberAlive || u.Incarnation != n.membership.incarnation || !u.verify(&n.config.privateAuth.PublicKey) {
+					t.Fatalf("refuted with %+v", u)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyGossipAboutNewMembers(t *testing.T) {
+	now := uint64(time.Now().UnixMilli())
+
+	tests := []struct {
+		name   string
+		update func(key *ecdsa.PrivateKey, ID string) memberUpdate
+		member bool
+	}{
+		{"unsigned Alive", func(_ *ecdsa.PrivateKey, ID string) memberUpdate {
+			return memberUpdate{ID: ID, Status: memberAlive, Incarnation: now}
+		}, false},
+		{"unsigned Suspect", func(_ *ecdsa.PrivateKey, ID string) memberUpdate {
+			return memberUpdate{ID: ID, Status: memberSuspect, Incarnation: now}
+		}, false},
+		{"Alive signed as a challenge", func(key *ecdsa.PrivateKey, ID string) memberUpdate {
+			u := memberUpdate{ID: ID, Status: memberAlive, Incarnation: now}
+			u.Signature, _ = signPayload(key, tagChallenge, u.signed())
+			return u
+		}, false},
+		{"signed Alive", func(key *ecdsa.PrivateKey, ID string) memberUpdate {
+			u := memberUpdate{ID: ID, Status: memberAlive, Incarnation: now}
+			if err := u.sign(key); err != nil {
+				t.Fatalf("u.sign: %v", err)
+			}
+			return u
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := testNetwork(t)
+			key, ID := testKey(t)
+			n.cluster.add(memberKeys{{ID: ID, PubKey: &key.PublicKey}})
+
+			n.applyGossip([]memberUpdate{tt.update(key, ID)})
+			if got := n.isMember(ID); got != tt.member {
+				t.Fatalf("member: got %t, want %t", got, tt.member)
+			}
+		})
+	}
+
+	t.Run("challenged by the node", func(t *testing.T) {
+		n := testNetwork(t)
+		key, ID := testKey(t)
+		n.presentAuthKey(ID, &key.PublicKey)
+		n.admitMember(ID)
+		if !n.isMember(ID) {
+			t.Fatalf("challenged member isn't a member")
+		}
+	})
+}
+
+func TestChallengeAnswerIsNoLeft(t *testing.T) {
+	n := testNetwork(t)
+	u := memberUpdate{ID: n.ID, Status: memberLeft, Incarnation: n.membership.incarnation}
+	u.Signature, _ = signPayload(n.config.privateAuth, tagChallenge, u.signed())
+
+	before := n.membership.incarnation
+	n.applyGossip([]memberUpdate{u})
+	if n.membership.incarnation == before {
+		t.Fatalf("Left signed as a challenge isn't refuted")
+	}
+}
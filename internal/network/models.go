@@ -1,8 +1,12 @@
 package network
 
 import (
-	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"fmt"
 	"math/big"
 	"udisend/pkg/crypt"
 )
@@ -27,6 +31,26 @@ ENUM(
 	Ping,
 	Pong,
 	DisconnectCandidate,
+	Hello,
+	SendICECandidate,
+	HandleICECandidate,
+	Reconnect,
+	Probe,
+	ProbeAck,
+	ProbeRequest,
+	SyncMembers,
+	FindNode,
+	FoundNode,
+	FindValue,
+	FoundValue,
+	Routed,
+	Broadcast,
+	Chat,
+	RoomEvent,
+	RoomSync,
+	Deposit,
+	Mail,
+	Receipt,
 
 )
 */
@@ -46,9 +70,50 @@ type signature struct {
 	R, S *big.Int
 }
 
+// signTag tells what a signature is for. Every kind of signed payload
+// has its own, so that a signature given for one kind, say a challenge
+// of any bytes a peer likes, never passes for another.
+type signTag string
+
+const (
+	tagChallenge signTag = "challenge"
+	tagVote      signTag = "vote"
+	tagMember    signTag = "member"
+	tagInvite    signTag = "invite"
+	tagEnvelope  signTag = "envelope"
+	tagLetter    signTag = "letter"
+)
+
+func (t signTag) hash(b []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(t))
+	h.Write([]byte{0})
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// signPayload signs sha256 of the tag and b with the auth key.
+func signPayload(key *ecdsa.PrivateKey, tag signTag, b []byte) ([]byte, error) {
+	hash := tag.hash(b)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(signature{R: r, S: s})
+}
+
+func verifyPayload(key *ecdsa.PublicKey, tag signTag, b, sigBytes []byte) bool {
+	var sig signature
+	if _, err := asn1.Unmarshal(sigBytes, &sig); err != nil {
+		return false
+	}
+	return ecdsa.Verify(key, tag.hash(b), sig.R, sig.S)
+}
+
 type connectionSign struct {
-	To, From, Sign, StunServer string
-	PubKey                     *rsa.PublicKey
+	To, From, Sign string
+	StunServers    []string
+	PubKey         *rsa.PublicKey
 }
 
 type rtcOffer struct {
@@ -67,66 +132,47 @@ func (o rtcOffer) marshal() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	totalLen := len(pubKeyBytes) + len(o.To) + len(o.From) + len(o.RemoteSD) + 1
-	out := make([]byte, 0, totalLen)
-	out = append(out, []byte(o.To)...)
-	out = append(out, []byte(o.From)...)
-	out = append(out, []byte(o.Sign)...)
-	out = append(out, o.RemoteSD...)
-	out = append(out, '|')
-	out = append(out, pubKeyBytes...)
-
-	return out, nil
+	var w payloadWriter
+	w.string(o.To)
+	w.string(o.From)
+	w.string(o.Sign)
+	w.bytes(pubKeyBytes)
+	w.bytes(o.RemoteSD)
+	return w.buf, nil
 }
 
 func (o *rtcOffer) unmarshal(b []byte) error {
-	minLen := idLength*2 + signLength + pubKeyLength
-	if len(b) < minLen {
-		return ErrInvalidMessage
-	}
-	del := bytes.Index(b, []byte{'|'})
-	if del < minLen-pubKeyLength {
-		return ErrInvalidMessage
-	}
-	if len(b[del:]) != pubKeyLength {
-		return ErrInvalidMessage
+	r := payloadReader{buf: b}
+	o.To = r.id()
+	o.From = r.id()
+	o.Sign = r.string(signLength)
+	pubKeyBytes := r.bytes(pubKeyLength)
+	o.RemoteSD = r.bytes(maxFrameSize)
+	if err := r.close(); err != nil {
+		return err
 	}
-	pubKey, err := crypt.ParsePublicKey(b[del:])
+	pubKey, err := crypt.ParsePublicKey(pubKeyBytes)
 	if err != nil {
 		return err
 	}
 	o.PubKey = pubKey
-	pos := 0
-	o.To = string(b[pos:idLength])
-	pos += idLength
-	o.From = string(b[pos : pos+idLength])
-	pos += idLength
-	o.Sign = string(b[pos : pos+signLength])
-	pos += signLength
-	o.RemoteSD = b[pos:del]
 	return nil
 }
 
 func (a rtcAnswer) marshal() []byte {
-	totalLen := len(a.To) + len(a.From) + len(a.RemoteSD)
-	out := make([]byte, 0, totalLen)
-	out = append(out, []byte(a.To)...)
-	out = append(out, []byte(a.From)...)
-	out = append(out, a.RemoteSD...)
-	return out
+	var w payloadWriter
+	w.string(a.To)
+	w.string(a.From)
+	w.bytes(a.RemoteSD)
+	return w.buf
 }
 
 func (a *rtcAnswer) unmarshal(b []byte) error {
-	if len(b) < idLength*2 {
-		return ErrInvalidMessage
-	}
-	pos := 0
-	a.To = string(b[pos:idLength])
-	pos += idLength
-	a.From = string(b[pos : pos+idLength])
-	pos += idLength
-	a.RemoteSD = b[pos:]
-	return nil
+	r := payloadReader{buf: b}
+	a.To = r.id()
+	a.From = r.id()
+	a.RemoteSD = r.bytes(maxFrameSize)
+	return r.close()
 }
 
 func (c connectionSign) marshal() ([]byte, error) {
@@ -134,41 +180,78 @@ func (c connectionSign) marshal() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	totalLen := idLength*2 + signLength + len(c.StunServer) + 1 + len(pubKeyBytes)
-	out := make([]byte, 0, totalLen)
-	out = append(out, []byte(c.To)...)
-	out = append(out, []byte(c.From)...)
-	out = append(out, []byte(c.Sign)...)
-	out = append(out, []byte(c.StunServer)...)
-	out = append(out, '|')
-	out = append(out, pubKeyBytes...)
-	return out, nil
+	var w payloadWriter
+	w.string(c.To)
+	w.string(c.From)
+	w.string(c.Sign)
+	w.strings(c.StunServers)
+	w.bytes(pubKeyBytes)
+	return w.buf, nil
 }
 
 func (c *connectionSign) unmarshal(b []byte) error {
-	minLen := idLength*2 + signLength + pubKeyLength
-	if len(b) < minLen {
-		return ErrInvalidMessage
-	}
-	del := bytes.Index(b, []byte{'|'})
-	if del < idLength*2+signLength {
-		return ErrInvalidMessage
-	}
-	if len(b[del:]) != pubKeyLength {
-		return ErrInvalidMessage
+	r := payloadReader{buf: b}
+	c.To = r.id()
+	c.From = r.id()
+	c.Sign = r.string(signLength)
+	c.StunServers = r.strings(maxStunServers, maxStunServerLength)
+	pubKeyBytes := r.bytes(pubKeyLength)
+	if err := r.close(); err != nil {
+		return err
 	}
-	pubKey, err := crypt.ParsePublicKey(b[del:])
+	pubKey, err := crypt.ParsePublicKey(pubKeyBytes)
 	if err != nil {
 		return err
 	}
 	c.PubKey = pubKey
-	pos := 0
-	c.To = string(b[pos:idLength])
-	pos += idLength
-	c.From = string(b[pos : pos+idLength])
-	pos += idLength
-	c.Sign = string(b[pos : pos+signLength])
-	pos += signLength
-	c.StunServer = string(b[pos:del])
+	return nil
+}
+
+type memberKey struct {
+	ID     string
+	PubKey *ecdsa.PublicKey
+}
+
+type memberKeys []memberKey
+
+func (m memberKeys) marshal() ([]byte, error) {
+	var w payloadWriter
+	w.uvarint(uint64(len(m)))
+	for _, k := range m {
+		pubKeyPEM, err := crypt.PublicKeyToPEM(k.PubKey)
+		if err != nil {
+			return nil, err
+		}
+		w.string(k.ID)
+		w.string(pubKeyPEM)
+	}
+	return w.buf, nil
+}
+
+func (m *memberKeys) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	count := r.uvarint(uint64(maxMemberKeys))
+	pems := make([]string, 0, count)
+	*m = (*m)[:0]
+	for range count {
+		*m = append(*m, memberKey{ID: r.id()})
+		pems = append(pems, r.string(authKeyLength))
+	}
+	if err := r.close(); err != nil {
+		return err
+	}
+
+	for idx, pubKeyPEM := range pems {
+		pubKey, err := crypt.GetECDSAPublicKeyFromPEM(pubKeyPEM)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+		// IDs are derived from keys, so a key can't be claimed by
+		// somebody else.
+		if !crypt.CheckNodeID((*m)[idx].ID, pubKey) {
+			return fmt.Errorf("%w: '%s' doesn't match its key", ErrInvalidPeerID, (*m)[idx].ID)
+		}
+		(*m)[idx].PubKey = pubKey
+	}
 	return nil
 }
@@ -46,6 +46,46 @@ const (
 	SignalTypePong signalType = "Pong"
 	// SignalTypeDisconnectCandidate is a signalType of type DisconnectCandidate.
 	SignalTypeDisconnectCandidate signalType = "DisconnectCandidate"
+	// SignalTypeHello is a signalType of type Hello.
+	SignalTypeHello signalType = "Hello"
+	// SignalTypeSendICECandidate is a signalType of type SendICECandidate.
+	SignalTypeSendICECandidate signalType = "SendICECandidate"
+	// SignalTypeHandleICECandidate is a signalType of type HandleICECandidate.
+	SignalTypeHandleICECandidate signalType = "HandleICECandidate"
+	// SignalTypeReconnect is a signalType of type Reconnect.
+	SignalTypeReconnect signalType = "Reconnect"
+	// SignalTypeProbe is a signalType of type Probe.
+	SignalTypeProbe signalType = "Probe"
+	// SignalTypeProbeAck is a signalType of type ProbeAck.
+	SignalTypeProbeAck signalType = "ProbeAck"
+	// SignalTypeProbeRequest is a signalType of type ProbeRequest.
+	SignalTypeProbeRequest signalType = "ProbeRequest"
+	// SignalTypeSyncMembers is a signalType of type SyncMembers.
+	SignalTypeSyncMembers signalType = "SyncMembers"
+	// SignalTypeFindNode is a signalType of type FindNode.
+	SignalTypeFindNode signalType = "FindNode"
+	// SignalTypeFoundNode is a signalType of type FoundNode.
+	SignalTypeFoundNode signalType = "FoundNode"
+	// SignalTypeFindValue is a signalType of type FindValue.
+	SignalTypeFindValue signalType = "FindValue"
+	// SignalTypeFoundValue is a signalType of type FoundValue.
+	SignalTypeFoundValue signalType = "FoundValue"
+	// SignalTypeRouted is a signalType of type Routed.
+	SignalTypeRouted signalType = "Routed"
+	// SignalTypeBroadcast is a signalType of type Broadcast.
+	SignalTypeBroadcast signalType = "Broadcast"
+	// SignalTypeChat is a signalType of type Chat.
+	SignalTypeChat signalType = "Chat"
+	// SignalTypeRoomEvent is a signalType of type RoomEvent.
+	SignalTypeRoomEvent signalType = "RoomEvent"
+	// SignalTypeRoomSync is a signalType of type RoomSync.
+	SignalTypeRoomSync signalType = "RoomSync"
+	// SignalTypeDeposit is a signalType of type Deposit.
+	SignalTypeDeposit signalType = "Deposit"
+	// SignalTypeMail is a signalType of type Mail.
+	SignalTypeMail signalType = "Mail"
+	// SignalTypeReceipt is a signalType of type Receipt.
+	SignalTypeReceipt signalType = "Receipt"
 )
 
 var ErrInvalidsignalType = errors.New("not a valid signalType")
@@ -80,6 +120,26 @@ var _signalTypeValue = map[string]signalType{
 	"Ping":                   SignalTypePing,
 	"Pong":                   SignalTypePong,
 	"DisconnectCandidate":    SignalTypeDisconnectCandidate,
+	"Hello":                  SignalTypeHello,
+	"SendICECandidate":       SignalTypeSendICECandidate,
+	"HandleICECandidate":     SignalTypeHandleICECandidate,
+	"Reconnect":              SignalTypeReconnect,
+	"Probe":                  SignalTypeProbe,
+	"ProbeAck":               SignalTypeProbeAck,
+	"ProbeRequest":           SignalTypeProbeRequest,
+	"SyncMembers":            SignalTypeSyncMembers,
+	"FindNode":               SignalTypeFindNode,
+	"FoundNode":              SignalTypeFoundNode,
+	"FindValue":              SignalTypeFindValue,
+	"FoundValue":             SignalTypeFoundValue,
+	"Routed":                 SignalTypeRouted,
+	"Broadcast":              SignalTypeBroadcast,
+	"Chat":                   SignalTypeChat,
+	"RoomEvent":              SignalTypeRoomEvent,
+	"RoomSync":               SignalTypeRoomSync,
+	"Deposit":                SignalTypeDeposit,
+	"Mail":                   SignalTypeMail,
+	"Receipt":                SignalTypeReceipt,
 }
 
 // ParsesignalType attempts to convert a string to a signalType.
@@ -3,7 +3,12 @@ package network
 import (
 	"context"
 	"crypto/ecdsa"
+	"errors"
+	"time"
+	"udisend/pkg/logger"
 	"udisend/pkg/span"
+
+	"github.com/pion/webrtc/v4"
 )
 
 type Network struct {
@@ -21,16 +26,76 @@ func New(
 		id:          ID,
 		pubAuth:     pubAuth,
 		privateAuth: privateAuth,
+		workersNum:  defaultWorkersNum,
 	}
 
 	for _, opt := range opts {
 		cfg = opt(cfg)
 	}
 
+	// The embedded server is only used for gathering once it's up.
+	if cfg.turnServer != nil {
+		if _, err := cfg.turnServer.publicAddr(); err != nil {
+			logger.Errorf(nil, "TURN server is disabled: %v", err)
+			cfg.turnServer = nil
+		}
+	}
+
+	var rules policy
+	for _, r := range cfg.policyRules {
+		if err := r.validate(); err != nil {
+			logger.Errorf(nil, "Policy rule '%s' is ignored: %v", r, err)
+			continue
+		}
+		rules.add(r)
+	}
+
+	if cfg.transport == nil {
+		cfg.transport = tcpTransport{tlsConfig: cfg.tlsConfig}
+	}
+
+	var apiOpts []func(*webrtc.API)
+	if cfg.rtcSettings != nil {
+		apiOpts = append(apiOpts, webrtc.WithSettingEngine(*cfg.rtcSettings))
+	}
+
+	cluster := NewCluster()
+	cluster.add(memberKeys{{ID: cfg.id, PubKey: cfg.pubAuth}})
+
 	return &Network{
 		config: cfg,
 		interactions: interactions{
-			interactions: make(map[string]*interaction),
+			ID:            cfg.id,
+			listenAddr:    cfg.listenAddr,
+			interactions:  make(map[string]*interaction),
+			cluster:       cluster,
+			privateAuth:   cfg.privateAuth,
+			iceServerList: cfg.iceServers,
+			rtcAPI:        webrtc.NewAPI(apiOpts...),
+			events:        make(chan Event, eventsBufferSize),
+			reconnect: reconnector{
+				lost: make(map[string]bool),
+			},
+			membership: newMembership(),
+			peers:      newPeerStore(cfg.peerStore),
+			evictions: evictions{
+				votes:   make(map[string]map[string]evictionVote),
+				blocked: make(map[string]time.Time),
+				quorum:  cfg.evictionQuorum,
+			},
+			policy:        &rules,
+			routing:       newRoutingTable(cfg.id),
+			routedSeen:    newSeenCache(routedSeenTTL),
+			broadcastSeen: newSeenCache(broadcastSeenTTL),
+			rooms:         newRooms(),
+			mail:          newMailStore(cfg.mailStore),
+			chatSeen:      newSeenCache(mailTTL),
+			receipts:      newReceipts(),
+			conversations: newConversations(cfg.id),
+			invites: invites{
+				inviteOnly: cfg.inviteOnly,
+				used:       make(map[string]time.Time),
+			},
 		},
 	}
 
@@ -38,5 +103,71 @@ func New(
 
 func (n *Network) Run(ctx context.Context) {
 	ctx = span.Extend(ctx, "network.Run")
+
+	// Started before anything gathers candidates, since that reads the
+	// server list.
+	if n.config.turnServer != nil {
+		if err := n.serveTURN(ctx); err != nil {
+			logger.Errorf(ctx, "n.serveTURN: %v", err)
+		}
+	}
+
 	n.interactions.Run(ctx, n.config.workersNum)
+
+	if n.config.chatAddr != "" {
+		if err := n.serveChat(ctx); err != nil {
+			logger.Errorf(ctx, "n.serveChat: %v", err)
+		}
+	}
+
+	if n.config.listenAddr != "" {
+		if err := n.listen(ctx); err != nil {
+			logger.Errorf(ctx, "n.listen: %v", err)
+		}
+	}
+
+	if err := n.peers.load(); err != nil {
+		logger.Errorf(ctx, "n.peers.load: %v", err)
+	}
+	// Stored keys are self-certifying, but their owners may be long
+	// gone, so they don't count as members until gossip says so.
+	n.cluster.add(n.peers.keys())
+	for ID, until := range n.peers.blocked() {
+		n.block(ID, until)
+	}
+	if err := n.mail.load(); err != nil {
+		logger.Errorf(ctx, "n.mail.load: %v", err)
+	}
+
+	if err := n.dialEntryPoint(ctx); err != nil && !errors.Is(err, ErrNoEntryPoint) {
+		logger.Errorf(ctx, "n.dialEntryPoint: %v", err)
+	}
+
+	go n.keepConnected(ctx)
+	go n.keepMembership(ctx)
+	go n.keepPeerStore(ctx)
+	go n.keepMail(ctx)
+	go n.keepReceipts(ctx)
+	go n.keepConversations(ctx)
+
+	<-ctx.Done()
+	n.leave()
+	// Data channels don't belong to the context, so they're closed
+	// explicitly.
+	for _, ID := range n.interactionIDs() {
+		n.disconnect(ID)
+	}
+}
+
+// Peers returns IDs of the members this node is directly connected with.
+func (n *Network) Peers() []string {
+	var out []string
+	n.rangeInteraction(func(memb *interaction) {
+		memb.mu.RLock()
+		defer memb.mu.RUnlock()
+		if memb.state == Connected {
+			out = append(out, memb.id)
+		}
+	})
+	return out
 }
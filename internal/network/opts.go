@@ -3,6 +3,9 @@ package network
 import (
 	"crypto/ecdsa"
 	"crypto/rsa"
+	"crypto/tls"
+
+	"github.com/pion/webrtc/v4"
 )
 
 type networkOpts struct {
@@ -15,7 +18,24 @@ type networkOpts struct {
 	privateKey  *rsa.PrivateKey
 	pubAuth     *ecdsa.PublicKey
 	privateAuth *ecdsa.PrivateKey
-	stunServer  string
+	iceServers  []webrtc.ICEServer
+	tlsConfig   *tls.Config
+	transport   Transport
+	rtcSettings *webrtc.SettingEngine
+	turnServer  *TURNServerConfig
+	peerStore   string
+	// evictionQuorum is a number of distinct votes that evicts a member;
+	// zero means a majority of the cluster.
+	evictionQuorum int
+	// invite is presented when joining an invite-only cluster.
+	invite     string
+	inviteOnly bool
+	// policyRules are the initial rules of the admission policy.
+	policyRules []PolicyRule
+	// chatAddr is where local clients post and read chat messages.
+	chatAddr string
+	// mailStore is a file to keep letters for offline members in.
+	mailStore string
 }
 
 type With func(networkOpts) networkOpts
@@ -44,7 +64,98 @@ func WithCrypt(decode func([]byte) ([]byte, error), pubRSA *rsa.PublicKey) With
 
 func WithStunServer(v string) With {
 	return func(o networkOpts) networkOpts {
-		o.stunServer = v
+		o.iceServers = append(o.iceServers, webrtc.ICEServer{URLs: []string{v}})
+		return o
+	}
+}
+
+func WithICEServers(v ...webrtc.ICEServer) With {
+	return func(o networkOpts) networkOpts {
+		o.iceServers = append(o.iceServers, v...)
+		return o
+	}
+}
+
+func WithTLS(v *tls.Config) With {
+	return func(o networkOpts) networkOpts {
+		o.tlsConfig = v
+		return o
+	}
+}
+
+func WithTransport(v Transport) With {
+	return func(o networkOpts) networkOpts {
+		o.transport = v
+		return o
+	}
+}
+
+func WithSettingEngine(v webrtc.SettingEngine) With {
+	return func(o networkOpts) networkOpts {
+		o.rtcSettings = &v
+		return o
+	}
+}
+
+func WithTURNServer(v TURNServerConfig) With {
+	return func(o networkOpts) networkOpts {
+		o.turnServer = &v
+		return o
+	}
+}
+
+// WithPeerStore keeps known peers in the file, so the node can rejoin
+// after a restart without an entry point.
+func WithPeerStore(path string) With {
+	return func(o networkOpts) networkOpts {
+		o.peerStore = path
+		return o
+	}
+}
+
+func WithEvictionQuorum(v int) With {
+	return func(o networkOpts) networkOpts {
+		o.evictionQuorum = v
+		return o
+	}
+}
+
+func WithInvite(token string) With {
+	return func(o networkOpts) networkOpts {
+		o.invite = token
+		return o
+	}
+}
+
+// WithInviteOnly makes the node refuse to verify newcomers without a
+// valid invite.
+func WithInviteOnly(v bool) With {
+	return func(o networkOpts) networkOpts {
+		o.inviteOnly = v
+		return o
+	}
+}
+
+func WithPolicyRules(rules ...PolicyRule) With {
+	return func(o networkOpts) networkOpts {
+		o.policyRules = append(o.policyRules, rules...)
+		return o
+	}
+}
+
+// WithChatAddr serves the chat endpoint for local clients on the address.
+func WithChatAddr(v string) With {
+	return func(o networkOpts) networkOpts {
+		o.chatAddr = v
+		return o
+	}
+}
+
+// WithMailStore keeps letters for offline members in the file, so they
+// aren't lost when the node restarts.
+func WithMailStore(path string) With {
+	return func(o networkOpts) networkOpts {
+		o.mailStore = path
 		return o
 	}
 }
@@ -0,0 +1,302 @@
+package network
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"udisend/pkg/crypt"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// Messages may take different paths and overtake each other, so each of
+// them carries a vector clock and is held back until the messages it
+// follows have been shown. Conversations are kept in one order on every
+// member: causal, and by the authors' clocks for concurrent messages.
+// Clocks follow the wall clock like room versions, so an author
+// restarting with an empty state still outruns its old messages. A
+// message whose predecessors never come is shown after causalWait anyway.
+
+// VectorClock maps authors to their clocks.
+type VectorClock map[string]uint64
+
+func (c VectorClock) marshal(w *payloadWriter) {
+	w.uvarint(uint64(len(c)))
+	for _, ID := range slices.Sorted(maps.Keys(c)) {
+		w.string(ID)
+		w.uvarint(c[ID])
+	}
+}
+
+// unmarshalClock refuses clocks far ahead of the wall clock: one would
+// hold the node's own clock there for good, or wrap it around.
+func unmarshalClock(r *payloadReader) VectorClock {
+	limit := uint64(time.Now().Add(maxClockSkew).UnixMilli())
+	n := r.uvarint(uint64(maxRoomMembers))
+	c := make(VectorClock, n)
+	for range n {
+		ID := r.id()
+		c[ID] = r.uvarint(limit)
+	}
+	return c
+}
+
+// compareMessages orders a conversation. A message always has a greater
+// clock of its author than the messages it follows.
+func compareMessages(a, b ChatMessage) int {
+	return cmp.Or(
+		cmp.Compare(a.Clock[a.Author], b.Clock[b.Author]),
+		strings.Compare(a.Author, b.Author),
+		strings.Compare(a.ID, b.ID),
+	)
+}
+
+// conversationKey is a room, or a member for direct messages.
+type conversationKey struct {
+	room string
+	peer string
+}
+
+func conversationOf(m ChatMessage) conversationKey {
+	if m.Room != "" {
+		return conversationKey{room: m.Room}
+	}
+	return conversationKey{peer: m.Author}
+}
+
+type heldMessage struct {
+	message ChatMessage
+	since   time.Time
+}
+
+type conversation struct {
+	// clock is the latest shown message of every author.
+	clock   VectorClock
+	held    []heldMessage
+	history []ChatMessage
+}
+
+type conversations struct {
+	mu    sync.Mutex
+	self  string
+	byKey map[conversationKey]*conversation
+	clock uint64
+}
+
+func newConversations(self string) conversations {
+	return conversations{self: self, byKey: make(map[conversationKey]*conversation)}
+}
+
+// get must be called with the lock held.
+func (cs *conversations) get(key conversationKey) *conversation {
+	c, ok := cs.byKey[key]
+	if !ok {
+		c = &conversation{clock: make(VectorClock)}
+		cs.byKey[key] = c
+	}
+	return c
+}
+
+// stamp puts a message of the node in the conversation.
+func (cs *conversations) stamp(key conversationKey, m *ChatMessage) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c := cs.get(key)
+	cs.clock = max(cs.clock+1, uint64(time.Now().UnixMilli()))
+	m.Clock = maps.Clone(c.clock)
+	m.Clock[cs.self] = cs.clock
+	m.Prev = c.clock[cs.self]
+	c.clock[cs.self] = cs.clock
+	c.remember(*m)
+}
+
+// receive takes in a message of somebody else and returns the messages
+// that can be shown now, in order.
+func (cs *conversations) receive(key conversationKey, m ChatMessage) []ChatMessage {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c := cs.get(key)
+	at, _ := slices.BinarySearchFunc(c.held, m, func(h heldMessage, m ChatMessage) int {
+		return compareMessages(h.message, m)
+	})
+	c.held = slices.Insert(c.held, at, heldMessage{message: m, since: time.Now()})
+
+	out := cs.flush(c)
+	for len(c.held) > maxHeldMessages {
+		out = append(out, cs.force(c)...)
+	}
+	return out
+}
+
+// ready reports whether the messages the message follows have been
+// shown. After the node restarts, the first message of every author
+// waits for causalWait, as the node can't tell what it has missed.
+func (c *conversation) ready(m ChatMessage, self string) bool {
+	if m.Prev > c.clock[m.Author] {
+		return false
+	}
+	for ID, t := range m.Clock {
+		if ID != m.Author && ID != self && t > c.clock[ID] {
+			return false
+		}
+	}
+	return true
+}
+
+// flush shows held messages that are ready, in order. Must be called with
+// the lock held.
+func (cs *conversations) flush(c *conversation) []ChatMessage {
+	var out []ChatMessage
+	for k := 0; k < len(c.held); {
+		m := c.held[k].message
+		if !c.ready(m, cs.self) {
+			k++
+			continue
+		}
+		c.held = slices.Delete(c.held, k, k+1)
+		cs.show(c, m, false)
+		out = append(out, m)
+		// The message may be what the ones before it wait for.
+		k = 0
+	}
+	return out
+}
+
+// force shows the first held message without waiting any longer for what
+// it follows, and whatever is ready after it. Must be called with the
+// lock held.
+func (cs *conversations) force(c *conversation) []ChatMessage {
+	m := c.held[0].message
+	c.held = slices.Delete(c.held, 0, 1)
+	cs.show(c, m, true)
+	return append([]ChatMessage{m}, cs.flush(c)...)
+}
+
+// show moves the clocks forward and puts a message in the history. A
+// forced message also moves clocks of the authors it follows, so others
+// that follow the same don't wait too. Must be called with the lock held.
+func (cs *conversations) show(c *conversation, m ChatMessage, forced bool) {
+	for ID, t := range m.Clock {
+		if ID == cs.self || (ID != m.Author && !forced) {
+			continue
+		}
+		c.clock[ID] = max(c.clock[ID], t)
+	}
+	cs.clock = max(cs.clock, m.Clock[m.Author])
+	c.remember(m)
+}
+
+// remember keeps a message in the history in order. A message that
+// comes late, after those that follow it, is put in its place too.
+func (c *conversation) remember(m ChatMessage) {
+	at, found := slices.BinarySearchFunc(c.history, m, compareMessages)
+	if found {
+		return
+	}
+	c.history = slices.Insert(c.history, at, m)
+	if len(c.history) > maxHistoryMessages {
+		c.history = slices.Delete(c.history, 0, len(c.history)-maxHistoryMessages)
+	}
+}
+
+// adopt takes clocks of authors the node knows nothing about from a
+// member, so that it doesn't wait for messages sent before it came.
+func (cs *conversations) adopt(key conversationKey, clock VectorClock) []ChatMessage {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c := cs.get(key)
+	for ID, t := range clock {
+		if ID != cs.self && c.clock[ID] == 0 {
+			c.clock[ID] = t
+		}
+	}
+	return cs.flush(c)
+}
+
+// expire shows messages held for too long.
+func (cs *conversations) expire() []ChatMessage {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var out []ChatMessage
+	deadline := time.Now().Add(-causalWait)
+	for _, c := range cs.byKey {
+		for slices.ContainsFunc(c.held, func(h heldMessage) bool { return h.since.Before(deadline) }) {
+			out = append(out, cs.force(c)...)
+		}
+	}
+	return out
+}
+
+func (cs *conversations) clockOf(key conversationKey) VectorClock {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if c, ok := cs.byKey[key]; ok {
+		return maps.Clone(c.clock)
+	}
+	return nil
+}
+
+func (cs *conversations) history(key conversationKey) []ChatMessage {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c, ok := cs.byKey[key]
+	if !ok {
+		return []ChatMessage{}
+	}
+	return slices.Clone(c.history)
+}
+
+// ChatHistory returns recent direct messages with a member in the order
+// both sides show them.
+func (n *Network) ChatHistory(ID string) ([]ChatMessage, error) {
+	if !crypt.ValidNodeID(ID) {
+		return nil, fmt.Errorf("%w: malformed ID '%s'", ErrInvalidPeerID, ID)
+	}
+	return n.conversations.history(conversationKey{peer: ID}), nil
+}
+
+// RoomHistory returns recent messages of a room in the order every member
+// shows them.
+func (n *Network) RoomHistory(roomID string) ([]ChatMessage, error) {
+	n.rooms.mu.Lock()
+	_, ok := n.rooms.rooms[roomID]
+	n.rooms.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownRoom, roomID)
+	}
+	return n.conversations.history(conversationKey{room: roomID}), nil
+}
+
+// keepConversations shows messages whose predecessors haven't come in
+// time, until the node stops.
+func (n *Network) keepConversations(ctx context.Context) {
+	ctx = span.Extend(ctx, "network.keepConversations")
+	logger.Debugf(ctx, "Start...")
+
+	ticker := time.NewTicker(causalCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debugf(ctx, "...End")
+			return
+		case <-ticker.C:
+			for _, m := range n.conversations.expire() {
+				logger.Debugf(ctx, "Message '%s' is shown without waiting for what it follows", m.ID)
+				n.chat.publish(m)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestChatClockAheadOfWallClock(t *testing.T) {
+	author := testNodeID(t)
+	now := uint64(time.Now().UnixMilli())
+
+	tests := []struct {
+		name  string
+		clock uint64
+		valid bool
+	}{
+		{"now", now, true},
+		{"within the skew", now + uint64(maxClockSkew.Milliseconds())/2, true},
+		{"past the skew", now + 2*uint64(maxClockSkew.Milliseconds()), false},
+		{"about to wrap", math.MaxUint64, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := ChatMessage{
+				ID:        "message",
+				Author:    author,
+				Timestamp: time.Now(),
+				Clock:     VectorClock{author: tt.clock},
+				Body:      "body",
+			}
+			err := new(ChatMessage).unmarshal(m.marshal())
+			if tt.valid && err != nil {
+				t.Fatalf("m.unmarshal: %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrFieldTooLarge) {
+				t.Fatalf("got %v, want %v", err, ErrFieldTooLarge)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+package network
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+	"udisend/pkg/crypt"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// peerStore is an address book that survives restarts. It's kept in
+// memory and flushed to a JSON file from time to time. A nil store
+// remembers nothing.
+type peerStore struct {
+	mu    sync.Mutex
+	path  string
+	peers map[string]*peerRecord
+	dirty bool
+}
+
+type peerRecord struct {
+	ID       string    `json:"id"`
+	PubKey   string    `json:"pub_key,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	// Addrs are bootstrap addresses, the most recent first.
+	Addrs []string `json:"addrs,omitempty"`
+	// ICEPairs are candidate pairs that carried a connection.
+	ICEPairs []icePair `json:"ice_pairs,omitempty"`
+	Trusted  bool      `json:"trusted,omitempty"`
+	// BlockedUntil is set for members evicted from the cluster.
+	BlockedUntil time.Time `json:"blocked_until,omitzero"`
+}
+
+type icePair struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+func newPeerStore(path string) *peerStore {
+	if path == "" {
+		return nil
+	}
+	return &peerStore{
+		path:  path,
+		peers: make(map[string]*peerRecord),
+	}
+}
+
+func (s *peerStore) load() error {
+	if s == nil {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records []*peerRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range records {
+		if !crypt.ValidNodeID(r.ID) {
+			continue
+		}
+		s.peers[r.ID] = r
+	}
+	return nil
+}
+
+// save writes the store through a temporary file, so a crash never
+// leaves a half-written one behind.
+func (s *peerStore) save() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	records := make([]*peerRecord, 0, len(s.peers))
+	for _, r := range s.peers {
+		records = append(records, r)
+	}
+	slices.SortFunc(records, func(a, b *peerRecord) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	b, err := json.MarshalIndent(records, "", "  ")
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// update changes the record of a peer, creating it when needed. Must
+// not be called on a nil store.
+func (s *peerStore) update(ID string, fn func(r *peerRecord)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.peers[ID]
+	if !ok {
+		r = &peerRecord{ID: ID}
+		s.peers[ID] = r
+	}
+	fn(r)
+	s.dirty = true
+}
+
+func (s *peerStore) seen(ID string) {
+	if s == nil {
+		return
+	}
+	s.update(ID, func(r *peerRecord) {
+		r.LastSeen = time.Now()
+	})
+}
+
+func (s *peerStore) addAddr(ID, addr string) {
+	if s == nil || addr == "" {
+		return
+	}
+	s.update(ID, func(r *peerRecord) {
+		r.Addrs = slices.DeleteFunc(r.Addrs, func(a string) bool { return a == addr })
+		r.Addrs = slices.Insert(r.Addrs, 0, addr)
+		r.Addrs = r.Addrs[:min(len(r.Addrs), maxStoredAddrs)]
+	})
+}
+
+func (s *peerStore) addICEPair(ID string, pair icePair) {
+	if s == nil {
+		return
+	}
+	s.update(ID, func(r *peerRecord) {
+		r.ICEPairs = slices.DeleteFunc(r.ICEPairs, func(p icePair) bool { return p == pair })
+		r.ICEPairs = slices.Insert(r.ICEPairs, 0, pair)
+		r.ICEPairs = r.ICEPairs[:min(len(r.ICEPairs), maxStoredICEPairs)]
+	})
+}
+
+func (s *peerStore) setKey(ID string, key *ecdsa.PublicKey) {
+	if s == nil {
+		return
+	}
+	pubKeyPEM, err := crypt.PublicKeyToPEM(key)
+	if err != nil {
+		logger.Warnf(nil, "peerStore.setKey <ID:%s>: crypt.PublicKeyToPEM: %v", ID, err)
+		return
+	}
+	s.update(ID, func(r *peerRecord) {
+		r.PubKey = pubKeyPEM
+	})
+}
+
+func (s *peerStore) setTrusted(ID string, trusted bool) {
+	if s == nil {
+		return
+	}
+	s.update(ID, func(r *peerRecord) {
+		r.Trusted = trusted
+	})
+}
+
+func (s *peerStore) setBlocked(ID string, until time.Time) {
+	if s == nil {
+		return
+	}
+	s.update(ID, func(r *peerRecord) {
+		r.BlockedUntil = until
+	})
+}
+
+// blocked returns evictions that haven't expired yet.
+func (s *peerStore) blocked() map[string]time.Time {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string]time.Time)
+	for ID, r := range s.peers {
+		if time.Now().Before(r.BlockedUntil) {
+			out[ID] = r.BlockedUntil
+		}
+	}
+	return out
+}
+
+func (s *peerStore) addrs(ID string) []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.peers[ID]
+	if !ok {
+		return nil
+	}
+	return slices.Clone(r.Addrs)
+}
+
+// keys returns stored keys that really belong to their IDs.
+func (s *peerStore) keys() memberKeys {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out memberKeys
+	for ID, r := range s.peers {
+		if r.PubKey == "" {
+			continue
+		}
+		key, err := crypt.GetECDSAPublicKeyFromPEM(r.PubKey)
+		if err != nil || !crypt.CheckNodeID(ID, key) {
+			continue
+		}
+		out = append(out, memberKey{ID: ID, PubKey: key})
+	}
+	return out
+}
+
+// bootstrapAddrs lists addresses to rejoin through: trusted peers first,
+// then the most recently seen ones.
+func (s *peerStore) bootstrapAddrs(except string) []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	records := make([]*peerRecord, 0, len(s.peers))
+	for _, r := range s.peers {
+		if r.ID != except && len(r.Addrs) > 0 {
+			records = append(records, r)
+		}
+	}
+	slices.SortFunc(records, func(a, b *peerRecord) int {
+		if a.Trusted != b.Trusted {
+			if a.Trusted {
+				return -1
+			}
+			return 1
+		}
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+
+	var out []string
+	for _, r := range records {
+		for _, addr := range r.Addrs {
+			if !slices.Contains(out, addr) {
+				out = append(out, addr)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	return out[:min(len(out), maxBootstrapAddrs)]
+}
+
+// keepPeerStore refreshes last-seen of neighbours and flushes the store
+// until the node stops, and once more on the way out.
+func (n *Network) keepPeerStore(ctx context.Context) {
+	if n.peers == nil {
+		return
+	}
+
+	ctx = span.Extend(ctx, "network.keepPeerStore")
+	logger.Debugf(ctx, "Start...")
+
+	ticker := time.NewTicker(peerStoreFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			n.flushPeerStore(ctx)
+			logger.Debugf(ctx, "...End")
+			return
+		case <-ticker.C:
+			n.flushPeerStore(ctx)
+		}
+	}
+}
+
+func (n *Network) flushPeerStore(ctx context.Context) {
+	for _, ID := range n.connectedPeers() {
+		n.peers.seen(ID)
+	}
+	if err := n.peers.save(); err != nil {
+		logger.Errorf(ctx, "n.peers.save: %v", err)
+	}
+}
+
+// rememberPeer stores a neighbour that has proven its ID, along with
+// the address it advertises.
+func (i *interactions) rememberPeer(ID string) {
+	memb, ok := i.getInteraction(ID)
+	if !ok {
+		return
+	}
+	i.peers.seen(ID)
+	i.peers.addAddr(ID, memb.listenAddr)
+}
+
+// TrustPeer marks a peer whose addresses are tried first when rejoining.
+func (n *Network) TrustPeer(ID string, trusted bool) {
+	n.peers.setTrusted(ID, trusted)
+}
+
+// advertisedAddr completes a listen address advertised by a peer with
+// the host it was actually seen at, when the peer didn't name one.
+func advertisedAddr(listenAddr string, observed net.Addr) string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil || port == "" {
+		return ""
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listenAddr
+	}
+	if observed == nil {
+		return ""
+	}
+	observedHost, _, err := net.SplitHostPort(observed.String())
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(observedHost, port)
+}
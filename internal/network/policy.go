@@ -0,0 +1,243 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"udisend/pkg/crypt"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+type PolicyAction string
+
+const (
+	PolicyAllow PolicyAction = "allow"
+	PolicyDeny  PolicyAction = "deny"
+)
+
+// PolicyKind is what a rule matches on. CIDR rules apply to bootstrap
+// connections only, since that's the only transport with a meaningful
+// remote address.
+type PolicyKind string
+
+const (
+	PolicyID          PolicyKind = "id"
+	PolicyFingerprint PolicyKind = "fingerprint"
+	PolicyCIDR        PolicyKind = "cidr"
+	PolicySignal      PolicyKind = "signal"
+)
+
+// PolicyRule allows or denies peers or signals. A deny always wins. Once
+// there is an allow rule of some kind, everything of that kind not
+// allowed explicitly is denied. Handshake signals are out of reach of
+// signal rules, since no peer could be verified otherwise.
+type PolicyRule struct {
+	Action PolicyAction
+	Kind   PolicyKind
+	Value  string
+}
+
+type policy struct {
+	mu    sync.RWMutex
+	rules []PolicyRule
+}
+
+// ParsePolicyRule reads a rule written as 'action:kind:value', e.g.
+// 'deny:cidr:10.0.0.0/8' or 'allow:signal:Ping'.
+func ParsePolicyRule(v string) (PolicyRule, error) {
+	parts := strings.SplitN(v, ":", 3)
+	if len(parts) != 3 {
+		return PolicyRule{}, fmt.Errorf("%w: '%s' must be 'action:kind:value'", ErrInvalidPolicyRule, v)
+	}
+	r := PolicyRule{
+		Action: PolicyAction(parts[0]),
+		Kind:   PolicyKind(parts[1]),
+		Value:  parts[2],
+	}
+	return r, r.validate()
+}
+
+func (r PolicyRule) String() string {
+	return string(r.Action) + ":" + string(r.Kind) + ":" + r.Value
+}
+
+func (r PolicyRule) validate() error {
+	switch r.Action {
+	case PolicyAllow, PolicyDeny:
+	default:
+		return fmt.Errorf("%w: unknown action '%s'", ErrInvalidPolicyRule, r.Action)
+	}
+
+	switch r.Kind {
+	case PolicyID:
+		if !crypt.ValidNodeID(r.Value) {
+			return fmt.Errorf("%w: malformed ID '%s'", ErrInvalidPolicyRule, r.Value)
+		}
+	case PolicyFingerprint:
+		if len(r.Value) != maxFingerprintLength {
+			return fmt.Errorf("%w: malformed fingerprint '%s'", ErrInvalidPolicyRule, r.Value)
+		}
+	case PolicyCIDR:
+		if _, err := netip.ParsePrefix(r.Value); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPolicyRule, err)
+		}
+	case PolicySignal:
+		if _, err := ParsesignalType(r.Value); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPolicyRule, err)
+		}
+	default:
+		return fmt.Errorf("%w: unknown kind '%s'", ErrInvalidPolicyRule, r.Kind)
+	}
+	return nil
+}
+
+func (r PolicyRule) matches(value string) bool {
+	if r.Kind != PolicyCIDR {
+		return r.Value == value
+	}
+	prefix, err := netip.ParsePrefix(r.Value)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return false
+	}
+	return prefix.Contains(addr.Unmap())
+}
+
+func (p *policy) add(r PolicyRule) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if slices.Contains(p.rules, r) {
+		return false
+	}
+	p.rules = append(p.rules, r)
+	return true
+}
+
+func (p *policy) remove(r PolicyRule) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idx := slices.Index(p.rules, r)
+	if idx < 0 {
+		return false
+	}
+	p.rules = slices.Delete(p.rules, idx, idx+1)
+	return true
+}
+
+func (p *policy) list() []PolicyRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return slices.Clone(p.rules)
+}
+
+// permits checks a single property against rules of its kind.
+func (p *policy) permits(kind PolicyKind, value string) bool {
+	if kind == PolicySignal && (handshakeSignals[signalType(value)] || signalType(value) == SignalTypeHello) {
+		return true
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var allowList, allowed bool
+	for _, r := range p.rules {
+		if r.Kind != kind {
+			continue
+		}
+		switch r.Action {
+		case PolicyDeny:
+			if r.matches(value) {
+				return false
+			}
+		case PolicyAllow:
+			allowList = true
+			allowed = allowed || r.matches(value)
+		}
+	}
+	return !allowList || allowed
+}
+
+// checkPolicy decides on a peer by everything known about it so far: the
+// key may be unknown yet, and the address is known for bootstrap
+// connections only.
+func (i *interactions) checkPolicy(ID string, addr net.Addr) error {
+	if !i.policy.permits(PolicyID, ID) {
+		return fmt.Errorf("%w: ID '%s'", ErrDeniedPeer, ID)
+	}
+
+	key := i.memberAuthKey(ID)
+	if key == nil {
+		key = i.candidateAuthKey(ID)
+	}
+	if key != nil {
+		fingerprint, err := crypt.Fingerprint(key)
+		if err != nil {
+			return err
+		}
+		if !i.policy.permits(PolicyFingerprint, fingerprint) {
+			return fmt.Errorf("%w: fingerprint '%s'", ErrDeniedPeer, fingerprint)
+		}
+	}
+
+	if addr != nil {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		if !i.policy.permits(PolicyCIDR, host) {
+			return fmt.Errorf("%w: address '%s'", ErrDeniedPeer, host)
+		}
+	}
+	return nil
+}
+
+// enforcePolicy drops connected peers that current rules deny.
+func (i *interactions) enforcePolicy() {
+	ctx := span.Init("interactions.enforcePolicy")
+
+	type peer struct {
+		ID   string
+		addr net.Addr
+	}
+	var peers []peer
+	i.rangeInteraction(func(memb *interaction) {
+		peers = append(peers, peer{ID: memb.id, addr: memb.remoteAddr})
+	})
+
+	for _, p := range peers {
+		if err := i.checkPolicy(p.ID, p.addr); err != nil {
+			logger.Warnf(ctx, "Disconnecting: %v", err)
+			i.disconnect(p.ID)
+		}
+	}
+}
+
+// AddPolicyRule adds a rule at runtime. Peers the rule denies are
+// disconnected right away.
+func (n *Network) AddPolicyRule(r PolicyRule) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if n.policy.add(r) {
+		n.enforcePolicy()
+	}
+	return nil
+}
+
+// RemovePolicyRule removes a rule and reports whether it was there.
+func (n *Network) RemovePolicyRule(r PolicyRule) bool {
+	return n.policy.remove(r)
+}
+
+func (n *Network) PolicyRules() []PolicyRule {
+	return n.policy.list()
+}
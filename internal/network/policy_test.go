@@ -0,0 +1,24 @@
+package network
+
+import "testing"
+
+func TestSignalAllowListSparesHandshake(t *testing.T) {
+	var p policy
+	p.add(PolicyRule{Action: PolicyAllow, Kind: PolicySignal, Value: SignalTypeChat.String()})
+	p.add(PolicyRule{Action: PolicyDeny, Kind: PolicySignal, Value: SignalTypeDoVerify.String()})
+
+	for s := range handshakeSignals {
+		if !p.permits(PolicySignal, s.String()) {
+			t.Errorf("%s is denied", s)
+		}
+	}
+	if !p.permits(PolicySignal, SignalTypeHello.String()) {
+		t.Errorf("%s is denied", SignalTypeHello)
+	}
+	if !p.permits(PolicySignal, SignalTypeChat.String()) {
+		t.Errorf("%s is denied", SignalTypeChat)
+	}
+	if p.permits(PolicySignal, SignalTypePing.String()) {
+		t.Errorf("%s isn't on the allow list, but is permitted", SignalTypePing)
+	}
+}
@@ -0,0 +1,329 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+	"udisend/pkg/crypt"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// MessageStatus is how far a message has got to a recipient.
+type MessageStatus uint8
+
+const (
+	// StatusPending messages wait in mailboxes for an offline recipient.
+	StatusPending MessageStatus = iota
+	StatusSent
+	StatusDelivered
+	StatusRead
+	// StatusFailed messages got no acknowledgement after all retries.
+	StatusFailed
+)
+
+func (s MessageStatus) String() string {
+	switch s {
+	case StatusPending:
+		return "pending"
+	case StatusSent:
+		return "sent"
+	case StatusDelivered:
+		return "delivered"
+	case StatusRead:
+		return "read"
+	case StatusFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+func (s MessageStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// receipt acknowledges a message on behalf of its recipient: delivered
+// to the node, or read by the user.
+type receipt struct {
+	ID     string
+	Status MessageStatus
+}
+
+func (r receipt) marshal() []byte {
+	var w payloadWriter
+	w.string(r.ID)
+	w.uvarint(uint64(r.Status))
+	return w.buf
+}
+
+func (r *receipt) unmarshal(b []byte) error {
+	pr := payloadReader{buf: b}
+	r.ID = pr.string(maxMessageIDLength)
+	r.Status = MessageStatus(pr.uvarint(uint64(StatusRead)))
+	if err := pr.close(); err != nil {
+		return err
+	}
+	if r.Status != StatusDelivered && r.Status != StatusRead {
+		return fmt.Errorf("%w: receipt status '%s'", ErrInvalidMessage, r.Status)
+	}
+	return nil
+}
+
+type delivery struct {
+	status   MessageStatus
+	attempts int
+	lastSent time.Time
+}
+
+type outgoing struct {
+	message    ChatMessage
+	created    time.Time
+	deliveries map[string]*delivery
+}
+
+// receipts tracks messages of the node until every recipient has read
+// them or they are given up on.
+type receipts struct {
+	mu       sync.Mutex
+	outgoing map[string]*outgoing
+}
+
+func newReceipts() receipts {
+	return receipts{outgoing: make(map[string]*outgoing)}
+}
+
+// track records a message handed to the network for a recipient.
+func (r *receipts) track(m ChatMessage, to string, status MessageStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out, ok := r.outgoing[m.ID]
+	if !ok {
+		if len(r.outgoing) >= maxTrackedMessages {
+			r.forgetOldest()
+		}
+		out = &outgoing{
+			message:    m,
+			created:    time.Now(),
+			deliveries: make(map[string]*delivery),
+		}
+		r.outgoing[m.ID] = out
+	}
+	out.deliveries[to] = &delivery{status: status, lastSent: time.Now()}
+}
+
+// forgetOldest makes room for a new message. Must be called with the
+// lock held.
+func (r *receipts) forgetOldest() {
+	var oldest *outgoing
+	for _, out := range r.outgoing {
+		if oldest == nil || out.created.Before(oldest.created) {
+			oldest = out
+		}
+	}
+	if oldest != nil {
+		delete(r.outgoing, oldest.message.ID)
+	}
+}
+
+// update moves a delivery forward; statuses never go back. It reports
+// whether the status has changed.
+func (r *receipts) update(ID, to string, status MessageStatus) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out, ok := r.outgoing[ID]
+	if !ok {
+		return false
+	}
+	d, ok := out.deliveries[to]
+	if !ok {
+		return false
+	}
+	if d.status != StatusFailed && d.status >= status {
+		return false
+	}
+	d.status = status
+	return true
+}
+
+func (r *receipts) statuses(ID string) (map[string]MessageStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out, ok := r.outgoing[ID]
+	if !ok {
+		return nil, false
+	}
+	statuses := make(map[string]MessageStatus, len(out.deliveries))
+	for to, d := range out.deliveries {
+		statuses[to] = d.status
+	}
+	return statuses, true
+}
+
+type retry struct {
+	message  ChatMessage
+	to       string
+	giveUp   bool
+	attempts int
+}
+
+// due collects deliveries that haven't been acknowledged in time. The
+// wait doubles with every attempt. Messages nobody waits for any more
+// are forgotten.
+func (r *receipts) due() []retry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []retry
+	now := time.Now()
+	for ID, o := range r.outgoing {
+		done := true
+		for _, to := range slices.Sorted(maps.Keys(o.deliveries)) {
+			d := o.deliveries[to]
+			switch d.status {
+			case StatusSent:
+				done = false
+				if now.Sub(d.lastSent) < receiptTimeout<<d.attempts {
+					continue
+				}
+				d.attempts++
+				d.lastSent = now
+				out = append(out, retry{
+					message:  o.message,
+					to:       to,
+					giveUp:   d.attempts > maxRetransmits,
+					attempts: d.attempts,
+				})
+			case StatusPending, StatusDelivered:
+				done = false
+			}
+		}
+		if done || now.Sub(o.created) > mailTTL {
+			delete(r.outgoing, ID)
+		}
+	}
+	return out
+}
+
+// retransmit sends unacknowledged messages again. When retries run out,
+// the message is left in mailboxes, as the recipient is likely gone.
+func (i *interactions) retransmit() {
+	for _, r := range i.receipts.due() {
+		ctx := span.Init("interactions.retransmit <To:%s> <ID:%s>", r.to, r.message.ID)
+
+		if !r.giveUp {
+			i.send(r.to, networkSignal{Type: SignalTypeChat, Payload: r.message.marshal()})
+			logger.Debugf(ctx, "Attempt %d", r.attempts)
+			continue
+		}
+
+		status := StatusPending
+		if err := i.postLetter(r.to, r.message); err != nil {
+			logger.Warnf(ctx, "i.postLetter: %v", err)
+			status = StatusFailed
+		}
+		i.setDelivery(r.message.ID, r.to, status)
+	}
+}
+
+// setDelivery forces a status, unlike acknowledgements that only move it
+// forward.
+func (i *interactions) setDelivery(ID, to string, status MessageStatus) {
+	i.receipts.mu.Lock()
+	o, ok := i.receipts.outgoing[ID]
+	if ok {
+		if d, ok := o.deliveries[to]; ok {
+			d.status = status
+		}
+	}
+	i.receipts.mu.Unlock()
+
+	if ok {
+		i.emit(Event{Type: EventMessageStatus, PeerID: to, Message: ID, Status: status})
+	}
+}
+
+// acknowledge tells the author the message has got here.
+func (i *interactions) acknowledge(m ChatMessage, status MessageStatus) {
+	i.send(m.Author, networkSignal{
+		Type:    SignalTypeReceipt,
+		Payload: receipt{ID: m.ID, Status: status}.marshal(),
+	})
+}
+
+func acceptReceipt(d dispatcher, s incomeSignal) {
+	var r receipt
+	if err := r.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "acceptReceipt <From:%s>: r.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("acceptReceipt <From:%s> <ID:%s> <Status:%s>", s.From, r.ID, r.Status)
+	d.receiveReceipt(s.From, r)
+	logger.Debugf(ctx, "Accepted")
+}
+
+// receiveReceipt only counts receipts of recipients of the message: the
+// sender is authenticated, so nobody can acknowledge for somebody else.
+func (i *interactions) receiveReceipt(from string, r receipt) {
+	// The recipient has got the message, so its letter is no longer
+	// needed, be it the node's own or held for somebody else.
+	i.mail.drop(r.ID, from)
+	if !i.receipts.update(r.ID, from, r.Status) {
+		return
+	}
+	i.emit(Event{Type: EventMessageStatus, PeerID: from, Message: r.ID, Status: r.Status})
+}
+
+// MessageStatus reports how far a message of the node has got to each of
+// its recipients. Messages are tracked until every recipient has read
+// them.
+func (n *Network) MessageStatus(ID string) (map[string]MessageStatus, error) {
+	statuses, ok := n.receipts.statuses(ID)
+	if !ok {
+		return nil, fmt.Errorf("%w: message '%s'", ErrNotFound, ID)
+	}
+	return statuses, nil
+}
+
+// MarkRead tells the author the user has read the message.
+func (n *Network) MarkRead(author, ID string) error {
+	if len(ID) == 0 || len(ID) > maxMessageIDLength {
+		return fmt.Errorf("%w: ID of %d bytes", ErrInvalidChatMessage, len(ID))
+	}
+	if !crypt.ValidNodeID(author) {
+		return fmt.Errorf("%w: malformed ID '%s'", ErrInvalidPeerID, author)
+	}
+	if author == n.ID {
+		return fmt.Errorf("%w: '%s' is the node itself", ErrInvalidPeerID, author)
+	}
+	if n.memberAuthKey(author) == nil && !n.isMember(author) {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMember, author)
+	}
+	n.acknowledge(ChatMessage{ID: ID, Author: author}, StatusRead)
+	return nil
+}
+
+// keepReceipts retransmits unacknowledged messages until the node stops.
+func (n *Network) keepReceipts(ctx context.Context) {
+	ctx = span.Extend(ctx, "network.keepReceipts")
+	logger.Debugf(ctx, "Start...")
+
+	ticker := time.NewTicker(receiptRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debugf(ctx, "...End")
+			return
+		case <-ticker.C:
+			n.retransmit()
+		}
+	}
+}
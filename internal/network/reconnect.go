@@ -0,0 +1,273 @@
+package network
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+type reconnectRequest struct {
+	Want  int
+	Lost  []string
+	Known []string
+}
+
+func (r reconnectRequest) marshal() []byte {
+	var w payloadWriter
+	w.uvarint(uint64(r.Want))
+	w.strings(r.Lost)
+	w.strings(r.Known)
+	return w.buf
+}
+
+func (r *reconnectRequest) unmarshal(b []byte) error {
+	p := payloadReader{buf: b}
+	r.Want = int(p.uvarint(uint64(minNetworkConns)))
+	r.Lost = p.strings(maxReconnectIDs, idLength)
+	r.Known = p.strings(maxReconnectIDs, idLength)
+	return p.close()
+}
+
+type reconnector struct {
+	mu      sync.Mutex
+	lost    map[string]bool
+	attempt int
+	next    time.Time
+}
+
+func (i *interactions) markLost(ID string) {
+	i.reconnect.mu.Lock()
+	defer i.reconnect.mu.Unlock()
+
+	if len(i.reconnect.lost) == 0 {
+		i.reconnect.attempt = 0
+		i.reconnect.next = time.Now()
+	}
+	i.reconnect.lost[ID] = true
+}
+
+func (i *interactions) markFound(ID string) {
+	i.reconnect.mu.Lock()
+	defer i.reconnect.mu.Unlock()
+
+	if !i.reconnect.lost[ID] {
+		return
+	}
+	delete(i.reconnect.lost, ID)
+	i.emit(Event{Type: EventReconnected, PeerID: ID})
+}
+
+// forgetLost stops reconnecting to a peer that is known to be gone.
+func (i *interactions) forgetLost(ID string) {
+	i.reconnect.mu.Lock()
+	defer i.reconnect.mu.Unlock()
+	delete(i.reconnect.lost, ID)
+}
+
+func (i *interactions) connectedPeers() []string {
+	var out []string
+	i.rangeInteraction(func(memb *interaction) {
+		memb.mu.RLock()
+		defer memb.mu.RUnlock()
+		if memb.state == Connected {
+			out = append(out, memb.id)
+		}
+	})
+	return out
+}
+
+// keepConnected restores the mesh after peers drop: it asks a
+// neighbour to introduce the node again, or dials the entry point when
+// no neighbour is left, backing off exponentially between attempts.
+func (n *Network) keepConnected(ctx context.Context) {
+	ctx = span.Extend(ctx, "network.keepConnected")
+	logger.Debugf(ctx, "Start...")
+	defer logger.Debugf(ctx, "...End")
+
+	ticker := time.NewTicker(reconnectCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.reconnectStep(ctx)
+		}
+	}
+}
+
+func (n *Network) reconnectStep(ctx context.Context) {
+	// Interactions are read before the reconnector is locked: the
+	// cleanup of a dropped connection takes those locks in reverse.
+	peers := n.connectedPeers()
+
+	lost, attempt, ok := n.nextReconnectAttempt(ctx, len(peers))
+	if !ok {
+		return
+	}
+
+	if len(peers) == 0 {
+		if err := n.dialEntryPoint(ctx); err != nil {
+			logger.Warnf(ctx, "n.dialEntryPoint: %v", err)
+		}
+		return
+	}
+
+	introducer := peers[rand.IntN(len(peers))]
+	logger.Debugf(ctx, "Attempt %d through %s", attempt, introducer)
+	n.send(introducer, networkSignal{
+		Type: SignalTypeReconnect,
+		Payload: reconnectRequest{
+			Want:  minNetworkConns - len(peers),
+			Lost:  lost,
+			Known: peers,
+		}.marshal(),
+	})
+}
+
+func (i *interactions) nextReconnectAttempt(ctx context.Context, connected int) ([]string, int, bool) {
+	r := &i.reconnect
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.lost) == 0 {
+		return nil, 0, false
+	}
+
+	if connected >= minNetworkConns {
+		logger.Debugf(ctx, "Enough connections again")
+		clear(r.lost)
+		return nil, 0, false
+	}
+
+	if time.Now().Before(r.next) {
+		return nil, 0, false
+	}
+
+	if r.attempt >= maxReconnectAttempts {
+		logger.Warnf(ctx, "Giving up after %d attempts", r.attempt)
+		for ID := range r.lost {
+			i.emit(Event{Type: EventReconnectFailed, PeerID: ID})
+		}
+		clear(r.lost)
+		return nil, 0, false
+	}
+
+	r.attempt++
+	delay := backoff(r.attempt)
+	r.next = time.Now().Add(delay)
+
+	lost := make([]string, 0, len(r.lost))
+	for ID := range r.lost {
+		lost = append(lost, ID)
+		i.emit(Event{
+			Type:    EventReconnecting,
+			PeerID:  ID,
+			Attempt: r.attempt,
+			Delay:   delay,
+		})
+	}
+
+	return lost, r.attempt, true
+}
+
+// backoff returns a delay from the upper half of the exponentially
+// growing window, so nodes that lost the same peer don't retry in step.
+func backoff(attempt int) time.Duration {
+	d := min(reconnectBaseDelay<<(attempt-1), reconnectMaxDelay)
+	return d/2 + rand.N(d/2+1)
+}
+
+func introduce(d dispatcher, s incomeSignal) {
+	ctx := span.Init("introduce <Requester:%s>", s.From)
+	logger.Debugf(ctx, "Start...")
+
+	var req reconnectRequest
+	if err := req.unmarshal(s.Payload); err != nil {
+		logger.Warnf(ctx, "req.unmarshal: %v", err)
+		return
+	}
+
+	requester, ok := d.getInteraction(s.From)
+	if !ok {
+		return
+	}
+	requester.mu.RLock()
+	state := requester.state
+	requester.mu.RUnlock()
+	if state != Connected {
+		logger.Warnf(ctx, "Requester isn't connected")
+		return
+	}
+
+	// Lost peers go first: restoring the old links is preferred over
+	// building new ones.
+	var candidates []string
+	d.rangeInteraction(func(memb *interaction) {
+		if memb.id == s.From || slices.Contains(req.Known, memb.id) {
+			return
+		}
+		memb.mu.RLock()
+		defer memb.mu.RUnlock()
+		if memb.state == Connected {
+			candidates = append(candidates, memb.id)
+		}
+	})
+	slices.SortFunc(candidates, func(a, b string) int {
+		aLost, bLost := slices.Contains(req.Lost, a), slices.Contains(req.Lost, b)
+		switch {
+		case aLost == bLost:
+			return 0
+		case aLost:
+			return -1
+		}
+		return 1
+	})
+	if len(candidates) > req.Want {
+		candidates = candidates[:req.Want]
+	}
+
+	for _, target := range candidates {
+		introduceTo(d, s.From, target)
+	}
+
+	logger.Debugf(ctx, "...End")
+}
+
+func introduceTo(d dispatcher, requester, target string) {
+	ctx := span.Init("introduceTo <Requester:%s> <Target:%s>", requester, target)
+
+	d.addReaction(d.timeout(2, waitingSignTimeout, target),
+		func(nextS incomeSignal) bool {
+			if nextS.Type != SignalTypeSendConnectionSign {
+				return false
+			}
+			if nextS.From != target {
+				return false
+			}
+			var sign connectionSign
+			if err := sign.unmarshal(nextS.Payload); err != nil {
+				return false
+			}
+			if sign.To != requester {
+				return false
+			}
+
+			logger.Debugf(ctx, "Going to send sign")
+			d.send(requester, networkSignal{
+				Type:    SignalTypeMakeOffer,
+				Payload: nextS.Payload,
+			})
+			return true
+		})
+
+	d.send(target, networkSignal{
+		Type:    SignalTypeGenerateConnectionSign,
+		Payload: []byte(requester),
+	})
+}
@@ -0,0 +1,562 @@
+package network
+
+import (
+	"crypto/rand"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// Rooms have no owner: every participant keeps the state of the room and
+// passes changes to the others. Each participant's status and the name
+// are last-writer-wins registers, so states converge whatever order
+// changes arrive in.
+
+type roomStatus uint8
+
+const (
+	roomInvited roomStatus = iota + 1
+	roomJoined
+	roomLeft
+)
+
+type roomEventKind uint8
+
+const (
+	roomEventInvited roomEventKind = iota + 1
+	roomEventJoined
+	roomEventLeft
+	roomEventRenamed
+)
+
+type roomMember struct {
+	status  roomStatus
+	version uint64
+}
+
+type room struct {
+	ID          string
+	name        string
+	nameVersion uint64
+	members     map[string]roomMember
+	// clock is the clock of the room's conversation. It's only passed
+	// along with the state, so newcomers don't wait for messages sent
+	// before they came.
+	clock VectorClock
+}
+
+// RoomInfo describes a room the node takes part in.
+type RoomInfo struct {
+	ID      string
+	Name    string
+	Members []string
+	Invited []string
+}
+
+// roomEvent is a change made by Actor. Only joined members change the
+// room, and everybody changes only their own status, except for invites.
+type roomEvent struct {
+	Room    string
+	Kind    roomEventKind
+	Actor   string
+	Subject string
+	Name    string
+	Version uint64
+}
+
+type rooms struct {
+	mu    sync.Mutex
+	rooms map[string]*room
+	clock uint64
+}
+
+func newRooms() rooms {
+	return rooms{rooms: make(map[string]*room)}
+}
+
+// nextVersion stamps local changes. Versions follow the clock, so a
+// member restarting with an empty state still outruns its old changes.
+// Must be called with the rooms lock held.
+func (r *rooms) nextVersion() uint64 {
+	r.clock = max(r.clock+1, uint64(time.Now().UnixNano()))
+	return r.clock
+}
+
+func (e roomEvent) marshal() []byte {
+	var w payloadWriter
+	w.string(e.Room)
+	w.uvarint(uint64(e.Kind))
+	w.string(e.Actor)
+	w.string(e.Subject)
+	w.string(e.Name)
+	w.uvarint(e.Version)
+	return w.buf
+}
+
+func (e *roomEvent) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	e.Room = r.string(maxMessageIDLength)
+	e.Kind = roomEventKind(r.uvarint(uint64(roomEventRenamed)))
+	e.Actor = r.id()
+	e.Subject = r.id()
+	e.Name = r.string(maxRoomNameLength)
+	e.Version = r.uvarint(1<<64 - 1)
+	if err := r.close(); err != nil {
+		return err
+	}
+	if e.Kind == 0 {
+		return fmt.Errorf("%w: no room event kind", ErrInvalidMessage)
+	}
+	if aheadOfClock(e.Version) {
+		return fmt.Errorf("%w: version %d is ahead of the clock", ErrInvalidMessage, e.Version)
+	}
+	return nil
+}
+
+// aheadOfClock reports whether a version is too far in the future to be
+// a real one. Such a version would win over any change for good.
+func aheadOfClock(version uint64) bool {
+	return version > uint64(time.Now().Add(maxClockSkew).UnixNano())
+}
+
+func (rm *room) marshal() []byte {
+	var w payloadWriter
+	w.string(rm.ID)
+	w.string(rm.name)
+	w.uvarint(rm.nameVersion)
+	w.uvarint(uint64(len(rm.members)))
+	for _, ID := range slices.Sorted(maps.Keys(rm.members)) {
+		m := rm.members[ID]
+		w.string(ID)
+		w.uvarint(uint64(m.status))
+		w.uvarint(m.version)
+	}
+	rm.clock.marshal(&w)
+	return w.buf
+}
+
+func (rm *room) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	rm.ID = r.string(maxMessageIDLength)
+	rm.name = r.string(maxRoomNameLength)
+	rm.nameVersion = r.uvarint(1<<64 - 1)
+	n := r.uvarint(uint64(maxRoomMembers))
+	rm.members = make(map[string]roomMember, n)
+	for range n {
+		ID := r.id()
+		status := roomStatus(r.uvarint(uint64(roomLeft)))
+		version := r.uvarint(1<<64 - 1)
+		if status == 0 {
+			return fmt.Errorf("%w: no room status", ErrInvalidMessage)
+		}
+		if aheadOfClock(version) {
+			return fmt.Errorf("%w: version %d is ahead of the clock", ErrInvalidMessage, version)
+		}
+		rm.members[ID] = roomMember{status: status, version: version}
+	}
+	rm.clock = unmarshalClock(&r)
+	if err := r.close(); err != nil {
+		return err
+	}
+	if aheadOfClock(rm.nameVersion) {
+		return fmt.Errorf("%w: version %d is ahead of the clock", ErrInvalidMessage, rm.nameVersion)
+	}
+	return nil
+}
+
+func (rm *room) status(ID string) roomStatus {
+	return rm.members[ID].status
+}
+
+func (rm *room) joined() []string {
+	return rm.withStatus(roomJoined)
+}
+
+func (rm *room) withStatus(statuses ...roomStatus) []string {
+	var out []string
+	for ID, m := range rm.members {
+		if slices.Contains(statuses, m.status) {
+			out = append(out, ID)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func (rm *room) info() RoomInfo {
+	return RoomInfo{
+		ID:      rm.ID,
+		Name:    rm.name,
+		Members: rm.joined(),
+		Invited: rm.withStatus(roomInvited),
+	}
+}
+
+// setMember applies a status if it's newer. For the same version the
+// later status wins, so that leaving can't be undone by a stale join.
+func (rm *room) setMember(ID string, m roomMember) bool {
+	old, ok := rm.members[ID]
+	if ok && (m.version < old.version || m.version == old.version && m.status <= old.status) {
+		return false
+	}
+	if !ok && len(rm.members) >= maxRoomMembers {
+		return false
+	}
+	rm.members[ID] = m
+	return true
+}
+
+func (rm *room) setName(name string, version uint64) bool {
+	if version < rm.nameVersion || version == rm.nameVersion && name <= rm.name {
+		return false
+	}
+	rm.name, rm.nameVersion = name, version
+	return true
+}
+
+// permits checks that the actor of a change may make it in the current
+// state of the room.
+func (rm *room) permits(e roomEvent) bool {
+	switch e.Kind {
+	case roomEventInvited:
+		return rm.status(e.Actor) == roomJoined && rm.status(e.Subject) != roomJoined
+	case roomEventJoined:
+		return e.Actor == e.Subject && (rm.status(e.Subject) == roomInvited || rm.status(e.Subject) == roomJoined)
+	case roomEventLeft:
+		return e.Actor == e.Subject && rm.status(e.Subject) != roomLeft
+	case roomEventRenamed:
+		return rm.status(e.Actor) == roomJoined
+	}
+	return false
+}
+
+// apply reports whether the event changed the room.
+func (rm *room) apply(e roomEvent) bool {
+	switch e.Kind {
+	case roomEventInvited:
+		return rm.setMember(e.Subject, roomMember{status: roomInvited, version: e.Version})
+	case roomEventJoined:
+		return rm.setMember(e.Subject, roomMember{status: roomJoined, version: e.Version})
+	case roomEventLeft:
+		return rm.setMember(e.Subject, roomMember{status: roomLeft, version: e.Version})
+	case roomEventRenamed:
+		return rm.setName(e.Name, e.Version)
+	}
+	return false
+}
+
+// memberEvent is the change that would have given a member its status.
+func memberEvent(roomID, actor, subject string, m roomMember) roomEvent {
+	e := roomEvent{Room: roomID, Actor: actor, Subject: subject, Version: m.version}
+	switch m.status {
+	case roomInvited:
+		e.Kind = roomEventInvited
+	case roomJoined:
+		e.Kind = roomEventJoined
+	case roomLeft:
+		e.Kind = roomEventLeft
+	}
+	return e
+}
+
+func (e roomEvent) event() Event {
+	out := Event{PeerID: e.Subject, Room: e.Room}
+	switch e.Kind {
+	case roomEventInvited:
+		out.Type = EventRoomInvited
+	case roomEventJoined:
+		out.Type = EventRoomJoined
+	case roomEventLeft:
+		out.Type = EventRoomLeft
+	case roomEventRenamed:
+		out.Type = EventRoomRenamed
+		out.PeerID = e.Actor
+	}
+	return out
+}
+
+// CreateRoom starts a room with the node as its only member.
+func (n *Network) CreateRoom(name string) (RoomInfo, error) {
+	if len(name) == 0 || len(name) > maxRoomNameLength {
+		return RoomInfo{}, fmt.Errorf("%w: name of %d bytes", ErrInvalidRoom, len(name))
+	}
+
+	n.rooms.mu.Lock()
+	defer n.rooms.mu.Unlock()
+
+	version := n.rooms.nextVersion()
+	rm := &room{
+		ID:          rand.Text(),
+		name:        name,
+		nameVersion: version,
+		members:     map[string]roomMember{n.ID: {status: roomJoined, version: version}},
+	}
+	n.rooms.rooms[rm.ID] = rm
+	return rm.info(), nil
+}
+
+// InviteToRoom lets a member join the room. The member gets the state of
+// the room at once, and joins when it calls JoinRoom.
+func (n *Network) InviteToRoom(roomID, ID string) error {
+	if n.memberAuthKey(ID) == nil && !n.isMember(ID) {
+		return fmt.Errorf("%w: '%s'", ErrUnknownMember, ID)
+	}
+	snapshot, err := n.changeRoom(roomEvent{Room: roomID, Kind: roomEventInvited, Subject: ID})
+	if err != nil {
+		return err
+	}
+	n.send(ID, networkSignal{Type: SignalTypeRoomSync, Payload: snapshot})
+	return nil
+}
+
+// JoinRoom accepts an invite.
+func (n *Network) JoinRoom(roomID string) error {
+	_, err := n.changeRoom(roomEvent{Room: roomID, Kind: roomEventJoined, Subject: n.ID})
+	return err
+}
+
+// LeaveRoom tells the others the node has left and forgets the room.
+func (n *Network) LeaveRoom(roomID string) error {
+	if _, err := n.changeRoom(roomEvent{Room: roomID, Kind: roomEventLeft, Subject: n.ID}); err != nil {
+		return err
+	}
+
+	n.rooms.mu.Lock()
+	delete(n.rooms.rooms, roomID)
+	n.rooms.mu.Unlock()
+	return nil
+}
+
+func (n *Network) RenameRoom(roomID, name string) error {
+	if len(name) == 0 || len(name) > maxRoomNameLength {
+		return fmt.Errorf("%w: name of %d bytes", ErrInvalidRoom, len(name))
+	}
+	_, err := n.changeRoom(roomEvent{Room: roomID, Kind: roomEventRenamed, Subject: n.ID, Name: name})
+	return err
+}
+
+func (n *Network) Rooms() []RoomInfo {
+	n.rooms.mu.Lock()
+	defer n.rooms.mu.Unlock()
+
+	out := make([]RoomInfo, 0, len(n.rooms.rooms))
+	for _, rm := range n.rooms.rooms {
+		out = append(out, rm.info())
+	}
+	slices.SortFunc(out, func(a, b RoomInfo) int { return strings.Compare(a.ID, b.ID) })
+	return out
+}
+
+// SendRoom sends a message to every member of the room.
+func (n *Network) SendRoom(roomID, body string) (ChatMessage, error) {
+	if len(body) == 0 || len(body) > maxChatBodyLength {
+		return ChatMessage{}, fmt.Errorf("%w: body of %d bytes", ErrInvalidChatMessage, len(body))
+	}
+
+	n.rooms.mu.Lock()
+	rm, ok := n.rooms.rooms[roomID]
+	if !ok {
+		n.rooms.mu.Unlock()
+		return ChatMessage{}, fmt.Errorf("%w: '%s'", ErrUnknownRoom, roomID)
+	}
+	if rm.status(n.ID) != roomJoined {
+		n.rooms.mu.Unlock()
+		return ChatMessage{}, fmt.Errorf("%w: '%s'", ErrNotRoomMember, roomID)
+	}
+	members := rm.joined()
+	n.rooms.mu.Unlock()
+
+	m := ChatMessage{
+		ID:        rand.Text(),
+		Room:      roomID,
+		Author:    n.ID,
+		Timestamp: time.Now(),
+		Body:      body,
+	}
+	n.conversations.stamp(conversationKey{room: roomID}, &m)
+	for _, ID := range members {
+		if ID == n.ID {
+			continue
+		}
+		n.sendChat(ID, m)
+	}
+	return m, nil
+}
+
+// changeRoom makes a change on behalf of the node and passes it to the
+// other participants: joined and invited members, and whoever the change
+// is about. Invited ones need it too, or they'd join with a stale state.
+// It returns the state of the room after the change.
+func (i *interactions) changeRoom(e roomEvent) ([]byte, error) {
+	ctx := span.Init("interactions.changeRoom <Room:%s> <Subject:%s>", e.Room, e.Subject)
+
+	i.rooms.mu.Lock()
+	rm, ok := i.rooms.rooms[e.Room]
+	if !ok {
+		i.rooms.mu.Unlock()
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownRoom, e.Room)
+	}
+	e.Actor = i.ID
+	e.Version = i.rooms.nextVersion()
+	if !rm.permits(e) {
+		i.rooms.mu.Unlock()
+		return nil, fmt.Errorf("%w: '%s'", ErrNotRoomMember, e.Room)
+	}
+	rm.apply(e)
+	recipients := append(rm.withStatus(roomInvited, roomJoined), e.Subject)
+	rm.clock = i.conversations.clockOf(conversationKey{room: e.Room})
+	snapshot := rm.marshal()
+	i.rooms.mu.Unlock()
+
+	payload := e.marshal()
+	for _, ID := range slices.Compact(slices.Sorted(slices.Values(recipients))) {
+		if ID == i.ID {
+			continue
+		}
+		i.send(ID, networkSignal{Type: SignalTypeRoomEvent, Payload: payload})
+	}
+	i.emit(e.event())
+	logger.Debugf(ctx, "Changed")
+	return snapshot, nil
+}
+
+func acceptRoomEvent(d dispatcher, s incomeSignal) {
+	var e roomEvent
+	if err := e.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "acceptRoomEvent <From:%s>: e.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("acceptRoomEvent <Room:%s> <Actor:%s> <Subject:%s>", e.Room, e.Actor, e.Subject)
+	if e.Actor != s.From {
+		logger.Warnf(ctx, "Actor isn't the sender!")
+		return
+	}
+	if !d.applyRoomEvent(e) {
+		return
+	}
+
+	// The newcomer may have missed changes made since the invite.
+	if e.Kind == roomEventJoined {
+		if snapshot, ok := d.roomSnapshot(e.Room); ok {
+			d.send(e.Subject, networkSignal{Type: SignalTypeRoomSync, Payload: snapshot})
+		}
+	}
+	logger.Debugf(ctx, "Applied")
+}
+
+func acceptRoomSync(d dispatcher, s incomeSignal) {
+	var rm room
+	if err := rm.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "acceptRoomSync <From:%s>: rm.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("acceptRoomSync <Room:%s> <From:%s>", rm.ID, s.From)
+	if rm.status(s.From) != roomJoined {
+		logger.Warnf(ctx, "Sender isn't a member of the room!")
+		return
+	}
+	d.mergeRoom(s.From, &rm)
+	logger.Debugf(ctx, "Merged")
+}
+
+// applyRoomEvent applies a change of a known room and reports whether
+// it was new.
+func (i *interactions) applyRoomEvent(e roomEvent) bool {
+	i.rooms.mu.Lock()
+	rm, ok := i.rooms.rooms[e.Room]
+	if !ok || !rm.permits(e) || !rm.apply(e) {
+		i.rooms.mu.Unlock()
+		return false
+	}
+	i.rooms.mu.Unlock()
+
+	i.emit(e.event())
+	return true
+}
+
+// mergeRoom takes in the state of a room from one of its members. An
+// unknown room is only accepted along with an invite for the node, and
+// then as it is, since there's nothing to check it against. Otherwise
+// only changes the sender could make itself are taken: its own status
+// and invites. Others tell about their statuses themselves.
+func (i *interactions) mergeRoom(from string, in *room) {
+	var events []Event
+
+	i.rooms.mu.Lock()
+	rm, ok := i.rooms.rooms[in.ID]
+	if !ok {
+		if in.status(i.ID) != roomInvited {
+			i.rooms.mu.Unlock()
+			return
+		}
+		rm = &room{ID: in.ID, members: make(map[string]roomMember)}
+		i.rooms.rooms[in.ID] = rm
+		events = append(events, Event{Type: EventRoomInvited, PeerID: i.ID, Room: in.ID})
+	} else if rm.status(from) != roomJoined {
+		i.rooms.mu.Unlock()
+		return
+	}
+
+	if rm.setName(in.name, in.nameVersion) && ok {
+		events = append(events, Event{Type: EventRoomRenamed, PeerID: from, Room: in.ID})
+	}
+	// Checked against the room as it was before the merge, so that the
+	// sender's own leave doesn't take back its invites.
+	members := make(map[string]roomMember, len(in.members))
+	for ID, m := range in.members {
+		// Only the node itself knows whether it has joined or left.
+		if ID == i.ID && ok {
+			continue
+		}
+		if ok && !rm.permits(memberEvent(in.ID, from, ID, m)) {
+			continue
+		}
+		members[ID] = m
+	}
+	for ID, m := range members {
+		if !rm.setMember(ID, m) || !ok {
+			continue
+		}
+		switch m.status {
+		case roomJoined:
+			events = append(events, Event{Type: EventRoomJoined, PeerID: ID, Room: in.ID})
+		case roomLeft:
+			events = append(events, Event{Type: EventRoomLeft, PeerID: ID, Room: in.ID})
+		}
+	}
+	i.rooms.mu.Unlock()
+
+	for _, e := range events {
+		i.emit(e)
+	}
+	for _, m := range i.conversations.adopt(conversationKey{room: in.ID}, in.clock) {
+		i.chat.publish(m)
+	}
+}
+
+func (i *interactions) roomSnapshot(roomID string) ([]byte, bool) {
+	i.rooms.mu.Lock()
+	defer i.rooms.mu.Unlock()
+
+	rm, ok := i.rooms.rooms[roomID]
+	if !ok {
+		return nil, false
+	}
+	rm.clock = i.conversations.clockOf(conversationKey{room: roomID})
+	return rm.marshal(), true
+}
+
+func (i *interactions) isRoomMember(roomID, ID string) bool {
+	i.rooms.mu.Lock()
+	defer i.rooms.mu.Unlock()
+
+	rm, ok := i.rooms.rooms[roomID]
+	return ok && rm.status(ID) == roomJoined
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeRoomTakesOnlyPermittedChanges(t *testing.T) {
+	n := testNetwork(t)
+	from, invited, joined, stranger := testNodeID(t), testNodeID(t), testNodeID(t), testNodeID(t)
+
+	v := uint64(time.Now().UnixNano())
+	n.rooms.rooms["room"] = &room{ID: "room", members: map[string]roomMember{
+		n.ID:    {status: roomJoined, version: v},
+		from:    {status: roomJoined, version: v},
+		invited: {status: roomInvited, version: v},
+		joined:  {status: roomJoined, version: v},
+	}}
+
+	v++
+	n.mergeRoom(from, &room{ID: "room", members: map[string]roomMember{
+		from:     {status: roomLeft, version: v},
+		invited:  {status: roomJoined, version: v},
+		joined:   {status: roomLeft, version: v},
+		stranger: {status: roomInvited, version: v},
+	}})
+
+	rm := n.rooms.rooms["room"]
+	for ID, want := range map[string]roomStatus{
+		from:     roomLeft,
+		invited:  roomInvited,
+		joined:   roomJoined,
+		stranger: roomInvited,
+	} {
+		if got := rm.status(ID); got != want {
+			t.Errorf("status of %s is %d, want %d", ID, got, want)
+		}
+	}
+}
+
+func TestRoomVersionsAheadOfClock(t *testing.T) {
+	ahead := uint64(time.Now().Add(2 * maxClockSkew).UnixNano())
+
+	e := roomEvent{Room: "room", Kind: roomEventRenamed, Actor: testNodeID(t), Name: "name", Version: ahead}
+	if err := new(roomEvent).unmarshal(e.marshal()); err == nil {
+		t.Errorf("event ahead of the clock is accepted")
+	}
+
+	members := &room{ID: "room", members: map[string]roomMember{
+		testNodeID(t): {status: roomJoined, version: ahead},
+	}}
+	if err := new(room).unmarshal(members.marshal()); err == nil {
+		t.Errorf("member version ahead of the clock is accepted")
+	}
+
+	name := &room{ID: "room", name: "name", nameVersion: ahead, members: map[string]roomMember{}}
+	if err := new(room).unmarshal(name.marshal()); err == nil {
+		t.Errorf("name version ahead of the clock is accepted")
+	}
+}
@@ -0,0 +1,278 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// envelope carries a signal to a member that isn't a neighbour. It's
+// signed by the source, since every hop could claim to be anybody else.
+type envelope struct {
+	ID   string
+	Src  string
+	Dst  string
+	TTL  uint8
+	Hops []string
+	networkSignal
+	Signature []byte
+}
+
+// seenCache remembers message IDs for a while, so that copies coming
+// along different paths are dropped.
+type seenCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]time.Time
+}
+
+func newSeenCache(ttl time.Duration) *seenCache {
+	return &seenCache{ttl: ttl, entries: make(map[string]time.Time)}
+}
+
+// seen reports whether an ID has been recorded, without recording it.
+func (c *seenCache) seen(ID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.entries[ID]
+	return ok && time.Now().Before(expires)
+}
+
+// firstSeen records an ID and reports whether it's new.
+func (c *seenCache) firstSeen(ID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if expires, ok := c.entries[ID]; ok && now.Before(expires) {
+		return false
+	}
+	if len(c.entries) >= maxSeenMessages {
+		for key, expires := range c.entries {
+			if now.After(expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	if len(c.entries) >= maxSeenMessages {
+		// Flooded with live IDs: forget an arbitrary one rather than grow.
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[ID] = now.Add(c.ttl)
+	return true
+}
+
+func (e envelope) signed() []byte {
+	var w payloadWriter
+	w.string(e.ID)
+	w.string(e.Src)
+	w.string(e.Dst)
+	w.uvarint(uint64(signalCodes[e.Type]))
+	w.bytes(e.Payload)
+	return w.buf
+}
+
+func (e envelope) marshal() []byte {
+	w := payloadWriter{buf: e.signed()}
+	w.uvarint(uint64(e.TTL))
+	w.strings(e.Hops)
+	w.bytes(e.Signature)
+	return w.buf
+}
+
+func (e *envelope) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	e.ID = r.string(maxMessageIDLength)
+	e.Src = r.id()
+	e.Dst = r.id()
+	code := uint8(r.uvarint(255))
+	e.Payload = r.bytes(maxFrameSize)
+	e.TTL = uint8(r.uvarint(uint64(routedTTL)))
+	e.Hops = readIDs(&r, routedTTL)
+	e.Signature = r.bytes(maxSignatureLength)
+	if err := r.close(); err != nil {
+		return err
+	}
+
+	t, ok := signalTypes[code]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownSignalType, code)
+	}
+	e.Type = t
+	return nil
+}
+
+// route sends a signal to a member through the mesh. When no route to it
+// is known yet, the member is looked up first.
+func (i *interactions) route(ID string, s networkSignal) {
+	ctx := span.Init("interactions.route <ID:%s> <Type:%s>", ID, s.Type)
+
+	if handshakeSignals[s.Type] || s.Type == SignalTypeRouted {
+		logger.Warnf(ctx, "Signal can't be routed")
+		return
+	}
+	if i.memberAuthKey(ID) == nil && !i.isMember(ID) {
+		logger.Debugf(ctx, "Not a member")
+		return
+	}
+
+	e := envelope{
+		ID:            rand.Text(),
+		Src:           i.ID,
+		Dst:           ID,
+		TTL:           uint8(routedTTL),
+		networkSignal: s,
+	}
+	var err error
+	if e.Signature, err = signPayload(i.privateAuth, tagEnvelope, e.signed()); err != nil {
+		logger.Errorf(ctx, "signPayload: %v", err)
+		return
+	}
+	i.routedSeen.firstSeen(e.ID)
+
+	if i.routing.knows(ID) {
+		i.forward(ctx, e)
+		return
+	}
+	go func() {
+		lookupCtx, cancel := context.WithTimeout(context.Background(), dhtLookupTimeout*time.Duration(dhtLookupAttempts))
+		defer cancel()
+		if _, err := findNode(lookupCtx, i, ID); err != nil {
+			logger.Debugf(ctx, "findNode: %v", err)
+		}
+		// The route may be known now; if not, the envelope makes its way
+		// as a lookup would.
+		i.forward(ctx, e)
+	}()
+}
+
+// forward passes an envelope one hop closer to its destination. The source
+// sends copies through several neighbours, as a single path may end up
+// in a dead end; the destination drops all but the first.
+func (i *interactions) forward(ctx context.Context, e envelope) {
+	paths := 1
+	if e.Src == i.ID {
+		paths = routedPaths
+	}
+
+	e.Hops = append(e.Hops, i.ID)
+	exclude := slices.Clone(e.Hops)
+	payload := e.marshal()
+	for range paths {
+		next, ok := i.routing.nextHop(e.Dst, i.connectedPeers(), exclude)
+		if !ok {
+			break
+		}
+		i.send(next, networkSignal{Type: SignalTypeRouted, Payload: payload})
+		logger.Debugf(ctx, "Passed to '%s'", next)
+		exclude = append(exclude, next)
+	}
+	if len(exclude) == len(e.Hops) {
+		logger.Debugf(ctx, "No route to '%s'", e.Dst)
+	}
+}
+
+// acceptRouted handles an envelope: delivers it when it has arrived, or
+// passes it on.
+func acceptRouted(d dispatcher, s incomeSignal) {
+	var e envelope
+	if err := e.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "acceptRouted <From:%s>: e.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("acceptRouted <Src:%s> <Dst:%s> <Type:%s>", e.Src, e.Dst, e.Type)
+	if len(e.Hops) == 0 || e.Hops[len(e.Hops)-1] != s.From {
+		logger.Warnf(ctx, "Hops don't end with the sender!")
+		return
+	}
+	if slices.Contains(e.Hops, d.myID()) || e.Src == d.myID() {
+		logger.Debugf(ctx, "Loop")
+		return
+	}
+	// An ID is recorded only along with a signature that checks out, so
+	// a forged copy coming first doesn't get the real one dropped.
+	if d.wasSeen(e.ID) {
+		logger.Debugf(ctx, "Duplicate")
+		return
+	}
+
+	// Keys spread only to neighbours that are connected at the moment,
+	// so the source may be missed; its key is looked up then, but only
+	// by the destination: a hop just passes the envelope on.
+	key := d.memberAuthKey(e.Src)
+	if key == nil && e.Dst == d.myID() {
+		lookupCtx, cancel := context.WithTimeout(ctx, dhtLookupTimeout*time.Duration(dhtLookupAttempts))
+		defer cancel()
+		var err error
+		if key, err = findAuthKey(lookupCtx, d, e.Src); err != nil {
+			logger.Warnf(ctx, "Unknown source: %v", err)
+			return
+		}
+	}
+	if key != nil {
+		if !verifyPayload(key, tagEnvelope, e.signed(), e.Signature) {
+			logger.Warnf(ctx, "Invalid signature!")
+			return
+		}
+		if !d.firstSeen(e.ID) {
+			logger.Debugf(ctx, "Duplicate")
+			return
+		}
+		// Replies find their way back the same way. Hops aren't signed,
+		// so only the source is learned.
+		d.routes().learn(e.Src, s.From)
+	}
+
+	if e.Dst != d.myID() {
+		if e.TTL <= 1 {
+			logger.Debugf(ctx, "TTL exceeded")
+			return
+		}
+		e.TTL--
+		d.forward(ctx, e)
+		return
+	}
+	if handshakeSignals[e.Type] || e.Type == SignalTypeRouted {
+		logger.Warnf(ctx, "Signal can't be routed")
+		return
+	}
+	if err := d.checkPolicy(e.Src, nil); err != nil {
+		logger.Warnf(ctx, "d.checkPolicy: %v", err)
+		return
+	}
+	if !d.permitsSignal(e.Type) {
+		logger.Debugf(ctx, "Signal is denied")
+		return
+	}
+
+	d.deliver(incomeSignal{From: e.Src, networkSignal: e.networkSignal})
+	logger.Debugf(ctx, "Delivered")
+}
+
+func (i *interactions) firstSeen(ID string) bool {
+	return i.routedSeen.firstSeen(ID)
+}
+
+func (i *interactions) wasSeen(ID string) bool {
+	return i.routedSeen.seen(ID)
+}
+
+func (i *interactions) permitsSignal(t signalType) bool {
+	return i.policy.permits(PolicySignal, t.String())
+}
+
+// deliver hands a signal that came from afar to the same handlers as
+// signals from neighbours.
+func (i *interactions) deliver(s incomeSignal) {
+	i.dispatch(s)
+}
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestAcceptRoutedLearnsVerifiedSourcesOnly(t *testing.T) {
+	srcKey, src := testKey(t)
+	_, unknown := testKey(t)
+	neighbour := testNodeID(t)
+	forged := testNodeID(t)
+	dst := testNodeID(t)
+
+	envelopeFrom := func(t *testing.T, src string, valid bool) envelope {
+		e := envelope{
+			ID:            "message",
+			Src:           src,
+			Dst:           dst,
+			TTL:           uint8(routedTTL),
+			Hops:          []string{forged, neighbour},
+			networkSignal: networkSignal{Type: SignalTypeChat, Payload: []byte("hello")},
+		}
+		var err error
+		if e.Signature, err = signPayload(srcKey, tagEnvelope, e.signed()); err != nil {
+			t.Fatalf("signPayload: %v", err)
+		}
+		if !valid {
+			e.Payload = []byte("bye")
+		}
+		return e
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		valid   bool
+		learned bool
+	}{
+		{"valid signature", src, true, true},
+		{"invalid signature", src, false, false},
+		{"unknown source", unknown, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := testNetwork(t)
+			n.addMembers(memberKeys{{ID: src, PubKey: &srcKey.PublicKey}})
+
+			e := envelopeFrom(t, tt.src, tt.valid)
+			acceptRouted(&n.interactions, incomeSignal{
+				From:          neighbour,
+				networkSignal: networkSignal{Type: SignalTypeRouted, Payload: e.marshal()},
+			})
+
+			if got := n.routing.knows(tt.src); got != tt.learned {
+				t.Fatalf("source is learned: got %t, want %t", got, tt.learned)
+			}
+			if n.routing.knows(forged) {
+				t.Fatalf("unsigned hop is learned")
+			}
+		})
+	}
+
+	t.Run("forged copy first", func(t *testing.T) {
+		n := testNetwork(t)
+		n.addMembers(memberKeys{{ID: src, PubKey: &srcKey.PublicKey}})
+
+		for _, valid := range []bool{false, true} {
+			e := envelopeFrom(t, src, valid)
+			acceptRouted(&n.interactions, incomeSignal{
+				From:          neighbour,
+				networkSignal: networkSignal{Type: SignalTypeRouted, Payload: e.marshal()},
+			})
+			if got := n.wasSeen(e.ID); got != valid {
+				t.Fatalf("seen after a copy with valid=%t: got %t", valid, got)
+			}
+		}
+		if !n.routing.knows(src) {
+			t.Fatalf("real envelope is dropped after a forged copy")
+		}
+	})
+}
@@ -0,0 +1,307 @@
+// Package simnet runs several network.Network instances in one process
+// over a simulated network with configurable latency, loss, reordering
+// and partitions.
+package simnet
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand/v2"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"udisend/internal/network"
+	"udisend/pkg/crypt"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/logging"
+	"github.com/pion/transport/v3/vnet"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	subnet        = "10.0.0.0/24"
+	bootstrapPort = 7000
+	startTimeout  = 5 * time.Second
+	pollInterval  = 10 * time.Millisecond
+)
+
+type Config struct {
+	Nodes int
+	// Latency is added to every packet and every bootstrap write.
+	Latency time.Duration
+	// Jitter is a random extra delay per packet; packets overtake each
+	// other when it's larger than the gap between them.
+	Jitter time.Duration
+	// Loss is a probability of dropping a packet.
+	Loss float64
+	// Options are applied to every started node.
+	Options []network.With
+	// PeerStoreDir, when set, gives every node a peer store file there.
+	PeerStoreDir string
+}
+
+type Node struct {
+	ID      string
+	Addr    string
+	Network *network.Network
+	cancel  context.CancelFunc
+	key     *ecdsa.PrivateKey
+	vn      *vnet.Net
+}
+
+type Stats struct {
+	Delivered int64
+	Dropped   int64
+}
+
+type Cluster struct {
+	Nodes []*Node
+
+	ctx    context.Context
+	cfg    Config
+	router *vnet.Router
+
+	mu        sync.RWMutex
+	listeners map[string]*listener
+	groups    map[string]int
+	latency   time.Duration
+	jitter    time.Duration
+	loss      float64
+
+	delivered atomic.Int64
+	dropped   atomic.Int64
+}
+
+// Start launches cfg.Nodes nodes. The first node is the entry point
+// for all others.
+func Start(ctx context.Context, cfg Config) (*Cluster, error) {
+	router, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          subnet,
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("vnet.NewRouter: %w", err)
+	}
+	if err := router.Start(); err != nil {
+		return nil, fmt.Errorf("router.Start: %w", err)
+	}
+
+	c := &Cluster{
+		ctx:       ctx,
+		cfg:       cfg,
+		router:    router,
+		listeners: make(map[string]*listener),
+		latency:   cfg.Latency,
+		jitter:    cfg.Jitter,
+		loss:      cfg.Loss,
+	}
+
+	for range cfg.Nodes {
+		if _, err := c.AddNode(); err != nil {
+			c.Stop()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// AddNode starts one more node that joins through the first one.
+func (c *Cluster) AddNode() (*Node, error) {
+	privateAuth, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	ID, err := crypt.NodeID(&privateAuth.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return c.addNode(ID, privateAuth)
+}
+
+// addNode starts a node under the ID, which doesn't have to be the one
+// of the key.
+func (c *Cluster) addNode(ID string, privateAuth *ecdsa.PrivateKey) (*Node, error) {
+	idx := len(c.Nodes)
+	host := hostOf(idx)
+
+	vn, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{host}})
+	if err != nil {
+		return nil, fmt.Errorf("vnet.NewNet: %w", err)
+	}
+	if err := c.router.AddNet(vn); err != nil {
+		return nil, fmt.Errorf("router.AddNet: %w", err)
+	}
+
+	node := &Node{
+		ID:   ID,
+		Addr: fmt.Sprintf("%s:%d", host, bootstrapPort),
+		key:  privateAuth,
+		vn:   vn,
+	}
+
+	var entryPoint string
+	if idx > 0 {
+		entryPoint = c.Nodes[0].Addr
+	}
+	if err := c.start(idx, node, entryPoint); err != nil {
+		return nil, err
+	}
+
+	c.Nodes = append(c.Nodes, node)
+	return node, nil
+}
+
+// Restart stops the node and starts it again with the same identity
+// and address. Without an entry point it can only rejoin through its
+// peer store.
+func (c *Cluster) Restart(idx int, entryPoint string) error {
+	node := c.Nodes[idx]
+	node.cancel()
+
+	if !c.Eventually(startTimeout, func() bool {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		_, ok := c.listeners[node.Addr]
+		return !ok
+	}) {
+		return fmt.Errorf("node %d didn't stop listening", idx)
+	}
+
+	return c.start(idx, node, entryPoint)
+}
+
+func (c *Cluster) start(idx int, node *Node, entryPoint string) error {
+	host := hostOf(idx)
+
+	var se webrtc.SettingEngine
+	se.SetNet(&packetNet{Net: node.vn, sim: c, host: host})
+	se.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+
+	opts := []network.With{
+		network.WithListenAddr(node.Addr),
+		network.WithTransport(bootstrapTransport{sim: c, host: host}),
+		network.WithSettingEngine(se),
+	}
+	if entryPoint != "" {
+		opts = append(opts, network.WithEntypoint(entryPoint))
+	}
+	if c.cfg.PeerStoreDir != "" {
+		opts = append(opts, network.WithPeerStore(filepath.Join(c.cfg.PeerStoreDir, host+".json")))
+	}
+	opts = append(opts, c.cfg.Options...)
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	node.Network = network.New(node.ID, &node.key.PublicKey, node.key, opts...)
+	node.cancel = cancel
+	go node.Network.Run(ctx)
+
+	if !c.Eventually(startTimeout, func() bool {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		_, ok := c.listeners[node.Addr]
+		return ok
+	}) {
+		cancel()
+		return fmt.Errorf("node %d didn't start listening", idx)
+	}
+	return nil
+}
+
+func (c *Cluster) Stop() {
+	for _, n := range c.Nodes {
+		n.cancel()
+	}
+	c.router.Stop()
+}
+
+// Partition splits nodes into isolated groups by their indexes. Nodes
+// that aren't listed are put together into one more group.
+func (c *Cluster) Partition(groups ...[]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.groups = make(map[string]int)
+	for g, idxs := range groups {
+		for _, idx := range idxs {
+			c.groups[hostOf(idx)] = g + 1
+		}
+	}
+}
+
+func (c *Cluster) Heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.groups = nil
+}
+
+func (c *Cluster) SetLoss(v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loss = v
+}
+
+func (c *Cluster) SetLatency(latency, jitter time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latency = latency
+	c.jitter = jitter
+}
+
+// Linked reports whether node i sees node j as a connected peer.
+func (c *Cluster) Linked(i, j int) bool {
+	return slices.Contains(c.Nodes[i].Network.Peers(), c.Nodes[j].ID)
+}
+
+// Eventually polls cond until it holds or timeout expires.
+func (c *Cluster) Eventually(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(pollInterval)
+	}
+	return cond()
+}
+
+func (c *Cluster) Stats() Stats {
+	return Stats{
+		Delivered: c.delivered.Load(),
+		Dropped:   c.dropped.Load(),
+	}
+}
+
+func (c *Cluster) link(from, to string) (delay time.Duration, drop, reachable bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.reachable(from, to) {
+		return 0, true, false
+	}
+
+	delay = c.latency
+	if c.jitter > 0 {
+		delay += mrand.N(c.jitter)
+	}
+
+	return delay, mrand.Float64() < c.loss, true
+}
+
+func (c *Cluster) reachable(from, to string) bool {
+	if c.groups == nil {
+		return true
+	}
+	return c.groups[from] == c.groups[to]
+}
+
+func hostOf(idx int) string {
+	return fmt.Sprintf("10.0.0.%d", idx+1)
+}
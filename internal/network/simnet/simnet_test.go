@@ -0,0 +1,375 @@
+package simnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"udisend/internal/network"
+	"udisend/pkg/crypt"
+)
+
+const (
+	joinTimeout     = 15 * time.Second
+	convergeTimeout = 30 * time.Second
+	deliverTimeout  = 20 * time.Second
+)
+
+// startCluster starts nodes one by one, each joining once the one
+// before it has, so the mesh forms the way it does in practice.
+func startCluster(t *testing.T, nodes int, cfg Config) *Cluster {
+	t.Helper()
+
+	cfg.Nodes = 1
+	c, err := Start(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(c.Stop)
+
+	for range nodes - 1 {
+		n, err := c.AddNode()
+		if err != nil {
+			t.Fatalf("AddNode: %v", err)
+		}
+		if !c.Eventually(joinTimeout, func() bool { return len(n.Network.Peers()) > 0 }) {
+			t.Fatalf("node %s didn't join", n.ID)
+		}
+	}
+	return c
+}
+
+// membersConverged reports whether every node sees exactly the others.
+func membersConverged(c *Cluster, nodes ...int) bool {
+	for _, i := range nodes {
+		var want []string
+		for _, j := range nodes {
+			if i != j {
+				want = append(want, c.Nodes[j].ID)
+			}
+		}
+		slices.Sort(want)
+		got := c.Nodes[i].Network.Members()
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// forgedIdentity returns an ID along with a key it isn't derived from.
+func forgedIdentity(t *testing.T) (string, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	owner, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ID, err := crypt.NodeID(&owner.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ID, other
+}
+
+func allNodes(c *Cluster) []int {
+	out := make([]int, len(c.Nodes))
+	for i := range out {
+		out[i] = i
+	}
+	return out
+}
+
+func TestJoin(t *testing.T) {
+	c := startCluster(t, 4, Config{Latency: 2 * time.Millisecond})
+
+	for i := range c.Nodes {
+		if len(c.Nodes[i].Network.Peers()) == 0 {
+			t.Errorf("node %d has no peers", i)
+		}
+	}
+	// The entry point verifies everybody, so it knows all of them.
+	for i := 1; i < len(c.Nodes); i++ {
+		if !c.Eventually(joinTimeout, func() bool {
+			return slices.Contains(c.Nodes[0].Network.Members(), c.Nodes[i].ID)
+		}) {
+			t.Errorf("node %d isn't a member at the entry point", i)
+		}
+	}
+}
+
+// An ID that isn't derived from the node's key fails the challenge, so
+// the node never becomes a peer or a member.
+func TestVerificationRejectsForeignID(t *testing.T) {
+	dir := t.TempDir()
+	c := startCluster(t, 2, Config{Latency: 2 * time.Millisecond, PeerStoreDir: dir})
+
+	ID, key := forgedIdentity(t)
+	if _, err := c.addNode(ID, key); err != nil {
+		t.Fatalf("addNode: %v", err)
+	}
+
+	if c.Eventually(5*time.Second, func() bool {
+		return c.Linked(0, 2) || slices.Contains(c.Nodes[0].Network.Members(), ID)
+	}) {
+		t.Fatalf("node with a foreign ID is admitted")
+	}
+
+	// Nor is it remembered: the store is flushed on the way out.
+	c.Nodes[0].cancel()
+	path := filepath.Join(dir, hostOf(0)+".json")
+	var stored []byte
+	if !c.Eventually(startTimeout, func() bool {
+		stored, _ = os.ReadFile(path)
+		return bytes.Contains(stored, []byte(c.Nodes[1].ID))
+	}) {
+		t.Fatalf("peer store isn't flushed")
+	}
+	if bytes.Contains(stored, []byte(ID)) {
+		t.Fatalf("node with a foreign ID is stored")
+	}
+}
+
+// The joining node challenges the entry point too, so an address that
+// leads to an impostor doesn't get it into a fake cluster.
+func TestVerificationRejectsForeignEntryPoint(t *testing.T) {
+	c, err := Start(context.Background(), Config{Latency: 2 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(c.Stop)
+
+	ID, key := forgedIdentity(t)
+	if _, err := c.addNode(ID, key); err != nil {
+		t.Fatalf("addNode: %v", err)
+	}
+	if _, err := c.AddNode(); err != nil {
+		t.Fatalf("AddNode: %v", err)
+	}
+
+	if c.Eventually(5*time.Second, func() bool {
+		return c.Linked(1, 0) || slices.Contains(c.Nodes[1].Network.Members(), ID)
+	}) {
+		t.Fatalf("entry point with a foreign ID is trusted")
+	}
+}
+
+// A newcomer claiming the ID of a connected member can't take over its
+// connection.
+func TestVerificationKeepsConnectedPeer(t *testing.T) {
+	c := startCluster(t, 2, Config{Latency: 2 * time.Millisecond})
+
+	_, key := forgedIdentity(t)
+	if _, err := c.addNode(c.Nodes[1].ID, key); err != nil {
+		t.Fatalf("addNode: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inbox := c.Nodes[1].Network.ChatMessages(ctx)
+	impostor := c.Nodes[2].Network.ChatMessages(ctx)
+
+	// Give the impostor time to try.
+	time.Sleep(3 * time.Second)
+	if !c.Linked(0, 1) {
+		t.Fatalf("member is disconnected")
+	}
+	sent, err := c.Nodes[0].Network.SendChat(c.Nodes[1].ID, "hello")
+	if err != nil {
+		t.Fatalf("SendChat: %v", err)
+	}
+	select {
+	case got := <-inbox:
+		if got.ID != sent.ID {
+			t.Fatalf("got %+v, want %+v", got, sent)
+		}
+	case got := <-impostor:
+		t.Fatalf("impostor got %+v", got)
+	case <-time.After(deliverTimeout):
+		t.Fatalf("not delivered")
+	}
+}
+
+func TestMembershipConvergence(t *testing.T) {
+	c := startCluster(t, 6, Config{Latency: 2 * time.Millisecond, Jitter: time.Millisecond})
+
+	if !c.Eventually(convergeTimeout, func() bool { return membersConverged(c, allNodes(c)...) }) {
+		for i, n := range c.Nodes {
+			t.Logf("node %d sees %d members", i, len(n.Network.Members()))
+		}
+		t.Fatalf("membership didn't converge")
+	}
+
+	// A stopped node leaves, and everybody else forgets it.
+	c.Nodes[5].cancel()
+	if !c.Eventually(convergeTimeout, func() bool { return membersConverged(c, 0, 1, 2, 3, 4) }) {
+		t.Fatalf("membership didn't converge after a leave")
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	c := startCluster(t, 6, Config{Latency: 2 * time.Millisecond, Jitter: time.Millisecond})
+	if !c.Eventually(convergeTimeout, func() bool { return membersConverged(c, allNodes(c)...) }) {
+		t.Fatalf("membership didn't converge")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inboxes := make([]<-chan network.ChatMessage, len(c.Nodes))
+	for i, n := range c.Nodes {
+		inboxes[i] = n.Network.ChatMessages(ctx)
+	}
+
+	var direct, routed int
+	for from := range c.Nodes {
+		for to := range c.Nodes {
+			if from == to {
+				continue
+			}
+			if c.Linked(from, to) {
+				direct++
+			} else {
+				routed++
+			}
+
+			sent, err := c.Nodes[from].Network.SendChat(c.Nodes[to].ID, "hello")
+			if err != nil {
+				t.Fatalf("SendChat %d -> %d: %v", from, to, err)
+			}
+			select {
+			case got := <-inboxes[to]:
+				if got.ID != sent.ID || got.Author != c.Nodes[from].ID || got.Body != sent.Body {
+					t.Fatalf("%d -> %d: got %+v, want %+v", from, to, got, sent)
+				}
+			case <-time.After(deliverTimeout):
+				t.Fatalf("%d -> %d: not delivered (linked: %t)", from, to, c.Linked(from, to))
+			}
+		}
+	}
+	t.Logf("%d direct and %d routed deliveries", direct, routed)
+	if routed == 0 {
+		t.Logf("every pair is linked, routing isn't exercised")
+	}
+}
+
+func TestDeliveryWithLoss(t *testing.T) {
+	c := startCluster(t, 4, Config{Latency: 2 * time.Millisecond})
+	if !c.Eventually(convergeTimeout, func() bool { return membersConverged(c, allNodes(c)...) }) {
+		t.Fatalf("membership didn't converge")
+	}
+	// Data channels retransmit lost packets, so messages still come,
+	// just later.
+	c.SetLoss(0.1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inbox := c.Nodes[3].Network.ChatMessages(ctx)
+
+	sent, err := c.Nodes[1].Network.SendChat(c.Nodes[3].ID, "hello")
+	if err != nil {
+		t.Fatalf("SendChat: %v", err)
+	}
+	select {
+	case got := <-inbox:
+		if got.ID != sent.ID {
+			t.Fatalf("got %+v, want %+v", got, sent)
+		}
+	case <-time.After(deliverTimeout):
+		t.Fatalf("not delivered")
+	}
+}
+
+// A single-use invite is redeemed only by the inviter, so the newcomer
+// joins through it even when another entry point is configured.
+func TestSingleUseInviteEntersThroughInviter(t *testing.T) {
+	c, err := Start(context.Background(), Config{
+		Nodes:   1,
+		Latency: 2 * time.Millisecond,
+		Options: []network.With{network.WithInviteOnly(true)},
+	})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(c.Stop)
+	inviter := c.Nodes[0]
+
+	invite := func(once bool) network.With {
+		t.Helper()
+		token, err := network.MintInvite(inviter.key, inviter.Addr, time.Hour, once)
+		if err != nil {
+			t.Fatalf("MintInvite: %v", err)
+		}
+		return network.WithInvite(token)
+	}
+
+	c.cfg.Options = append(c.cfg.Options, invite(false))
+	other, err := c.AddNode()
+	if err != nil {
+		t.Fatalf("AddNode: %v", err)
+	}
+	if !c.Eventually(joinTimeout, func() bool { return len(other.Network.Peers()) > 0 }) {
+		t.Fatalf("node with an invite didn't join")
+	}
+
+	c.cfg.Options = []network.With{
+		network.WithInviteOnly(true),
+		invite(true),
+		network.WithEntypoint(other.Addr),
+	}
+	newcomer, err := c.AddNode()
+	if err != nil {
+		t.Fatalf("AddNode: %v", err)
+	}
+	if !c.Eventually(joinTimeout, func() bool {
+		return slices.Contains(inviter.Network.Members(), newcomer.ID)
+	}) {
+		t.Fatalf("node with a single-use invite didn't join")
+	}
+}
+
+// A fingerprint rule holds even though the key of a newcomer arrives
+// after it's let in.
+func TestPolicyDeniesFingerprint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ID, err := crypt.NodeID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := crypt.Fingerprint(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := startCluster(t, 1, Config{
+		Latency: 2 * time.Millisecond,
+		Options: []network.With{network.WithPolicyRules(network.PolicyRule{
+			Action: network.PolicyDeny,
+			Kind:   network.PolicyFingerprint,
+			Value:  fingerprint,
+		})},
+	})
+	c.cfg.Options = nil
+	if _, err := c.addNode(ID, key); err != nil {
+		t.Fatalf("addNode: %v", err)
+	}
+
+	if c.Eventually(5*time.Second, func() bool {
+		return c.Linked(0, 1) || slices.Contains(c.Nodes[0].Network.Members(), ID)
+	}) {
+		t.Fatalf("node with a denied fingerprint is admitted")
+	}
+}
@@ -0,0 +1,182 @@
+package simnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/transport/v3"
+	"github.com/pion/transport/v3/vnet"
+)
+
+var (
+	ErrUnreachable    = errors.New("host unreachable")
+	ErrListenerClosed = errors.New("listener closed")
+)
+
+// bootstrapTransport is an in-memory network.Transport. Streams are
+// reliable and ordered like TCP, so only latency and partitions apply.
+type bootstrapTransport struct {
+	sim  *Cluster
+	host string
+}
+
+func (t bootstrapTransport) Listen(addr string) (net.Listener, error) {
+	l := &listener{
+		sim:    t.sim,
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+
+	t.sim.mu.Lock()
+	defer t.sim.mu.Unlock()
+	t.sim.listeners[addr] = l
+
+	return l, nil
+}
+
+func (t bootstrapTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t.sim.mu.RLock()
+	l, ok := t.sim.listeners[addr]
+	reachable := t.sim.reachable(t.host, host)
+	t.sim.mu.RUnlock()
+	if !ok || !reachable {
+		return nil, ErrUnreachable
+	}
+
+	local, remote := net.Pipe()
+	select {
+	case l.conns <- &streamConn{Conn: remote, sim: t.sim, from: host, to: t.host}:
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return &streamConn{Conn: local, sim: t.sim, from: t.host, to: host}, nil
+}
+
+type listener struct {
+	sim       *Cluster
+	addr      string
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+
+		l.sim.mu.Lock()
+		defer l.sim.mu.Unlock()
+		if l.sim.listeners[l.addr] == l {
+			delete(l.sim.listeners, l.addr)
+		}
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return pipeAddr(l.addr)
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "simnet" }
+func (a pipeAddr) String() string  { return string(a) }
+
+type streamConn struct {
+	net.Conn
+	sim      *Cluster
+	from, to string
+}
+
+// RemoteAddr names the host on the other end, so that address based
+// rules see something better than a pipe.
+func (c *streamConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(c.to)}
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	latency, _, reachable := c.sim.link(c.from, c.to)
+	if !reachable {
+		c.Close()
+		return 0, ErrUnreachable
+	}
+	time.Sleep(latency)
+	return c.Conn.Write(b)
+}
+
+// packetNet wraps vnet.Net so every outgoing datagram gets its own random
+// delay, which is what makes packets overtake each other.
+type packetNet struct {
+	*vnet.Net
+	sim  *Cluster
+	host string
+}
+
+func (n *packetNet) ListenUDP(network string, locAddr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.ListenUDP(network, locAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{UDPConn: conn, sim: n.sim, host: n.host}, nil
+}
+
+func (n *packetNet) ListenPacket(network string, address string) (net.PacketConn, error) {
+	addr, err := n.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return n.ListenUDP(network, addr)
+}
+
+type packetConn struct {
+	transport.UDPConn
+	sim  *Cluster
+	host string
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+
+	delay, drop, reachable := c.sim.link(c.host, host)
+	if drop || !reachable {
+		c.sim.dropped.Add(1)
+		return len(b), nil
+	}
+
+	pkt := append([]byte(nil), b...)
+	time.AfterFunc(delay, func() {
+		if _, err := c.UDPConn.WriteTo(pkt, addr); err == nil {
+			c.sim.delivered.Add(1)
+		}
+	})
+
+	return len(b), nil
+}
+
+func (c *packetConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	return c.WriteTo(b, addr)
+}
@@ -0,0 +1,260 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+)
+
+// Transport carries bootstrap connections between nodes.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+type tcpTransport struct {
+	tlsConfig *tls.Config
+}
+
+func (t tcpTransport) Listen(addr string) (net.Listener, error) {
+	if t.tlsConfig != nil {
+		return tls.Listen("tcp", addr, t.tlsConfig)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (t tcpTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	if t.tlsConfig != nil {
+		tlsDialer := tls.Dialer{NetDialer: &dialer, Config: t.tlsConfig}
+		return tlsDialer.DialContext(ctx, "tcp", addr)
+	}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+type tcpConnection struct {
+	id         string
+	conn       net.Conn
+	version    uint8
+	listenAddr string
+}
+
+func (c *tcpConnection) ID() string {
+	return c.id
+}
+
+func (c *tcpConnection) ListenAddr() string {
+	return c.listenAddr
+}
+
+func (c *tcpConnection) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *tcpConnection) Interact(
+	ctx context.Context,
+	out <-chan networkSignal,
+) <-chan incomeSignal {
+	ctx = span.Extend(ctx, "tcpConnection.Interact")
+	in := make(chan incomeSignal)
+
+	go func() {
+		defer c.conn.Close()
+		for s := range out {
+			if err := writeSignal(c.conn, c.version, s); err != nil {
+				logger.Warnf(ctx, "writeSignal: %v", err)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(in)
+		for {
+			s, err := readSignal(c.conn)
+			if err != nil {
+				logger.Debugf(ctx, "readSignal: %v", err)
+				return
+			}
+			select {
+			case in <- incomeSignal{From: c.id, networkSignal: s}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return in
+}
+
+func (n *Network) listen(ctx context.Context) error {
+	ctx = span.Extend(ctx, "network.listen <Addr:%s>", n.config.listenAddr)
+	logger.Debugf(ctx, "Start...")
+
+	l, err := n.config.transport.Listen(n.config.listenAddr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	go func() {
+		defer logger.Debugf(ctx, "...End")
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Errorf(ctx, "l.Accept: %v", err)
+				}
+				return
+			}
+			go func() {
+				if _, err := n.bootstrap(ctx, conn); err != nil {
+					logger.Warnf(ctx, "bootstrap <Remote:%s>: %v", conn.RemoteAddr(), err)
+					conn.Close()
+				}
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// dialEntryPoint joins the cluster through the configured entry point
+// or, failing that, through addresses remembered from earlier runs.
+func (n *Network) dialEntryPoint(ctx context.Context) error {
+	entryPoint := n.config.entryPoint
+	// The invite is presented to whoever verifies the node; its entry
+	// point is used unless another one is configured. A single-use one
+	// is redeemed only by the inviter, so its entry point always wins.
+	var invitation []byte
+	if n.config.invite != "" {
+		inv, err := parseInvite(n.config.invite)
+		if err != nil {
+			return err
+		}
+		invitation = inv.marshal()
+		if entryPoint == "" || inv.SingleUse {
+			entryPoint = inv.EntryPoint
+		}
+	}
+
+	addrs := n.peers.bootstrapAddrs(n.myID())
+	if entryPoint != "" {
+		addrs = slices.DeleteFunc(addrs, func(a string) bool { return a == entryPoint })
+		addrs = slices.Insert(addrs, 0, entryPoint)
+	}
+	if len(addrs) == 0 {
+		return ErrNoEntryPoint
+	}
+
+	var errs []error
+	for _, addr := range addrs {
+		err := n.dial(ctx, addr, addr == entryPoint, invitation)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Network) dial(ctx context.Context, addr string, trusted bool, invitation []byte) error {
+	ctx = span.Extend(ctx, "network.dial <Addr:%s>", addr)
+	logger.Debugf(ctx, "Start...")
+
+	conn, err := n.config.transport.Dial(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+
+	peerID, err := n.bootstrap(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("bootstrap: %w", err)
+	}
+
+	// The dialled side is challenged before anything it says is trusted,
+	// as the address may lead anywhere.
+	passed := make(chan struct{}, 1)
+	challengePeer(n, peerID, func(context.Context) { passed <- struct{}{} })
+	select {
+	case <-passed:
+	case <-time.After(handshakeTimeout):
+		n.disconnect(peerID)
+		return fmt.Errorf("%w: '%s'", ErrChallengeFailed, peerID)
+	case <-ctx.Done():
+		n.disconnect(peerID)
+		return ctx.Err()
+	}
+
+	n.admitMember(peerID)
+	n.rememberPeer(peerID)
+	// The address is known to work, unlike the one the peer advertises.
+	n.peers.addAddr(peerID, addr)
+	if trusted {
+		n.peers.setTrusted(peerID, true)
+	}
+	n.compareAndSwapInteractionState(peerID, NotVerified, Connected)
+	n.expectChallenge(peerID)
+	n.send(peerID, networkSignal{Type: SignalTypeDoVerify, Payload: invitation})
+
+	logger.Debugf(ctx, "...End")
+	return nil
+}
+
+func (n *Network) bootstrap(ctx context.Context, conn net.Conn) (string, error) {
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return "", err
+	}
+
+	remote, caps, err := exchangeHello(
+		n.myID(),
+		n.config.listenAddr,
+		func(s networkSignal) error { return writeSignal(conn, minProtocolVersion, s) },
+		func() (networkSignal, error) { return readSignal(conn) },
+	)
+	if err != nil {
+		return "", err
+	}
+	peerID := remote.ID
+	if n.isBlocked(peerID) {
+		return "", fmt.Errorf("%w: '%s'", ErrBlockedPeer, peerID)
+	}
+	if err := n.checkPolicy(peerID, conn.RemoteAddr()); err != nil {
+		return "", err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return "", err
+	}
+
+	connCtx, disconnect := context.WithCancel(ctx)
+	if err := n.addConnection(
+		connCtx,
+		&tcpConnection{
+			id:         peerID,
+			conn:       conn,
+			version:    caps.version,
+			listenAddr: advertisedAddr(remote.ListenAddr, conn.RemoteAddr()),
+		},
+		caps,
+		disconnect,
+	); err != nil {
+		disconnect()
+		return "", err
+	}
+	// Both sides present their keys to be challenged with.
+	sendAuthKeys(n, peerID, memberKeys{{ID: n.myID(), PubKey: n.config.pubAuth}})
+
+	return peerID, nil
+}
@@ -0,0 +1,171 @@
+package network
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"sync"
+	"udisend/pkg/crypt"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+
+	"github.com/pion/webrtc/v4"
+)
+
+type iceCandidate struct {
+	To, From  string
+	Candidate []byte
+}
+
+func (c iceCandidate) marshal() []byte {
+	var w payloadWriter
+	w.string(c.To)
+	w.string(c.From)
+	w.bytes(c.Candidate)
+	return w.buf
+}
+
+func (c *iceCandidate) unmarshal(b []byte) error {
+	r := payloadReader{buf: b}
+	c.To = r.id()
+	c.From = r.id()
+	c.Candidate = r.bytes(maxFrameSize)
+	return r.close()
+}
+
+// remoteCandidates holds candidates that arrived before the remote
+// description was set; pion refuses to add them until then.
+type remoteCandidates struct {
+	mu      sync.Mutex
+	pc      *webrtc.PeerConnection
+	pending []webrtc.ICECandidateInit
+}
+
+func (r *remoteCandidates) add(c webrtc.ICECandidateInit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pc == nil {
+		r.pending = append(r.pending, c)
+		return nil
+	}
+	return r.pc.AddICECandidate(c)
+}
+
+func (r *remoteCandidates) ready(pc *webrtc.PeerConnection) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pc = pc
+	for _, c := range r.pending {
+		if err := pc.AddICECandidate(c); err != nil {
+			return err
+		}
+	}
+	r.pending = nil
+	return nil
+}
+
+func trickleCandidates(
+	n dispatcher,
+	pc *webrtc.PeerConnection,
+	introducer, to string,
+	pubRSA *rsa.PublicKey,
+) {
+	ctx := span.Init("trickleCandidates <To:%s>", to)
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			logger.Debugf(ctx, "Gathering completed")
+			return
+		}
+
+		init, err := json.Marshal(c.ToJSON())
+		if err != nil {
+			logger.Errorf(ctx, "json.Marshal: %v", err)
+			return
+		}
+
+		encrypted, err := crypt.SealMessage(init, pubRSA)
+		if err != nil {
+			logger.Errorf(ctx, "crypt.SealMessage: %v", err)
+			return
+		}
+
+		n.send(introducer, networkSignal{
+			Type: SignalTypeSendICECandidate,
+			Payload: iceCandidate{
+				To:        to,
+				From:      n.myID(),
+				Candidate: encrypted,
+			}.marshal(),
+		})
+	})
+}
+
+func awaitCandidates(
+	n dispatcher,
+	introducer, from string,
+	privateRSA *rsa.PrivateKey,
+	candidates *remoteCandidates,
+) {
+	ctx := span.Init("awaitCandidates <From:%s>", from)
+
+	n.addReaction(
+		waitCandidatesTimeout,
+		func(nextS incomeSignal) bool {
+			if nextS.Type != SignalTypeHandleICECandidate {
+				return false
+			}
+			if nextS.From != introducer {
+				return false
+			}
+			var cand iceCandidate
+			if err := cand.unmarshal(nextS.Payload); err != nil {
+				return false
+			}
+			if cand.To != n.myID() || cand.From != from {
+				return false
+			}
+
+			init, err := crypt.OpenMessage(cand.Candidate, privateRSA)
+			if err != nil {
+				logger.Warnf(ctx, "crypt.OpenMessage: %v", err)
+				return false
+			}
+
+			var c webrtc.ICECandidateInit
+			if err := json.Unmarshal(init, &c); err != nil {
+				logger.Warnf(ctx, "json.Unmarshal: %v", err)
+				return false
+			}
+
+			if err := candidates.add(c); err != nil {
+				logger.Warnf(ctx, "candidates.add: %v", err)
+			}
+
+			// Candidates keep coming until gathering on the other side
+			// is over, so the reaction lives until its timeout.
+			return false
+		},
+	)
+}
+
+func relayICECandidate(n dispatcher, s incomeSignal) {
+	var cand iceCandidate
+	if err := cand.unmarshal(s.Payload); err != nil {
+		logger.Warnf(nil, "relayICECandidate <From:%s>: cand.unmarshal: %v", s.From, err)
+		return
+	}
+
+	ctx := span.Init("relayICECandidate <From:%s> <To:%s>", cand.From, cand.To)
+	if cand.From != s.From {
+		logger.Warnf(ctx, "Sender mismatch!")
+		return
+	}
+
+	n.send(cand.To, networkSignal{
+		Type:    SignalTypeHandleICECandidate,
+		Payload: s.Payload,
+	})
+	logger.Debugf(ctx, "Relayed")
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"udisend/pkg/logger"
+	"udisend/pkg/span"
+
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+type TURNServerConfig struct {
+	// ListenAddr is a UDP address the server is bound to.
+	ListenAddr string
+	// PublicIP is advertised to peers and handed out as a relay address.
+	// Defaults to the host of ListenAddr.
+	PublicIP string
+	Realm    string
+	// Users maps usernames to passwords. Without users the server
+	// still answers STUN binding requests.
+	Users map[string]string
+}
+
+func (c TURNServerConfig) publicAddr() (string, error) {
+	host, port, err := net.SplitHostPort(c.ListenAddr)
+	if err != nil {
+		return "", err
+	}
+	if c.PublicIP != "" {
+		host = c.PublicIP
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return "", fmt.Errorf("%w: '%s' can't be advertised", ErrInvalidTURNConfig, host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// iceServers describes the embedded server for the node's own gathering.
+// The node relays through it as the first user by name: any of them
+// would do, and the choice stays the same across restarts.
+func (c TURNServerConfig) iceServers() ([]webrtc.ICEServer, error) {
+	addr, err := c.publicAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []webrtc.ICEServer{{URLs: []string{"stun:" + addr}}}
+	if len(c.Users) > 0 {
+		user := slices.Min(slices.Collect(maps.Keys(c.Users)))
+		out = append(out, webrtc.ICEServer{
+			URLs:           []string{"turn:" + addr + "?transport=udp"},
+			Username:       user,
+			Credential:     c.Users[user],
+			CredentialType: webrtc.ICECredentialTypePassword,
+		})
+	}
+	return out, nil
+}
+
+func (n *Network) serveTURN(ctx context.Context) error {
+	cfg := *n.config.turnServer
+	ctx = span.Extend(ctx, "network.serveTURN <Addr:%s>", cfg.ListenAddr)
+	logger.Debugf(ctx, "Start...")
+
+	servers, err := cfg.iceServers()
+	if err != nil {
+		return err
+	}
+	addr, err := cfg.publicAddr()
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+
+	// Relayed allocations are bound like the server itself: to every
+	// interface when no host is given.
+	bindHost, _, err := net.SplitHostPort(cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	if bindHost == "" {
+		bindHost = "0.0.0.0"
+	}
+
+	conn, err := net.ListenPacket("udp4", cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("net.ListenPacket: %w", err)
+	}
+
+	keys := make(map[string][]byte, len(cfg.Users))
+	for user, password := range cfg.Users {
+		keys[user] = turn.GenerateAuthKey(user, cfg.Realm, password)
+	}
+
+	srv, err := turn.NewServer(turn.ServerConfig{
+		Realm: cfg.Realm,
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			key, ok := keys[username]
+			if !ok {
+				logger.Warnf(ctx, "Unknown TURN user '%s' <Remote:%s>", username, srcAddr)
+			}
+			return key, ok
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: conn,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP(host),
+					Address:      bindHost,
+				},
+			},
+		},
+	})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("turn.NewServer: %w", err)
+	}
+	n.iceServerList = append(servers, n.iceServerList...)
+
+	go func() {
+		<-ctx.Done()
+		if err := srv.Close(); err != nil {
+			logger.Warnf(ctx, "srv.Close: %v", err)
+		}
+		logger.Debugf(ctx, "...End")
+	}()
+
+	return nil
+}
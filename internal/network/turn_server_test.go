@@ -0,0 +1,57 @@
+package network
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestTURNServerIsAdvertisedAfterStart(t *testing.T) {
+	busy, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket: %v", err)
+	}
+	defer busy.Close()
+
+	tests := []struct {
+		name       string
+		listenAddr string
+		advertised bool
+	}{
+		{"all interfaces", ":0", true},
+		{"port in use", busy.LocalAddr().String(), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			n := &Network{config: networkOpts{turnServer: &TURNServerConfig{
+				ListenAddr: tt.listenAddr,
+				PublicIP:   "127.0.0.1",
+				Users:      map[string]string{"bob": "b", "alice": "a"},
+			}}}
+			err := n.serveTURN(ctx)
+			if tt.advertised != (err == nil) {
+				t.Fatalf("serveTURN: %v", err)
+			}
+			if !tt.advertised {
+				if len(n.iceServerList) != 0 {
+					t.Fatalf("servers are advertised: %v", n.iceServerList)
+				}
+				return
+			}
+			if len(n.iceServerList) != 2 {
+				t.Fatalf("got %d servers, want 2", len(n.iceServerList))
+			}
+			if got := n.iceServerList[1].Username; got != "alice" {
+				t.Fatalf("relaying as '%s', want 'alice'", got)
+			}
+			if !slices.Contains(n.iceServerList[0].URLs, "stun:127.0.0.1:0") {
+				t.Fatalf("got %v", n.iceServerList[0].URLs)
+			}
+		})
+	}
+}
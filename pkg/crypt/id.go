@@ -0,0 +1,68 @@
+package crypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+)
+
+// Идентификатор узла устроен как multihash: байт кода хеш-функции и
+// первые 31 байт SHA-256 от DER публичного ключа. В base32 без
+// выравнивания это ровно NodeIDLength символов.
+const (
+	NodeIDLength = 52
+
+	nodeIDHashCode   = 0x12 // sha2-256 в таблице multihash
+	nodeIDDigestSize = 31
+)
+
+var nodeIDEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NodeID выводит идентификатор узла из его публичного ключа.
+func NodeID(pubKey *ecdsa.PublicKey) (string, error) {
+	derBytes, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", fmt.Errorf("ошибка маршалинга публичного ключа: %w", err)
+	}
+
+	digest := sha256.Sum256(derBytes)
+	raw := append([]byte{nodeIDHashCode}, digest[:nodeIDDigestSize]...)
+	return nodeIDEncoding.EncodeToString(raw), nil
+}
+
+// CheckNodeID проверяет, что идентификатор выведен именно из этого ключа.
+func CheckNodeID(ID string, pubKey *ecdsa.PublicKey) bool {
+	expected, err := NodeID(pubKey)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(ID), []byte(expected)) == 1
+}
+
+// ValidNodeID проверяет только формат идентификатора, без ключа.
+func ValidNodeID(ID string) bool {
+	if len(ID) != NodeIDLength {
+		return false
+	}
+	raw, err := nodeIDEncoding.DecodeString(ID)
+	if err != nil {
+		return false
+	}
+	return len(raw) == 1+nodeIDDigestSize && raw[0] == nodeIDHashCode
+}
+
+// Fingerprint возвращает отпечаток ключа: SHA-256 от DER публичного ключа
+// в hex. В отличие от идентификатора, отпечаток не усечён.
+func Fingerprint(pubKey *ecdsa.PublicKey) (string, error) {
+	derBytes, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", fmt.Errorf("ошибка маршалинга публичного ключа: %w", err)
+	}
+
+	digest := sha256.Sum256(derBytes)
+	return hex.EncodeToString(digest[:]), nil
+}
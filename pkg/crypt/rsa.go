@@ -1,14 +1,21 @@
 package crypt
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
+	"fmt"
 )
 
+// ErrNotRSAKey is returned for a public key of another algorithm.
+var ErrNotRSAKey = errors.New("public key is not RSA")
+
 // GenerateRSAKeys генерирует пару RSA 2048-битных ключей
 func GenerateRSAKeys() (*rsa.PrivateKey, *rsa.PublicKey, error) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -60,7 +67,11 @@ func ParsePublicKey(pubPEM []byte) (*rsa.PublicKey, error) {
 		return nil, err
 	}
 
-	return pub.(*rsa.PublicKey), nil
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrNotRSAKey, pub)
+	}
+	return rsaPub, nil
 }
 
 func EncryptMessage(plaintext []byte, publicKey *rsa.PublicKey) ([]byte, error) {
@@ -72,3 +83,69 @@ func EncryptMessage(plaintext []byte, publicKey *rsa.PublicKey) ([]byte, error)
 		nil,
 	)
 }
+
+// SealMessage шифрует сообщение произвольной длины: данные закрываются
+// одноразовым ключом AES-GCM, а сам ключ шифруется RSA-OAEP.
+func SealMessage(plaintext []byte, publicKey *rsa.PublicKey) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	encryptedKey, err := EncryptMessage(key, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 2, 2+len(encryptedKey)+len(nonce)+len(plaintext)+gcm.Overhead())
+	binary.BigEndian.PutUint16(out, uint16(len(encryptedKey)))
+	out = append(out, encryptedKey...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// OpenMessage расшифровывает сообщение, закрытое SealMessage.
+func OpenMessage(ciphertext []byte, privateKey *rsa.PrivateKey) ([]byte, error) {
+	if len(ciphertext) < 2 {
+		return nil, errors.New("sealed message is too short")
+	}
+	keyLen := int(binary.BigEndian.Uint16(ciphertext))
+	ciphertext = ciphertext[2:]
+	if len(ciphertext) < keyLen {
+		return nil, errors.New("sealed message is too short")
+	}
+
+	key, err := DecryptMessage(ciphertext[:keyLen], privateKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext = ciphertext[keyLen:]
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("sealed message is too short")
+	}
+
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
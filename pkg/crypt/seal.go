@@ -0,0 +1,90 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const sealInfo = "udisend seal v1"
+
+// Seal шифрует сообщение для владельца ключа: ECDH с одноразовым ключом
+// P-256, HKDF-SHA256 и AES-256-GCM. Результат: одноразовый публичный
+// ключ, затем nonce и шифртекст. additional не шифруется, но
+// аутентифицируется.
+func Seal(pubKey *ecdsa.PublicKey, plaintext, additional []byte) ([]byte, error) {
+	remote, err := pubKey.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка преобразования публичного ключа: %w", err)
+	}
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ephemeral.ECDH(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	aead, err := sealAEAD(secret, ephemeralPub)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(ephemeralPub, nonce...)
+	return aead.Seal(out, nonce, plaintext, additional), nil
+}
+
+// Open расшифровывает сообщение, зашифрованное Seal.
+func Open(privateKey *ecdsa.PrivateKey, sealed, additional []byte) ([]byte, error) {
+	local, err := privateKey.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка преобразования приватного ключа: %w", err)
+	}
+
+	pubLength := len(local.PublicKey().Bytes())
+	if len(sealed) < pubLength {
+		return nil, errors.New("шифртекст слишком короткий")
+	}
+	ephemeral, err := ecdh.P256().NewPublicKey(sealed[:pubLength])
+	if err != nil {
+		return nil, fmt.Errorf("некорректный одноразовый ключ: %w", err)
+	}
+	secret, err := local.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := sealAEAD(secret, sealed[:pubLength])
+	if err != nil {
+		return nil, err
+	}
+	rest := sealed[pubLength:]
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("шифртекст слишком короткий")
+	}
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], additional)
+}
+
+func sealAEAD(secret, salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, sealInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}